@@ -17,25 +17,57 @@ func main() {
 
 	if len(os.Args) != 4 {
 		fmt.Printf("Usage: %s <target IP> <target Port> <scan type>\n", os.Args[0])
+		fmt.Printf("       %s <capture file> <target Port or 0 for all> offline\n", os.Args[0])
 		return
 	}
-	// get the privileges
-	privileges.Init()
 
-	targetIP := net.ParseIP(os.Args[1])
 	targetPort, err := strconv.Atoi(os.Args[2])
 	if err != nil {
 		log.Fatalf("Invalid port provided: %v\n", err)
 	}
 	var portArr []int
-	portArr = append(portArr, targetPort)
+	if targetPort != 0 {
+		portArr = append(portArr, targetPort)
+	}
 	sType := os.Args[3]
 
+	// reading a capture doesn't need the privileges nor a target
+	if sType == "offline" || sType == "pcap" {
+		hosts, err := scanner.AnalyzePcap(os.Args[1], portArr)
+		if err != nil {
+			log.Fatalf("Analyzing the capture failed: %v\n", err)
+		}
+		for _, h := range hosts {
+			fmt.Println(h.MakeReport())
+		}
+		log.Printf("Analysis took %s\n", time.Since(start))
+		return
+	}
+
+	// get the privileges
+	privileges.Init()
+
+	// PORTSLIBK_BACKEND=afpacket sends and captures without libpcap
+	if b := os.Getenv("PORTSLIBK_BACKEND"); b != "" {
+		if err := scanner.SetPacketBackend(b); err != nil {
+			log.Fatalf("Couldn't pick the packet backend: %v\n", err)
+		}
+	}
+
+	targetIP := net.ParseIP(os.Args[1])
+
 	s, err := scanner.CreateScanner(sType, targetIP, portArr, time.Second*2)
 	if err != nil {
 		log.Fatalf("Couldn't create new scanner: %v\n", err)
 	}
 
+	// PORTSLIBK_TRACE=1 prints every packet the raw scanners send and read
+	if os.Getenv("PORTSLIBK_TRACE") != "" {
+		if t, ok := s.(interface{ SetTracer(scanner.PacketTracer) }); ok {
+			t.SetTracer(scanner.NewTextTracer(os.Stderr))
+		}
+	}
+
 	if err = s.Start(); err != nil {
 		log.Fatalf("Scan failed: %v\n", err)
 	}
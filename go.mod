@@ -2,9 +2,12 @@ module github.com/KennyZ69/portslibK
 
 go 1.23.4
 
-require github.com/google/gopacket v1.1.19
+require (
+	github.com/google/gopacket v1.1.19
+	github.com/phayes/freeport v0.0.0-20220201140144-74d24b5ae9f5
+)
 
 require (
-	github.com/phayes/freeport v0.0.0-20220201140144-74d24b5ae9f5 // indirect
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
 	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
 )
@@ -9,7 +9,6 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 )
 
 type ACKScanner struct {
@@ -20,10 +19,14 @@ type ACKScanner struct {
 	targetPort int
 	ifi        *net.Interface
 	options    gopacket.SerializeOptions
+	timeout    time.Duration // how long to wait for the RST
+	tmplMu     sync.Mutex
+	tmpl       *tcpTemplate // the probe for the link type of the last handle
+	packetTaps
 }
 
 func NewACKScanner(targetIP net.IP, portArr []int) (*ACKScanner, error) {
-	sourceIP, ifi, err := GetSource(targetIP)
+	sourceIP, ifi, err := routeSource(targetIP)
 	if err != nil {
 		return nil, err
 	}
@@ -38,111 +41,111 @@ func NewACKScanner(targetIP net.IP, portArr []int) (*ACKScanner, error) {
 			FixLengths:       true,
 			ComputeChecksums: true,
 		},
+		timeout: time.Second * 5,
 	}, nil
 }
 
-func (s *ACKScanner) buildPacket() ([]byte, error) {
-	eth := layers.Ethernet{
-		SrcMAC:       s.ifi.HardwareAddr,
-		DstMAC:       net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
-		EthernetType: layers.EthernetTypeIPv4,
-	}
-
-	ip4 := layers.IPv4{
-		Version:  4,
-		TTL:      64,
-		IHL:      5,
-		Protocol: layers.IPProtocolTCP,
-		SrcIP:    s.sourceIP,
-		DstIP:    s.targetIP,
-	}
-
-	tcp := layers.TCP{
-		SrcPort: layers.TCPPort(s.sourcePort),
-		DstPort: layers.TCPPort(s.targetPort),
-		Seq:     0,
-		ACK:     true,
-		Window:  14600,
-	}
-
-	tcp.SetNetworkLayerForChecksum(&ip4)
-
-	buf := gopacket.NewSerializeBuffer()
-	if err := gopacket.SerializeLayers(buf, s.options, &eth, &ip4, &tcp); err != nil {
+// the probe goes into buf, a new buffer is only made when it's too small
+func (s *ACKScanner) buildPacket(buf []byte, f linkFraming, port int) ([]byte, error) {
+	t, err := s.template(f)
+	if err != nil {
 		return nil, err
 	}
-
-	return buf.Bytes(), nil
+	return t.packet(t.buffer(buf), s.targetIP, uint16(s.sourcePort), uint16(port)), nil
 }
 
 func (s *ACKScanner) Scan(port int) (string, error) {
 	var report string
 
-	packet, err := s.buildPacket()
+	// the same handle sends and listens, the RST can come back before a second one would be open
+	handle, err := openPacketConn(s.ifi.Name, time.Millisecond*100)
+	if err != nil {
+		return report, err
+	}
+	defer handle.Close()
+
+	f, err := framingFor(handle.LinkType())
+	if err != nil {
+		return report, err
+	}
+	buf := probeBufs.Get().(*[]byte)
+	defer probeBufs.Put(buf)
+	packet, err := s.buildPacket(*buf, f, port)
 	if err != nil {
 		return report, fmt.Errorf("Error building ACK Packet: %v\n", err)
 	}
+	*buf = packet
 
-	if err = s.sendPacket(packet); err != nil {
+	if err = s.sendPacket(handle, packet, port); err != nil {
 		return report, fmt.Errorf("Error sending ACK Packet: %v\n", err)
 	}
 
-	state, err := s.listen(time.Second * 5)
+	state, err := s.listen(handle, f, port, s.timeout)
 	return fmt.Sprintf("%s", state), err
 }
 
-func (s *ACKScanner) sendPacket(packet []byte) error {
-	handle, err := pcap.OpenLive(s.ifi.Name, 65535, true, pcap.BlockForever)
-	if err != nil {
+func (s *ACKScanner) sendPacket(handle PacketConn, packet []byte, port int) error {
+	if err := handle.WritePacketData(packet); err != nil {
 		return err
 	}
-	defer handle.Close()
-
-	return handle.WritePacketData(packet)
+	s.packetTaps.sent(handle.LinkType(), packet, fmt.Sprintf("ACK probe to %s:%d from port %d", s.targetIP, port, s.sourcePort))
+	return nil
 }
 
 // TODO: Add the ackstate type and make open, closed, filtered etc... constants
-func (s *ACKScanner) listen(timeout time.Duration) (ACKState, error) {
-	handle, err := pcap.OpenLive(s.ifi.Name, 65535, true, pcap.BlockForever)
-	if err != nil {
-		return "", err
-	}
-	defer handle.Close()
-
+func (s *ACKScanner) listen(handle PacketConn, f linkFraming, port int, timeout time.Duration) (ACKState, error) {
 	start := time.Now()
 
+	ip4 := &layers.IPv4{}
+	tcp := &layers.TCP{}
+	icmp := &layers.ICMPv4{}
+	inner := &layers.IPv4{} // the header the ICMP quotes
+	payload := &gopacket.Payload{}
+	parser := f.parser(ip4, tcp, icmp, payload)
+	decoded := make([]gopacket.LayerType, 0, 4)
+
 	for {
 		if time.Since(start) > timeout {
 			// return AckFiltered, fmt.Errorf("No response received till timeout\n") // no response gotten
-			return AckFiltered, nil
+			return ackNoReply, nil
 		}
 
-		data, _, err := handle.ReadPacketData()
-		if err == pcap.NextErrorTimeoutExpired {
+		data, ci, err := handle.ReadPacketData()
+		if err == ErrPacketTimeout {
 			continue // no packet is available yet
 		} else if err != nil {
 			return "", fmt.Errorf("Error reading packet: %v\n", err)
 		}
 
-		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
-
-		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
-			tcp, _ := tcpLayer.(*layers.TCP)
-
-			if tcp.SrcPort == layers.TCPPort(s.targetPort) && tcp.DstPort == layers.TCPPort(s.sourcePort) {
-				if tcp.RST {
-					return AckUnfiltered, nil
+		// one parser and its layers for every frame, nothing is allocated per packet
+		parser.DecodeLayers(data, &decoded)
+		switch transportLayer(decoded) {
+		case layers.LayerTypeTCP:
+			if tcp.SrcPort == layers.TCPPort(port) && tcp.DstPort == layers.TCPPort(s.sourcePort) {
+				if state := ackReplyState(tcp); state != "" {
+					s.packetTaps.received(handle.LinkType(), ci, data, fmt.Sprintf("Reply to the ACK probe to %s:%d: %s", s.targetIP, port, state))
+					return state, nil
 				}
 			}
-		}
-
-		// check for ICMP unreachable responses to detect filtered ports by firewalls
-		if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
-			icmp, _ := icmpLayer.(*layers.ICMPv4)
-			if icmp.TypeCode.Type() == layers.ICMPv4TypeDestinationUnreachable {
+		case layers.LayerTypeICMPv4:
+			// an unreachable is about our probe only when it quotes it, any other one is left for its own scan
+			if inner.DecodeFromBytes(icmp.Payload, gopacket.NilDecodeFeedback) != nil || inner.Protocol != layers.IPProtocolTCP ||
+				!inner.DstIP.Equal(s.targetIP) {
+				break
+			}
+			if srcPort, dstPort, ok := innerPorts(inner); !ok || srcPort != s.sourcePort || dstPort != port {
+				break
+			}
+			// only the codes a firewall sends make the port filtered, the same ones nmap takes
+			if icmpProbeState(icmp, layers.IPProtocolTCP) != "" {
+				s.packetTaps.received(handle.LinkType(), ci, data, fmt.Sprintf("ICMP %s to the ACK probe to %s:%d: %s", icmp.TypeCode, s.targetIP, port, AckFiltered))
 				return AckFiltered, nil
 			}
+		case gopacket.LayerTypeZero:
+			s.packetTaps.ignored(handle.LinkType(), ci, data, fmt.Sprintf("neither TCP nor ICMP, %s", decodedLayers(decoded)))
+			continue
 		}
+		s.packetTaps.ignored(handle.LinkType(), ci, data, "not an answer to the ACK probe")
 	}
 }
 
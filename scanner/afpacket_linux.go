@@ -0,0 +1,340 @@
+//go:build linux
+
+package portslibK
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func init() {
+	packetBackends["afpacket"] = OpenAFPacket
+}
+
+// from linux/if_packet.h
+const (
+	solPacket           = 263
+	packetAddMembership = 1
+	packetRxRing        = 5
+	packetVersion       = 10
+	packetMrPromisc     = 1
+	tpacketV3           = 2
+	tpStatusKernel      = 0
+	tpStatusUser        = 1
+	ethPAll             = 0x0003
+	soAttachFilter      = 26
+	pollIn              = 0x1
+
+	// 8 blocks of 1MiB, a block goes to us when it's full or after afpacketBlockTimeout
+	afpacketBlockSize    = 1 << 20
+	afpacketBlockNr      = 8
+	afpacketFrameSize    = 1 << 11
+	afpacketBlockTimeout = 10 // ms
+)
+
+type tpacketReq3 struct {
+	blockSize      uint32
+	blockNr        uint32
+	frameSize      uint32
+	frameNr        uint32
+	retireBlkTov   uint32
+	sizeofPriv     uint32
+	featureReqWord uint32
+}
+
+type packetMreq struct {
+	ifindex int32
+	typ     uint16
+	alen    uint16
+	address [8]byte
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *BPFInstruction
+}
+
+type pollFd struct {
+	fd      int32
+	events  int16
+	revents int16
+}
+
+// afpacketConn reads through a TPACKET_V3 ring mapped from the kernel and writes straight to the socket,
+// it needs neither cgo nor libpcap
+type afpacketConn struct {
+	fd        int
+	ifi       *net.Interface
+	linkType  layers.LinkType
+	timeout   time.Duration
+	ring      []byte
+	block     int         // the block being read
+	started   bool        // the block is ours and pkt, left are set
+	pkt       int         // offset of the next packet in the block
+	left      int         // packets not read yet in the block
+	tx        *afpacketTx // the TX ring of WritePacketBatch, nil until the first batch
+	closeOnce sync.Once
+
+	filterMu sync.Mutex
+	filtered atomic.Bool // a filter replaced the drop all one of setup
+}
+
+// OpenAFPacket is the PacketOpener of the AF_PACKET backend, the interface is put into promiscuous mode like with pcap
+func OpenAFPacket(ifName string, timeout time.Duration) (PacketConn, error) {
+	ifi, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %s: %v", ifName, err)
+	}
+
+	// protocol 0 takes nothing, the socket gets frames from the bind on
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening AF_PACKET socket on %s: %v", ifName, err)
+	}
+	c := &afpacketConn{
+		fd:       fd,
+		ifi:      ifi,
+		linkType: afpacketLinkType(ifName),
+		timeout:  timeout,
+	}
+
+	if err := c.setup(); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Error opening AF_PACKET socket on %s: %v", ifName, err)
+	}
+	return c, nil
+}
+
+func (c *afpacketConn) setup() error {
+	if err := syscall.SetsockoptInt(c.fd, solPacket, packetVersion, tpacketV3); err != nil {
+		return fmt.Errorf("TPACKET_V3: %v", err)
+	}
+
+	req := tpacketReq3{
+		blockSize:    afpacketBlockSize,
+		blockNr:      afpacketBlockNr,
+		frameSize:    afpacketFrameSize,
+		frameNr:      afpacketBlockSize / afpacketFrameSize * afpacketBlockNr,
+		retireBlkTov: afpacketBlockTimeout,
+	}
+	if err := setsockopt(c.fd, solPacket, packetRxRing, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		return fmt.Errorf("RX ring: %v", err)
+	}
+
+	ring, err := syscall.Mmap(c.fd, 0, afpacketBlockSize*afpacketBlockNr, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap: %v", err)
+	}
+	c.ring = ring
+
+	// nothing goes into the ring until there's a filter, the frames of the whole interface would be in front of the
+	// answers otherwise. Without SetBPFFilter the first read or write lets everything through
+	if err := c.attach([]BPFInstruction{{Code: bpfRET | bpfK, K: 0}}); err != nil {
+		return fmt.Errorf("drop filter: %v", err)
+	}
+
+	if err := syscall.Bind(c.fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPAll), Ifindex: c.ifi.Index}); err != nil {
+		return fmt.Errorf("bind: %v", err)
+	}
+
+	mreq := packetMreq{ifindex: int32(c.ifi.Index), typ: packetMrPromisc}
+	if err := setsockopt(c.fd, solPacket, packetAddMembership, unsafe.Pointer(&mreq), unsafe.Sizeof(mreq)); err != nil {
+		return fmt.Errorf("promiscuous mode: %v", err)
+	}
+	return nil
+}
+
+// SetsockoptString passes a pointer and a length, it works for the structs on every arch (386 has no setsockopt syscall)
+func setsockopt(fd, level, name int, val unsafe.Pointer, size uintptr) error {
+	return syscall.SetsockoptString(fd, level, name, unsafe.String((*byte)(val), size))
+}
+
+func htons(v uint16) uint16 {
+	return binary.NativeEndian.Uint16(binary.BigEndian.AppendUint16(nil, v))
+}
+
+// the framing the socket gives, from the ARPHRD type of the interface. The loopback has an ethernet header with
+// zero addresses and tun, wireguard and the like have no header at all
+func afpacketLinkType(ifName string) layers.LinkType {
+	b, err := os.ReadFile("/sys/class/net/" + ifName + "/type")
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	hwType, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	switch hwType {
+	case syscall.ARPHRD_NONE, syscall.ARPHRD_PPP, syscall.ARPHRD_TUNNEL, syscall.ARPHRD_IPGRE:
+		return layers.LinkTypeRaw
+	}
+	return layers.LinkTypeEthernet
+}
+
+// native endian fields of the ring, the kernel writes them
+func (c *afpacketConn) u32(off int) uint32 {
+	return *(*uint32)(unsafe.Pointer(&c.ring[off]))
+}
+
+func (c *afpacketConn) u16(off int) uint16 {
+	return *(*uint16)(unsafe.Pointer(&c.ring[off]))
+}
+
+func (c *afpacketConn) blockStatus() *uint32 {
+	return (*uint32)(unsafe.Pointer(&c.ring[c.block*afpacketBlockSize+8]))
+}
+
+func (c *afpacketConn) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if err := c.unfiltered(); err != nil {
+		return nil, gopacket.CaptureInfo{}, err
+	}
+	var deadline time.Time
+	if c.timeout > 0 {
+		deadline = time.Now().Add(c.timeout)
+	}
+
+	for {
+		if c.ring == nil {
+			return nil, gopacket.CaptureInfo{}, fmt.Errorf("Error reading packet: conn closed")
+		}
+		if atomic.LoadUint32(c.blockStatus())&tpStatusUser == 0 {
+			wait := time.Duration(-1)
+			if !deadline.IsZero() {
+				if wait = time.Until(deadline); wait <= 0 {
+					return nil, gopacket.CaptureInfo{}, ErrPacketTimeout
+				}
+			}
+			if err := c.poll(wait); err != nil {
+				return nil, gopacket.CaptureInfo{}, fmt.Errorf("Error reading packet: %v", err)
+			}
+			continue
+		}
+
+		base := c.block * afpacketBlockSize
+		if !c.started {
+			// struct tpacket_block_desc, the tpacket_hdr_v1 starts at 8
+			c.left = int(c.u32(base + 12))
+			c.pkt = int(c.u32(base + 16))
+			c.started = true
+		}
+		if c.left == 0 {
+			// give the block back to the kernel
+			atomic.StoreUint32(c.blockStatus(), tpStatusKernel)
+			c.block = (c.block + 1) % afpacketBlockNr
+			c.started = false
+			continue
+		}
+
+		// struct tpacket3_hdr
+		hdr := base + c.pkt
+		next := int(c.u32(hdr))
+		sec, nsec := c.u32(hdr+4), c.u32(hdr+8)
+		snaplen, length := int(c.u32(hdr+12)), int(c.u32(hdr+16))
+		mac := int(c.u16(hdr + 24))
+
+		data := make([]byte, snaplen)
+		copy(data, c.ring[hdr+mac:hdr+mac+snaplen])
+		c.left--
+		c.pkt += next
+
+		ci := gopacket.CaptureInfo{
+			Timestamp:      time.Unix(int64(sec), int64(nsec)),
+			CaptureLength:  snaplen,
+			Length:         length,
+			InterfaceIndex: c.ifi.Index,
+		}
+		return data, ci, nil
+	}
+}
+
+// waits for the socket to have a block for us, a negative wait is forever
+func (c *afpacketConn) poll(wait time.Duration) error {
+	pfd := pollFd{fd: int32(c.fd), events: pollIn}
+	var ts *syscall.Timespec
+	if wait >= 0 {
+		t := syscall.NsecToTimespec(int64(wait))
+		ts = &t
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_PPOLL, uintptr(unsafe.Pointer(&pfd)), 1, uintptr(unsafe.Pointer(ts)), 0, 0, 0)
+	if errno != 0 && errno != syscall.EINTR {
+		return errno
+	}
+	return nil
+}
+
+func (c *afpacketConn) WritePacketData(data []byte) error {
+	// the answer can come before the first read
+	if err := c.unfiltered(); err != nil {
+		return err
+	}
+	_, err := syscall.Write(c.fd, data)
+	return err
+}
+
+// SetBPFFilter compiles the filter with CompileBPF and attaches it to the socket. The socket dropped everything
+// until now, so the frames that came before the filter are not in the ring
+func (c *afpacketConn) SetBPFFilter(filter string) error {
+	insns, err := CompileBPF(filter, c.linkType)
+	if err != nil {
+		return err
+	}
+
+	c.filterMu.Lock()
+	defer c.filterMu.Unlock()
+	if err := c.attach(insns); err != nil {
+		return fmt.Errorf("Error attaching BPF filter %q: %v", filter, err)
+	}
+	c.filtered.Store(true)
+	return nil
+}
+
+// the handles without a filter get everything like with pcap, the drop all filter goes once they are used
+func (c *afpacketConn) unfiltered() error {
+	if c.filtered.Load() {
+		return nil
+	}
+	c.filterMu.Lock()
+	defer c.filterMu.Unlock()
+	if c.filtered.Load() {
+		return nil
+	}
+	if err := c.attach([]BPFInstruction{{Code: bpfRET | bpfK, K: bpfSnapLen}}); err != nil {
+		return fmt.Errorf("Error attaching BPF filter: %v", err)
+	}
+	c.filtered.Store(true)
+	return nil
+}
+
+func (c *afpacketConn) attach(insns []BPFInstruction) error {
+	prog := sockFprog{len: uint16(len(insns)), filter: &insns[0]}
+	return setsockopt(c.fd, syscall.SOL_SOCKET, soAttachFilter, unsafe.Pointer(&prog), unsafe.Sizeof(prog))
+}
+
+func (c *afpacketConn) LinkType() layers.LinkType {
+	return c.linkType
+}
+
+func (c *afpacketConn) Close() {
+	c.closeOnce.Do(func() {
+		if c.ring != nil {
+			syscall.Munmap(c.ring)
+			c.ring = nil
+		}
+		syscall.Close(c.fd)
+		if c.tx != nil {
+			c.tx.close()
+		}
+	})
+}
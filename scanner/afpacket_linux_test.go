@@ -0,0 +1,119 @@
+package portslibK
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// needs CAP_NET_RAW, it is skipped without it
+func TestAFPacketLoopback(t *testing.T) {
+	c, err := OpenAFPacket("lo", time.Millisecond*100)
+	if err != nil {
+		t.Skipf("no AF_PACKET socket: %v", err)
+	}
+	defer c.Close()
+
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.LocalAddr().(*net.UDPAddr).Port
+
+	if err := c.SetBPFFilter("udp and dst host 127.0.0.1 and dst port " + strconv.Itoa(port)); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := net.Dial("udp4", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	if _, err := u.Write([]byte("portslibK")); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		data, _, err := c.ReadPacketData()
+		if err == ErrPacketTimeout {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		packet := gopacket.NewPacket(data, c.LinkType(), gopacket.Default)
+		udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+		if !ok || int(udp.DstPort) != port {
+			t.Fatalf("the filter let through %v", packet)
+		}
+		if string(udp.Payload) != "portslibK" {
+			t.Fatalf("got payload %q", udp.Payload)
+		}
+		return
+	}
+	t.Fatal("the datagram was not captured")
+}
+
+func TestAFPacketTimeout(t *testing.T) {
+	c, err := OpenAFPacket("lo", time.Millisecond*50)
+	if err != nil {
+		t.Skipf("no AF_PACKET socket: %v", err)
+	}
+	defer c.Close()
+
+	// nothing on the loopback goes to this port
+	if err := c.SetBPFFilter("udp and dst port 9"); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, _, err := c.ReadPacketData(); err != ErrPacketTimeout {
+		t.Fatalf("got %v, want ErrPacketTimeout", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("the read took %s", d)
+	}
+}
+
+// the frames from before SetBPFFilter must not be read, whatever filter comes later
+func TestAFPacketNothingBeforeFilter(t *testing.T) {
+	c, err := OpenAFPacket("lo", time.Millisecond*50)
+	if err != nil {
+		t.Skipf("no AF_PACKET socket: %v", err)
+	}
+	defer c.Close()
+
+	l, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	u, err := net.Dial("udp4", l.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+
+	// sent before the filter, it matches it but has to be gone
+	if _, err := u.Write([]byte("early")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50) // the ring block retires after 10ms
+	if err := c.SetBPFFilter("udp and dst port " + strconv.Itoa(l.LocalAddr().(*net.UDPAddr).Port)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		data, _, err := c.ReadPacketData()
+		if err == ErrPacketTimeout {
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		t.Fatalf("read a frame from before the filter: %v", gopacket.NewPacket(data, c.LinkType(), gopacket.Default))
+	}
+}
@@ -0,0 +1,164 @@
+//go:build linux
+
+package portslibK
+
+import (
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// from linux/if_packet.h, the TX ring is TPACKET_V2 on a socket of its own since the RX one is V3
+const (
+	packetTxRing        = 13
+	packetQdiscBypass   = 20
+	tpacketV2           = 1
+	tpStatusAvailable   = 0
+	tpStatusSendRequest = 1
+	tpStatusSending     = 2
+	tpStatusWrongFormat = 4
+
+	// the data of a TX frame goes right after the struct tpacket2_hdr
+	tpacket2DataOffset = 32
+
+	afpacketTxBlockSize = 1 << 16
+	afpacketTxBlockNr   = 16
+	afpacketTxFrameSize = 1 << 11
+	afpacketTxFrameNr   = afpacketTxBlockSize / afpacketTxFrameSize * afpacketTxBlockNr
+)
+
+type tpacketReq struct {
+	blockSize uint32
+	blockNr   uint32
+	frameSize uint32
+	frameNr   uint32
+}
+
+// afpacketTx fills the frames of the mapped ring and sends all that are ready with one system call
+type afpacketTx struct {
+	fd    int
+	ring  []byte
+	frame int // the next frame to fill
+}
+
+func newAFPacketTx(ifindex int) (*afpacketTx, error) {
+	// protocol 0, the socket only sends
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, 0)
+	if err != nil {
+		return nil, err
+	}
+	t := &afpacketTx{fd: fd}
+
+	if err := syscall.SetsockoptInt(fd, solPacket, packetVersion, tpacketV2); err != nil {
+		t.close()
+		return nil, fmt.Errorf("TPACKET_V2: %v", err)
+	}
+	// the qdisc is skipped when the kernel can, it's fine when it can't
+	syscall.SetsockoptInt(fd, solPacket, packetQdiscBypass, 1)
+
+	req := tpacketReq{
+		blockSize: afpacketTxBlockSize,
+		blockNr:   afpacketTxBlockNr,
+		frameSize: afpacketTxFrameSize,
+		frameNr:   afpacketTxFrameNr,
+	}
+	if err := setsockopt(fd, solPacket, packetTxRing, unsafe.Pointer(&req), unsafe.Sizeof(req)); err != nil {
+		t.close()
+		return nil, fmt.Errorf("TX ring: %v", err)
+	}
+	ring, err := syscall.Mmap(fd, 0, afpacketTxBlockSize*afpacketTxBlockNr, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		t.close()
+		return nil, fmt.Errorf("mmap: %v", err)
+	}
+	t.ring = ring
+
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Ifindex: ifindex}); err != nil {
+		t.close()
+		return nil, fmt.Errorf("bind: %v", err)
+	}
+	return t, nil
+}
+
+func (t *afpacketTx) status(frame int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&t.ring[frame*afpacketTxFrameSize]))
+}
+
+// the kernel is done with the frame when it's available again, or it didn't take it
+func (t *afpacketTx) free(frame int) bool {
+	s := atomic.LoadUint32(t.status(frame))
+	return s == tpStatusAvailable || s == tpStatusWrongFormat
+}
+
+// send makes the kernel send every frame marked for it and waits until it did
+func (t *afpacketTx) send() error {
+	for {
+		err := syscall.Sendto(t.fd, nil, 0, nil)
+		if err == syscall.EINTR || err == syscall.EAGAIN || err == syscall.ENOBUFS {
+			time.Sleep(time.Microsecond * 50)
+			continue
+		}
+		return err
+	}
+}
+
+// write puts the packets into the ring, sending whenever it is full and once at the end
+func (t *afpacketTx) write(packets [][]byte) (int, error) {
+	queued := 0
+	for i, p := range packets {
+		if len(p) > afpacketTxFrameSize-tpacket2DataOffset {
+			return i, fmt.Errorf("Error writing packet: %d bytes don't fit a TX frame", len(p))
+		}
+		for !t.free(t.frame) {
+			if err := t.send(); err != nil {
+				return i, fmt.Errorf("Error sending the TX ring: %v", err)
+			}
+		}
+
+		// struct tpacket2_hdr, the length goes in tp_len before the frame is handed over
+		base := t.frame * afpacketTxFrameSize
+		copy(t.ring[base+tpacket2DataOffset:], p)
+		*(*uint32)(unsafe.Pointer(&t.ring[base+4])) = uint32(len(p))
+		atomic.StoreUint32(t.status(t.frame), tpStatusSendRequest)
+		t.frame = (t.frame + 1) % afpacketTxFrameNr
+		queued++
+
+		if queued == afpacketTxFrameNr {
+			if err := t.send(); err != nil {
+				return i + 1, fmt.Errorf("Error sending the TX ring: %v", err)
+			}
+			queued = 0
+		}
+	}
+	if queued > 0 {
+		if err := t.send(); err != nil {
+			return len(packets), fmt.Errorf("Error sending the TX ring: %v", err)
+		}
+	}
+	return len(packets), nil
+}
+
+func (t *afpacketTx) close() {
+	if t.ring != nil {
+		syscall.Munmap(t.ring)
+		t.ring = nil
+	}
+	syscall.Close(t.fd)
+}
+
+// WritePacketBatch sends the packets through a TX ring, set up on the first batch
+func (c *afpacketConn) WritePacketBatch(packets [][]byte) (int, error) {
+	if err := c.unfiltered(); err != nil {
+		return 0, err
+	}
+	if c.tx == nil {
+		tx, err := newAFPacketTx(c.ifi.Index)
+		if err != nil {
+			return 0, fmt.Errorf("Error setting up the TX ring on %s: %v", c.ifi.Name, err)
+		}
+		c.tx = tx
+	}
+	return c.tx.write(packets)
+}
@@ -0,0 +1,362 @@
+package portslibK
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BannerInfo is what a text protocol told us after we asked it something harmless
+type BannerInfo struct {
+	Protocol     string
+	Version      string
+	Capabilities []string          // EHLO keywords, FEAT, CAPA and CAPABILITY lists
+	Fields       map[string]string // everything else worth keeping, like the greeting or the redis INFO
+}
+
+// BannerProbe sends safe commands to the text protocols so the ones that don't talk first reveal themselves too, it is a PortProbe
+type BannerProbe struct {
+	Timeout time.Duration
+}
+
+// talks the protocol on a fresh connection, nothing here changes the state of the server
+type bannerFunc func(c net.Conn, timeout time.Duration, info *BannerInfo) error
+
+var bannerProtocols = map[string]bannerFunc{
+	"smtp":      bannerSMTP,
+	"ftp":       bannerFTP,
+	"pop3":      bannerPOP3,
+	"imap":      bannerIMAP,
+	"redis":     bannerRedis,
+	"memcached": bannerMemcached,
+}
+
+// the part of the redis INFO that is kept
+var redisInfoFields = map[string]bool{"redis_version": true, "redis_mode": true, "os": true, "arch_bits": true, "executable": true, "config_file": true}
+
+var bannerPorts = map[int]string{
+	21:    "ftp",
+	25:    "smtp",
+	110:   "pop3",
+	143:   "imap",
+	587:   "smtp",
+	6379:  "redis",
+	11211: "memcached",
+}
+
+// names from the service detection
+var bannerServices = map[string]string{
+	"ftp":        "ftp",
+	"smtp":       "smtp",
+	"submission": "smtp",
+	"pop3":       "pop3",
+	"imap":       "imap",
+	"redis":      "redis",
+	"memcached":  "memcached",
+	"memcache":   "memcached",
+}
+
+func NewBannerProbe(timeout time.Duration) *BannerProbe {
+	return &BannerProbe{
+		Timeout: timeout,
+	}
+}
+
+func (p *BannerProbe) Name() string {
+	return "banner"
+}
+
+func (p *BannerProbe) Probe(targetIP net.IP, r *TCPResult) error {
+	proto := bannerProtocol(r)
+	if proto == "" {
+		return nil
+	}
+	info, err := p.Grab(targetIP, r.port, proto)
+	if err != nil {
+		return err
+	}
+	r.bannerInfo = info
+	return nil
+}
+
+// GrabBanner talks the protocol (smtp, ftp, pop3, imap, redis or memcached) to the port
+func GrabBanner(targetIP net.IP, port int, protocol string, timeout time.Duration) (*BannerInfo, error) {
+	return NewBannerProbe(timeout).Grab(targetIP, port, protocol)
+}
+
+func (p *BannerProbe) Grab(targetIP net.IP, port int, protocol string) (*BannerInfo, error) {
+	f, ok := bannerProtocols[protocol]
+	if !ok {
+		return nil, fmt.Errorf("No banner probe for %s", protocol)
+	}
+
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	c, err := net.DialTimeout("tcp", addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	info := &BannerInfo{
+		Protocol: protocol,
+		Fields:   make(map[string]string),
+	}
+	if err := f(c, p.Timeout, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// the same order as for STARTTLS, service first, then the banner and the port last
+func bannerProtocol(r *TCPResult) string {
+	if r.service != nil {
+		if r.service.TLS {
+			return ""
+		}
+		return bannerServices[r.service.Service]
+	}
+	if proto := startTLSFromBanner(r.banner); proto != "" {
+		return proto
+	}
+	return bannerPorts[r.port]
+}
+
+func lineReply(s string) bool {
+	return strings.HasSuffix(s, "\n")
+}
+
+// the reply lines without the codes, "250-SIZE 1000" is "SIZE 1000"
+func replyLines(reply string) []string {
+	var out []string
+	for _, l := range strings.Split(strings.TrimRight(reply, "\r\n"), "\n") {
+		l = strings.TrimRight(l, "\r")
+		if len(l) >= 4 && (l[3] == '-' || l[3] == ' ') {
+			l = l[4:]
+		}
+		out = append(out, strings.TrimSpace(l))
+	}
+	return out
+}
+
+func bannerSMTP(c net.Conn, timeout time.Duration, info *BannerInfo) error {
+	greeting, err := readReply(c, timeout, codeReply)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "220") {
+		return fmt.Errorf("Unexpected SMTP greeting: %s", strings.TrimSpace(greeting))
+	}
+	info.Fields["greeting"] = strings.Join(replyLines(greeting), " ")
+	info.Version = info.Fields["greeting"]
+
+	ehlo, err := command(c, timeout, "EHLO portslibk\r\n", codeReply)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(ehlo, "250") {
+		// old servers only know HELO, nothing more to get from them
+		info.Fields["ehlo"] = strings.TrimSpace(ehlo)
+		command(c, timeout, "QUIT\r\n", codeReply)
+		return nil
+	}
+
+	// the first line is the hostname of the server, the rest are the extensions
+	lines := replyLines(ehlo)
+	if len(lines) > 0 {
+		// a bare "250" has no hostname
+		if f := strings.Fields(lines[0]); len(f) > 0 {
+			info.Fields["hostname"] = f[0]
+		}
+		lines = lines[1:]
+	}
+	for _, l := range lines {
+		info.Capabilities = append(info.Capabilities, l)
+		if f := strings.Fields(l); len(f) == 2 && strings.EqualFold(f[0], "SIZE") {
+			info.Fields["size"] = f[1]
+		}
+	}
+
+	command(c, timeout, "QUIT\r\n", codeReply)
+	return nil
+}
+
+func bannerFTP(c net.Conn, timeout time.Duration, info *BannerInfo) error {
+	greeting, err := readReply(c, timeout, codeReply)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "220") {
+		return fmt.Errorf("Unexpected FTP greeting: %s", strings.TrimSpace(greeting))
+	}
+	info.Fields["greeting"] = strings.Join(replyLines(greeting), " ")
+	info.Version = info.Fields["greeting"]
+
+	// features are the lines between the 211 ones and start with a space
+	feat, err := command(c, timeout, "FEAT\r\n", codeReply)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(feat, "211") {
+		for _, l := range strings.Split(feat, "\n") {
+			if strings.HasPrefix(l, " ") {
+				info.Capabilities = append(info.Capabilities, strings.TrimSpace(l))
+			}
+		}
+	}
+
+	if syst, err := command(c, timeout, "SYST\r\n", codeReply); err == nil && strings.HasPrefix(syst, "215") {
+		info.Fields["system"] = strings.Join(replyLines(syst), " ")
+	}
+
+	command(c, timeout, "QUIT\r\n", codeReply)
+	return nil
+}
+
+func bannerPOP3(c net.Conn, timeout time.Duration, info *BannerInfo) error {
+	greeting, err := readReply(c, timeout, lineReply)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "+OK") {
+		return fmt.Errorf("Unexpected POP3 greeting: %s", strings.TrimSpace(greeting))
+	}
+	info.Fields["greeting"] = strings.TrimSpace(strings.TrimPrefix(greeting, "+OK"))
+	info.Version = info.Fields["greeting"]
+
+	// the list ends with a line with just a dot, an error is a single line
+	capa, err := command(c, timeout, "CAPA\r\n", func(s string) bool {
+		return strings.HasPrefix(s, "-ERR") && lineReply(s) || strings.HasSuffix(s, "\n.\r\n") || strings.HasSuffix(s, "\n.\n")
+	})
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(capa, "+OK") {
+		lines := strings.Split(strings.TrimRight(capa, "\r\n"), "\n")
+		for _, l := range lines[1 : len(lines)-1] {
+			l = strings.TrimSpace(l)
+			info.Capabilities = append(info.Capabilities, l)
+			if impl, ok := strings.CutPrefix(l, "IMPLEMENTATION "); ok {
+				info.Version = impl
+			}
+		}
+	}
+
+	command(c, timeout, "QUIT\r\n", lineReply)
+	return nil
+}
+
+func bannerIMAP(c net.Conn, timeout time.Duration, info *BannerInfo) error {
+	greeting, err := readReply(c, timeout, lineReply)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "* OK") && !strings.HasPrefix(greeting, "* PREAUTH") {
+		return fmt.Errorf("Unexpected IMAP greeting: %s", strings.TrimSpace(greeting))
+	}
+	info.Fields["greeting"] = strings.TrimSpace(greeting[2:])
+	info.Version = info.Fields["greeting"]
+
+	tagged := func(s string) bool {
+		return strings.Contains(s, "pk1 ") && lineReply(s)
+	}
+	reply, err := command(c, timeout, "pk1 CAPABILITY\r\n", tagged)
+	if err != nil {
+		return err
+	}
+	for _, l := range strings.Split(reply, "\n") {
+		if caps, ok := strings.CutPrefix(strings.TrimSpace(l), "* CAPABILITY "); ok {
+			info.Capabilities = strings.Fields(caps)
+		}
+	}
+
+	command(c, timeout, "pk2 LOGOUT\r\n", func(s string) bool {
+		return strings.Contains(s, "pk2 ") && lineReply(s)
+	})
+	return nil
+}
+
+// a RESP reply is complete after the first line, or for bulk strings after the length in the header
+func respReply(s string) bool {
+	i := strings.Index(s, "\r\n")
+	if i < 0 {
+		return false
+	}
+	if s[0] != '$' {
+		return true
+	}
+	n, err := strconv.Atoi(s[1:i])
+	if err != nil || n < 0 {
+		return true
+	}
+	return len(s) >= i+2+n+2
+}
+
+func bannerRedis(c net.Conn, timeout time.Duration, info *BannerInfo) error {
+	ping, err := command(c, timeout, "PING\r\n", respReply)
+	if err != nil {
+		return err
+	}
+	switch {
+	case strings.HasPrefix(ping, "+PONG"):
+	case strings.HasPrefix(ping, "-NOAUTH"), strings.HasPrefix(ping, "-ERR operation not permitted"):
+		info.Fields["auth"] = "required"
+		return nil
+	default:
+		return fmt.Errorf("Unexpected redis reply: %s", strings.TrimSpace(ping))
+	}
+	info.Fields["auth"] = "none"
+
+	reply, err := command(c, timeout, "INFO server\r\n", respReply)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(reply, "$") {
+		return nil
+	}
+	for _, l := range strings.Split(reply, "\r\n")[1:] {
+		k, v, ok := strings.Cut(l, ":")
+		if !ok || !redisInfoFields[k] {
+			continue
+		}
+		info.Fields[k] = v
+	}
+	info.Version = info.Fields["redis_version"]
+	return nil
+}
+
+func bannerMemcached(c net.Conn, timeout time.Duration, info *BannerInfo) error {
+	reply, err := command(c, timeout, "version\r\n", lineReply)
+	if err != nil {
+		return err
+	}
+	v, ok := strings.CutPrefix(strings.TrimSpace(reply), "VERSION ")
+	if !ok {
+		return fmt.Errorf("Unexpected memcached reply: %s", strings.TrimSpace(reply))
+	}
+	info.Version = v
+	return nil
+}
+
+func (i *BannerInfo) String() string {
+	s := i.Protocol
+	if i.Version != "" {
+		s += " " + i.Version
+	}
+	if len(i.Capabilities) > 0 {
+		s += fmt.Sprintf("\n  capabilities: %s", strings.Join(i.Capabilities, ", "))
+	}
+	keys := make([]string, 0, len(i.Fields))
+	for k := range i.Fields {
+		if k != "greeting" || i.Fields[k] != i.Version {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s += fmt.Sprintf("\n  %s: %s", k, i.Fields[k])
+	}
+	return s
+}
@@ -0,0 +1,64 @@
+package portslibK
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// plays the server side of the SMTP banner grab, every command gets the next reply
+func fakeSMTP(t *testing.T, c net.Conn, greeting string, replies ...string) {
+	t.Helper()
+	defer c.Close()
+	if _, err := c.Write([]byte(greeting)); err != nil {
+		return
+	}
+	r := bufio.NewReader(c)
+	for _, reply := range replies {
+		if _, err := r.ReadString('\n'); err != nil {
+			return
+		}
+		if _, err := c.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func TestBannerSMTPBareEHLO(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeSMTP(t, server, "220 mail.example.com ESMTP\r\n", "250 \r\n", "221 bye\r\n")
+
+	info := &BannerInfo{Fields: make(map[string]string)}
+	if err := bannerSMTP(client, time.Second, info); err != nil {
+		t.Fatalf("bannerSMTP: %v", err)
+	}
+	if h, ok := info.Fields["hostname"]; ok {
+		t.Errorf("hostname %q from a bare 250", h)
+	}
+	if len(info.Capabilities) != 0 {
+		t.Errorf("capabilities %v from a bare 250", info.Capabilities)
+	}
+}
+
+func TestBannerSMTPEHLO(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeSMTP(t, server, "220 mail.example.com ESMTP\r\n",
+		"250-mail.example.com Hello\r\n250-SIZE 1000\r\n250 STARTTLS\r\n", "221 bye\r\n")
+
+	info := &BannerInfo{Fields: make(map[string]string)}
+	if err := bannerSMTP(client, time.Second, info); err != nil {
+		t.Fatalf("bannerSMTP: %v", err)
+	}
+	if info.Fields["hostname"] != "mail.example.com" {
+		t.Errorf("hostname %q, want mail.example.com", info.Fields["hostname"])
+	}
+	if info.Fields["size"] != "1000" {
+		t.Errorf("size %q, want 1000", info.Fields["size"])
+	}
+	if len(info.Capabilities) != 2 {
+		t.Errorf("capabilities %v, want SIZE and STARTTLS", info.Capabilities)
+	}
+}
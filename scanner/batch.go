@@ -0,0 +1,168 @@
+package portslibK
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/phayes/freeport"
+)
+
+// BatchWriter is a PacketConn that can send many frames with one system call, the AF_PACKET backend through its TX ring
+type BatchWriter interface {
+	WritePacketBatch(packets [][]byte) (int, error)
+}
+
+// how many SYNs go out together when the batch size is not set
+const defaultBatchSize = 64
+
+// writePackets sends the batch in one go when the conn can, one by one otherwise
+func writePackets(c PacketConn, packets [][]byte) (int, error) {
+	if b, ok := c.(BatchWriter); ok {
+		return b.WritePacketBatch(packets)
+	}
+	for i, p := range packets {
+		if err := c.WritePacketData(p); err != nil {
+			return i, err
+		}
+	}
+	return len(packets), nil
+}
+
+// EnableBatch makes Start run a Sweep, the SYNs go out size at a time (0 is the default of 64)
+func (s *SynScanner) EnableBatch(size int) {
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	s.batchSize = size
+}
+
+// Sweep scans all the ports from a single conn: the SYNs are copies of one template sent in batches and the answers
+// are read until the timeout after the last batch. The ports without an answer are filtered
+func (s *SynScanner) Sweep() ([]*TCPResult, error) {
+	batchSize := s.batchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	handle, err := openPacketConn(s.ifi.Name, time.Millisecond*100)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+	if err := handle.SetBPFFilter(fmt.Sprintf("tcp and src host %s", s.targetIP)); err != nil {
+		return nil, err
+	}
+
+	srcPort, err := freeport.GetFreePort()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting a free port: %v\n", err)
+	}
+	f, err := framingFor(handle.LinkType())
+	if err != nil {
+		return nil, err
+	}
+	mac, err := s.destMAC(f)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting mac addr: %v\n", err)
+	}
+	tmpl, err := s.synTemplate(f, mac)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[int]*TCPResult, len(s.portR))
+	for _, port := range s.portR {
+		results[port] = &TCPResult{port: port}
+	}
+	pending := len(results)
+
+	// every probe has its own slice of one buffer, a batch is sent before the next one is built
+	n := tmpl.size()
+	buf := make([]byte, batchSize*n)
+	batch := make([][]byte, 0, batchSize)
+	linkType := handle.LinkType()
+	send := func() error {
+		if _, err := writePackets(handle, batch); err != nil {
+			return fmt.Errorf("Error sending SYN batch: %v\n", err)
+		}
+		if s.packetTaps.on() {
+			for _, p := range batch {
+				s.packetTaps.sent(linkType, p, fmt.Sprintf("SYN probe to %s:%d from port %d", s.targetIP, binary.BigEndian.Uint16(p[tmpl.tcp+2:]), srcPort))
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	log.Printf("Sending %d SYNs to %s in batches of %d\n", len(results), s.targetIP, batchSize)
+	for _, port := range s.portR {
+		i := len(batch)
+		batch = append(batch, tmpl.packet(buf[i*n:(i+1)*n], s.targetIP, uint16(srcPort), uint16(port)))
+		if len(batch) == batchSize {
+			if err := send(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := send(); err != nil {
+			return nil, err
+		}
+	}
+
+	ip4 := &layers.IPv4{}
+	tcp := &layers.TCP{}
+	parser := f.parser(ip4, tcp)
+	decoded := []gopacket.LayerType{}
+	target := s.targetIP.To4()
+
+	deadline := time.Now().Add(s.timeout)
+	for pending > 0 && time.Now().Before(deadline) {
+		data, ci, err := handle.ReadPacketData()
+		if err == ErrPacketTimeout {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Error reading packet: %v\n", err)
+		}
+		if parser.DecodeLayers(data, &decoded); transportLayer(decoded) != layers.LayerTypeTCP {
+			s.packetTaps.ignored(linkType, ci, data, fmt.Sprintf("not TCP, %s", decodedLayers(decoded)))
+			continue
+		}
+		r, ok := results[int(tcp.SrcPort)]
+		if !ok || !ip4.SrcIP.Equal(target) || tcp.DstPort != layers.TCPPort(srcPort) || r.state != "" {
+			s.packetTaps.ignored(linkType, ci, data, "not an answer to the sweep")
+			continue
+		}
+		state := synReplyState(tcp)
+		if state == "" {
+			s.packetTaps.ignored(linkType, ci, data, "neither a SYN-ACK nor a RST")
+			continue
+		}
+		s.packetTaps.received(linkType, ci, data, fmt.Sprintf("Reply to the SYN probe to %s:%d: %s", s.targetIP, r.port, state))
+		r.state = state
+		pending--
+		if s.osDetect {
+			probe := "syn"
+			if state == "closed" {
+				probe = "rst"
+			}
+			s.addFingerprint(tcpFingerprint(ip4, tcp, probe))
+		}
+	}
+
+	list := make([]*TCPResult, 0, len(results))
+	for _, r := range results {
+		if r.state == "" {
+			r.state = synNoReply
+			r.details = "No reply to the SYN"
+		}
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].port < list[j].port })
+	return list, nil
+}
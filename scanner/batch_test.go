@@ -0,0 +1,130 @@
+package portslibK
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// a conn that drops everything, only what it costs to build the packets is left
+type discardConn struct{}
+
+func (discardConn) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return nil, gopacket.CaptureInfo{}, ErrPacketTimeout
+}
+func (discardConn) WritePacketData(data []byte) error { return nil }
+func (discardConn) SetBPFFilter(filter string) error  { return nil }
+func (discardConn) LinkType() layers.LinkType         { return layers.LinkTypeEthernet }
+func (discardConn) Close()                            {}
+
+func ethernetFraming(t testing.TB) linkFraming {
+	f, err := framingFor(layers.LinkTypeEthernet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// the SYNs go to TEST-NET-3, the loopback drops them as it doesn't forward
+func benchScanner() *SynScanner {
+	return &SynScanner{
+		sourceIP: net.IPv4(127, 0, 0, 1),
+		targetIP: net.IPv4(203, 0, 113, 1),
+		ifi:      &net.Interface{Name: "lo", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}},
+	}
+}
+
+func benchConns(b *testing.B) map[string]PacketConn {
+	conns := map[string]PacketConn{"discard": discardConn{}}
+	if c, err := OpenAFPacket("lo", 0); err == nil {
+		conns["afpacket"] = c
+		b.Cleanup(c.Close)
+	}
+	return conns
+}
+
+// a SYN the way Scan built them before the templates, serialized by gopacket
+func gopacketSYN(s *SynScanner, srcPort uint16, port int, mac net.HardwareAddr) ([]byte, error) {
+	ipLayer, tcpLayer, ethLayer := s.BuildLayers(srcPort, s.ifi, mac)
+	tcpLayer.DstPort = layers.TCPPort(port)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, &ethLayer, &ipLayer, &tcpLayer); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// the per-packet path: every SYN serialized by gopacket and written with its own system call
+func BenchmarkSYNPerPacket(b *testing.B) {
+	s := benchScanner()
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	for name, c := range benchConns(b) {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p, err := gopacketSYN(s, 40000, 1+i%65535, mac)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := c.WritePacketData(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+		})
+	}
+}
+
+// the path of Sweep: SYNs patched into a template and sent a batch at a time
+func BenchmarkSYNBatch(b *testing.B) {
+	s := benchScanner()
+	tmpl, err := s.synTemplate(ethernetFraming(b), net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	if err != nil {
+		b.Fatal(err)
+	}
+	n := tmpl.size()
+	buf := make([]byte, defaultBatchSize*n)
+	batch := make([][]byte, 0, defaultBatchSize)
+
+	for name, c := range benchConns(b) {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				j := len(batch)
+				batch = append(batch, tmpl.packet(buf[j*n:(j+1)*n], s.targetIP, 40000, uint16(1+i%65535)))
+				if len(batch) == defaultBatchSize || i == b.N-1 {
+					if _, err := writePackets(c, batch); err != nil {
+						b.Fatal(err)
+					}
+					batch = batch[:0]
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "pkts/s")
+		})
+	}
+}
+
+// the template gives the same bytes as gopacket does, whatever the target and the ports
+func TestSYNTemplate(t *testing.T) {
+	s := benchScanner()
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	tmpl, err := s.synTemplate(ethernetFraming(t), mac)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, tmpl.size())
+	for _, dst := range []net.IP{net.IPv4(203, 0, 113, 1), net.IPv4(10, 0, 0, 1), net.IPv4(255, 255, 255, 254), net.IPv4(0, 0, 0, 0)} {
+		s.targetIP = dst
+		for _, ports := range [][2]int{{40000, 1}, {1, 22}, {54321, 443}, {65535, 65535}, {0, 0}} {
+			want, err := gopacketSYN(s, uint16(ports[0]), ports[1], mac)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tmpl.packet(buf, dst, uint16(ports[0]), uint16(ports[1])); string(got) != string(want) {
+				t.Errorf("%s %d -> %d:\ngot  %x\nwant %x", dst, ports[0], ports[1], got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package portslibK
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// BER tags used by SNMP
+const (
+	berInteger     byte = 0x02
+	berOctetString byte = 0x04
+	berNull        byte = 0x05
+	berOID         byte = 0x06
+	berSequence    byte = 0x30
+	berIPAddress   byte = 0x40
+	berCounter32   byte = 0x41
+	berGauge32     byte = 0x42
+	berTimeTicks   byte = 0x43
+	berCounter64   byte = 0x46
+)
+
+type berElement struct {
+	tag   byte
+	value []byte
+}
+
+// reads a single TLV from data and returns it with the rest of the data after it
+func readBER(data []byte) (berElement, []byte, error) {
+	if len(data) < 2 {
+		return berElement{}, nil, fmt.Errorf("BER element too short")
+	}
+	tag := data[0]
+	length := int(data[1])
+	off := 2
+
+	// long form, the low bits say how many bytes the length takes
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(data) < 2+n {
+			return berElement{}, nil, fmt.Errorf("Invalid BER length")
+		}
+		length = 0
+		for _, b := range data[2 : 2+n] {
+			length = length<<8 | int(b)
+		}
+		off += n
+	}
+
+	if length < 0 || len(data) < off+length {
+		return berElement{}, nil, fmt.Errorf("BER element truncated")
+	}
+
+	return berElement{tag: tag, value: data[off : off+length]}, data[off+length:], nil
+}
+
+// reads all the TLVs inside of a constructed element
+func (e berElement) children() ([]berElement, error) {
+	var elems []berElement
+	data := e.value
+	for len(data) > 0 {
+		el, rest, err := readBER(data)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, el)
+		data = rest
+	}
+	return elems, nil
+}
+
+func (e berElement) int() int64 {
+	var v int64
+	for i, b := range e.value {
+		if i == 0 && b&0x80 != 0 {
+			v = -1 // negative numbers are two's complement
+		}
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+func (e berElement) uint() uint64 {
+	var v uint64
+	for _, b := range e.value {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+func (e berElement) oid() string {
+	if len(e.value) == 0 {
+		return ""
+	}
+	// first byte holds the first two arcs
+	parts := []string{strconv.Itoa(int(e.value[0]) / 40), strconv.Itoa(int(e.value[0]) % 40)}
+	var arc uint64
+	for _, b := range e.value[1:] {
+		arc = arc<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			parts = append(parts, strconv.FormatUint(arc, 10))
+			arc = 0
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// String formats the value depending on its type so it can go into the report
+func (e berElement) String() string {
+	switch e.tag {
+	case berInteger:
+		return strconv.FormatInt(e.int(), 10)
+	case berOctetString:
+		return string(e.value)
+	case berOID:
+		return e.oid()
+	case berIPAddress:
+		if len(e.value) == 4 {
+			return fmt.Sprintf("%d.%d.%d.%d", e.value[0], e.value[1], e.value[2], e.value[3])
+		}
+	case berCounter32, berGauge32, berTimeTicks, berCounter64:
+		return strconv.FormatUint(e.uint(), 10)
+	case berNull:
+		return ""
+	}
+	return fmt.Sprintf("%x", e.value)
+}
+
+// berEncode wraps the value into a TLV, the length is in the short form when it fits
+func berEncode(tag byte, value []byte) []byte {
+	l := len(value)
+	var out []byte
+	switch {
+	case l < 0x80:
+		out = []byte{tag, byte(l)}
+	case l <= 0xff:
+		out = []byte{tag, 0x81, byte(l)}
+	default:
+		out = []byte{tag, 0x82, byte(l >> 8), byte(l)}
+	}
+	return append(out, value...)
+}
+
+// the shortest two's complement form of v
+func berInt(tag byte, v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if (v < 0x80 && v >= -0x80) || len(b) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return berEncode(tag, b)
+}
+
+func berOctets(s []byte) []byte {
+	return berEncode(berOctetString, s)
+}
+
+func berSeq(tag byte, elems ...[]byte) []byte {
+	var value []byte
+	for _, e := range elems {
+		value = append(value, e...)
+	}
+	return berEncode(tag, value)
+}
+
+func berEncodeOID(oid string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("Invalid OID %q", oid)
+	}
+	arcs := make([]uint64, len(parts))
+	for i, p := range parts {
+		a, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid OID %q", oid)
+		}
+		arcs[i] = a
+	}
+
+	value := []byte{byte(arcs[0]*40 + arcs[1])}
+	for _, a := range arcs[2:] {
+		// base 128 with the high bit set on every byte but the last
+		enc := []byte{byte(a & 0x7f)}
+		for a >>= 7; a > 0; a >>= 7 {
+			enc = append([]byte{byte(a&0x7f) | 0x80}, enc...)
+		}
+		value = append(value, enc...)
+	}
+	return berEncode(berOID, value), nil
+}
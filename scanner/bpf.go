@@ -0,0 +1,393 @@
+package portslibK
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// BPFInstruction is a classic BPF instruction, the layout of struct sock_filter
+type BPFInstruction struct {
+	Code uint16
+	Jt   uint8
+	Jf   uint8
+	K    uint32
+}
+
+// the opcodes the compiler uses
+const (
+	bpfLD   = 0x00
+	bpfLDX  = 0x01
+	bpfALU  = 0x04
+	bpfJMP  = 0x05
+	bpfRET  = 0x06
+	bpfW    = 0x00
+	bpfH    = 0x08
+	bpfB    = 0x10
+	bpfABS  = 0x20
+	bpfIND  = 0x40
+	bpfMSH  = 0xa0
+	bpfAND  = 0x50
+	bpfJA   = 0x00
+	bpfJEQ  = 0x10
+	bpfJSET = 0x40
+	bpfK    = 0x00
+
+	bpfSnapLen = 65535
+)
+
+// CompileBPF compiles a pcap style filter for the link type without libpcap. It knows the primitives the scanners
+// and the usual captures need: ip, arp, tcp, udp, icmp, [src|dst] host, [src|dst] net (CIDR or address) and
+// [src|dst] port, put together with and, or, not and parentheses. IPv4 only, an empty filter takes everything
+func CompileBPF(filter string, linkType layers.LinkType) ([]BPFInstruction, error) {
+	f, err := framingFor(linkType)
+	if err != nil {
+		return nil, fmt.Errorf("Error compiling BPF filter %q: link type %s is not supported", filter, linkType)
+	}
+	// the loopback family and raw IP have no ethertype, the IP version tells
+	var ethertype uint32
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		ethertype = 12
+	case layers.LinkTypeLinuxSLL:
+		ethertype = 14
+	}
+
+	p := &bpfParser{tokens: bpfTokens(filter)}
+	var expr *bpfExpr
+	if len(p.tokens) > 0 {
+		if expr, err = p.parseExpr(); err != nil {
+			return nil, fmt.Errorf("Error compiling BPF filter %q: %v", filter, err)
+		}
+		if p.pos < len(p.tokens) {
+			return nil, fmt.Errorf("Error compiling BPF filter %q: unexpected %q", filter, p.tokens[p.pos])
+		}
+	}
+
+	c := &bpfCompiler{l2: uint32(f.size), ethertype: ethertype, labels: make(map[int]int)}
+	accept, reject := c.label(), c.label()
+	if expr != nil {
+		c.expr(expr, accept, reject)
+	}
+	c.place(accept)
+	c.emit(BPFInstruction{Code: bpfRET | bpfK, K: bpfSnapLen})
+	c.place(reject)
+	c.emit(BPFInstruction{Code: bpfRET | bpfK, K: 0})
+
+	if err := c.resolve(); err != nil {
+		return nil, fmt.Errorf("Error compiling BPF filter %q: %v", filter, err)
+	}
+	return c.insns, nil
+}
+
+func bpfTokens(filter string) []string {
+	for _, sep := range []string{"(", ")", "!", "&&", "||"} {
+		filter = strings.ReplaceAll(filter, sep, " "+sep+" ")
+	}
+	return strings.Fields(filter)
+}
+
+// a node of the filter, op is and, or, not or a primitive
+type bpfExpr struct {
+	op    string
+	l, r  *bpfExpr
+	proto uint8 // the IP protocol of tcp, udp and icmp
+	dir   string
+	value uint32
+	mask  uint32
+}
+
+type bpfParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *bpfParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *bpfParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// and and or have the same precedence and go from the left like in pcap-filter, "tcp or udp and port 53" is
+// "(tcp or udp) and port 53"
+func (p *bpfParser) parseExpr() (*bpfExpr, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var op string
+		switch p.peek() {
+		case "and", "&&":
+			op = "and"
+		case "or", "||":
+			op = "or"
+		default:
+			return l, nil
+		}
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &bpfExpr{op: op, l: l, r: r}
+	}
+}
+
+func (p *bpfParser) parseNot() (*bpfExpr, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &bpfExpr{op: "not", l: x}, nil
+	case "(":
+		p.next()
+		x, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return x, nil
+	}
+	return p.parsePrimitive()
+}
+
+var bpfProtocols = map[string]uint8{
+	"tcp":  uint8(layers.IPProtocolTCP),
+	"udp":  uint8(layers.IPProtocolUDP),
+	"icmp": uint8(layers.IPProtocolICMPv4),
+}
+
+func (p *bpfParser) parsePrimitive() (*bpfExpr, error) {
+	var proto *bpfExpr
+	switch t := p.peek(); t {
+	case "ip", "arp":
+		p.next()
+		proto = &bpfExpr{op: t}
+	case "tcp", "udp", "icmp":
+		p.next()
+		proto = &bpfExpr{op: "proto", proto: bpfProtocols[t]}
+	}
+	// a protocol alone or before the rest of the primitive, like tcp port 80
+	switch p.peek() {
+	case "src", "dst", "host", "net", "port":
+	default:
+		if proto == nil {
+			return nil, fmt.Errorf("unexpected %q", p.peek())
+		}
+		return proto, nil
+	}
+
+	dir := ""
+	if t := p.peek(); t == "src" || t == "dst" {
+		dir = p.next()
+	}
+	kind := p.next()
+	value := p.next()
+
+	x := &bpfExpr{op: kind, dir: dir, mask: 0xffffffff}
+	switch kind {
+	case "host", "net":
+		addr := value
+		if kind == "net" && strings.Contains(value, "/") {
+			_, n, err := net.ParseCIDR(value)
+			if err != nil || n.IP.To4() == nil {
+				return nil, fmt.Errorf("bad IPv4 net %q", value)
+			}
+			addr = n.IP.String()
+			x.mask = ipv4ToUint(net.IP(n.Mask))
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("bad IPv4 address %q", value)
+		}
+		x.value = ipv4ToUint(ip) & x.mask
+	case "port":
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, fmt.Errorf("bad port %q", value)
+		}
+		x.value = uint32(port)
+	default:
+		return nil, fmt.Errorf("expected host, net or port after %s, got %q", dir, kind)
+	}
+
+	// no direction is either of them
+	if dir == "" {
+		src, dst := *x, *x
+		src.dir, dst.dir = "src", "dst"
+		x = &bpfExpr{op: "or", l: &src, r: &dst}
+	}
+	if proto != nil {
+		x = &bpfExpr{op: "and", l: proto, r: x}
+	}
+	return x, nil
+}
+
+func ipv4ToUint(ip net.IP) uint32 {
+	ip = ip.To4()
+	return uint32(ip[0])<<24 | uint32(ip[1])<<16 | uint32(ip[2])<<8 | uint32(ip[3])
+}
+
+// the jumps go to labels until the end, bpfNext is the instruction right after the jump
+const bpfNext = -1
+
+type bpfJump struct {
+	at     int
+	jt, jf int
+	always bool
+}
+
+type bpfCompiler struct {
+	l2        uint32 // length of the link header
+	ethertype uint32 // offset of the ethertype, 0 when the link has none
+	insns     []BPFInstruction
+	jumps     []bpfJump
+	labels    map[int]int
+	nlabel    int
+}
+
+func (c *bpfCompiler) label() int {
+	c.nlabel++
+	return c.nlabel
+}
+
+func (c *bpfCompiler) place(l int) {
+	c.labels[l] = len(c.insns)
+}
+
+func (c *bpfCompiler) emit(i BPFInstruction) {
+	c.insns = append(c.insns, i)
+}
+
+func (c *bpfCompiler) load(size uint16, off uint32) {
+	c.emit(BPFInstruction{Code: bpfLD | size | bpfABS, K: off})
+}
+
+func (c *bpfCompiler) jump(op uint16, k uint32, jt, jf int) {
+	c.jumps = append(c.jumps, bpfJump{at: len(c.insns), jt: jt, jf: jf})
+	c.emit(BPFInstruction{Code: bpfJMP | op | bpfK, K: k})
+}
+
+func (c *bpfCompiler) jumpTo(l int) {
+	c.jumps = append(c.jumps, bpfJump{at: len(c.insns), jt: l, always: true})
+	c.emit(BPFInstruction{Code: bpfJMP | bpfJA})
+}
+
+func (c *bpfCompiler) expr(x *bpfExpr, t, f int) {
+	switch x.op {
+	case "and":
+		m := c.label()
+		c.expr(x.l, m, f)
+		c.place(m)
+		c.expr(x.r, t, f)
+	case "or":
+		m := c.label()
+		c.expr(x.l, t, m)
+		c.place(m)
+		c.expr(x.r, t, f)
+	case "not":
+		c.expr(x.l, f, t)
+	case "ip":
+		c.ipv4(t, f)
+	case "arp":
+		if c.ethertype == 0 {
+			c.jumpTo(f)
+			return
+		}
+		c.load(bpfH, c.ethertype)
+		c.jump(bpfJEQ, uint32(layers.EthernetTypeARP), t, f)
+	case "proto":
+		c.ipv4(bpfNext, f)
+		c.load(bpfB, c.l2+9)
+		c.jump(bpfJEQ, uint32(x.proto), t, f)
+	case "host", "net":
+		c.ipv4(bpfNext, f)
+		off := c.l2 + 12
+		if x.dir == "dst" {
+			off = c.l2 + 16
+		}
+		c.load(bpfW, off)
+		if x.mask != 0xffffffff {
+			c.emit(BPFInstruction{Code: bpfALU | bpfAND | bpfK, K: x.mask})
+		}
+		c.jump(bpfJEQ, x.value, t, f)
+	case "port":
+		c.ipv4(bpfNext, f)
+		transport := c.label()
+		c.load(bpfB, c.l2+9)
+		c.jump(bpfJEQ, uint32(layers.IPProtocolTCP), transport, bpfNext)
+		c.jump(bpfJEQ, uint32(layers.IPProtocolUDP), bpfNext, f)
+		c.place(transport)
+		// only the first fragment has the ports
+		c.load(bpfH, c.l2+6)
+		c.jump(bpfJSET, 0x1fff, f, bpfNext)
+		c.emit(BPFInstruction{Code: bpfLDX | bpfB | bpfMSH, K: c.l2})
+		off := c.l2
+		if x.dir == "dst" {
+			off += 2
+		}
+		c.emit(BPFInstruction{Code: bpfLD | bpfH | bpfIND, K: off})
+		c.jump(bpfJEQ, x.value, t, f)
+	}
+}
+
+// the packet is IPv4, by the ethertype or the version of the IP header right after the link one
+func (c *bpfCompiler) ipv4(t, f int) {
+	if c.ethertype != 0 {
+		c.load(bpfH, c.ethertype)
+		c.jump(bpfJEQ, uint32(layers.EthernetTypeIPv4), t, f)
+		return
+	}
+	c.load(bpfB, c.l2)
+	c.emit(BPFInstruction{Code: bpfALU | bpfAND | bpfK, K: 0xf0})
+	c.jump(bpfJEQ, 0x40, t, f)
+}
+
+func (c *bpfCompiler) resolve() error {
+	offset := func(at, l int) (int, error) {
+		if l == bpfNext {
+			return 0, nil
+		}
+		target, ok := c.labels[l]
+		if !ok {
+			return 0, fmt.Errorf("jump to a label that was never placed")
+		}
+		return target - at - 1, nil
+	}
+
+	for _, j := range c.jumps {
+		jt, err := offset(j.at, j.jt)
+		if err != nil {
+			return err
+		}
+		if j.always {
+			c.insns[j.at].K = uint32(jt)
+			continue
+		}
+		jf, err := offset(j.at, j.jf)
+		if err != nil {
+			return err
+		}
+		if jt > 255 || jf > 255 {
+			return fmt.Errorf("filter is too long")
+		}
+		c.insns[j.at].Jt, c.insns[j.at].Jf = uint8(jt), uint8(jf)
+	}
+	return nil
+}
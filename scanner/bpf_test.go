@@ -0,0 +1,202 @@
+package portslibK
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// runs the program like the kernel would, only the instructions CompileBPF makes
+func runBPF(t *testing.T, prog []BPFInstruction, pkt []byte) uint32 {
+	t.Helper()
+	var a, x uint32
+	for pc := 0; pc < len(prog); pc++ {
+		i := prog[pc]
+		load := func(off uint32, size int) uint32 {
+			if int(off)+size > len(pkt) {
+				t.Fatalf("load of %d bytes at %d out of the packet", size, off)
+			}
+			switch size {
+			case 1:
+				return uint32(pkt[off])
+			case 2:
+				return uint32(binary.BigEndian.Uint16(pkt[off:]))
+			}
+			return binary.BigEndian.Uint32(pkt[off:])
+		}
+		sizes := map[uint16]int{bpfW: 4, bpfH: 2, bpfB: 1}
+
+		switch i.Code & 0x07 {
+		case bpfLD:
+			if i.Code&0xe0 == bpfIND {
+				a = load(x+i.K, sizes[i.Code&0x18])
+			} else {
+				a = load(i.K, sizes[i.Code&0x18])
+			}
+		case bpfLDX:
+			x = 4 * (load(i.K, 1) & 0xf)
+		case bpfALU:
+			a &= i.K
+		case bpfJMP:
+			var cond bool
+			switch i.Code & 0xf0 {
+			case bpfJA:
+				pc += int(i.K)
+				continue
+			case bpfJEQ:
+				cond = a == i.K
+			case bpfJSET:
+				cond = a&i.K != 0
+			}
+			if cond {
+				pc += int(i.Jt)
+			} else {
+				pc += int(i.Jf)
+			}
+		case bpfRET:
+			return i.K
+		default:
+			t.Fatalf("unknown instruction %#x", i.Code)
+		}
+	}
+	t.Fatal("program ended without a return")
+	return 0
+}
+
+func testFrame(t *testing.T, l ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	for _, layer := range l {
+		if tl, ok := layer.(interface {
+			SetNetworkLayerForChecksum(gopacket.NetworkLayer) error
+		}); ok {
+			tl.SetNetworkLayerForChecksum(l[len(l)-2].(*layers.IPv4))
+		}
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, l...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCompileBPF(t *testing.T) {
+	eth := func() *layers.Ethernet {
+		return &layers.Ethernet{
+			SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+			DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			EthernetType: layers.EthernetTypeIPv4,
+		}
+	}
+	ip := func(proto layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto, SrcIP: testTargetIP, DstIP: testScannerIP}
+	}
+
+	synAck := testFrame(t, eth(), ip(layers.IPProtocolTCP), &layers.TCP{SrcPort: 22, DstPort: 40000, SYN: true, ACK: true})
+	dns := testFrame(t, eth(), ip(layers.IPProtocolUDP), &layers.UDP{SrcPort: 53, DstPort: 40001})
+	arpEth := eth()
+	arpEth.EthernetType = layers.EthernetTypeARP
+	arp := testFrame(t, arpEth, &layers.ARP{
+		AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+		Operation: layers.ARPRequest, SourceHwAddress: []byte{2, 0, 0, 0, 0, 2}, SourceProtAddress: []byte{10, 0, 0, 2},
+		DstHwAddress: []byte{0, 0, 0, 0, 0, 0}, DstProtAddress: []byte{10, 0, 0, 1},
+	})
+	// a later fragment of a TCP packet, the bytes where the ports would be are the middle of the data
+	fragIP := ip(layers.IPProtocolTCP)
+	fragIP.FragOffset = 100
+	frag := testFrame(t, eth(), fragIP, gopacket.Payload([]byte{0, 22, 0, 22, 0, 0, 0, 0}))
+
+	for _, c := range []struct {
+		filter string
+		pkt    []byte
+		want   bool
+	}{
+		{"", arp, true},
+		{"tcp and src host 10.0.0.2 and src port 22", synAck, true},
+		{"tcp and src host 10.0.0.2 and src port 23", synAck, false},
+		{"tcp and src host 10.0.0.3 and src port 22", synAck, false},
+		{"tcp and dst host 10.0.0.2", synAck, false},
+		{"tcp port 22", synAck, true},
+		{"udp port 22", synAck, false},
+		{"port 53", dns, true},
+		{"dst port 40001", dns, true},
+		{"udp and (port 53 or port 5353)", dns, true},
+		{"tcp or udp and port 53", synAck, false},
+		{"tcp or udp and port 53", dns, true},
+		{"udp and port 53 or tcp", synAck, true},
+		{"tcp or (udp and port 53)", synAck, true},
+		{"net 10.0.0.0/24", synAck, true},
+		{"src net 10.0.1.0/24", synAck, false},
+		{"icmp or arp", arp, true},
+		{"icmp or arp", dns, false},
+		{"not arp", arp, false},
+		{"! arp && ip", synAck, true},
+		{"host 10.0.0.1", arp, false},
+		{"port 22", frag, false},
+		{"tcp", frag, true},
+	} {
+		prog, err := CompileBPF(c.filter, layers.LinkTypeEthernet)
+		if err != nil {
+			t.Fatalf("%q: %v", c.filter, err)
+		}
+		if got := runBPF(t, prog, c.pkt) != 0; got != c.want {
+			t.Errorf("%q: got %t, want %t", c.filter, got, c.want)
+		}
+	}
+}
+
+// the same filters on the links without ethernet, the IP header starts after the header of the link
+func TestCompileBPFLinkTypes(t *testing.T) {
+	ip := testFrame(t, &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: testTargetIP, DstIP: testScannerIP},
+		&layers.TCP{SrcPort: 443, DstPort: 40000, RST: true})
+	// an incoming IPv4 packet of a cooked capture: packet type, ARPHRD_ETHER, the address and the protocol
+	sll := []byte{0, 0, 0, 1, 0, 6, 2, 0, 0, 0, 0, 2, 0, 0, 0x08, 0x00}
+
+	for linkType, hdr := range map[layers.LinkType][]byte{
+		layers.LinkTypeRaw:      nil,
+		layers.LinkTypeNull:     {2, 0, 0, 0},
+		layers.LinkTypeLoop:     {0, 0, 0, 2},
+		layers.LinkTypeLinuxSLL: sll,
+	} {
+		pkt := append(append([]byte(nil), hdr...), ip...)
+		for _, c := range []struct {
+			filter string
+			want   bool
+		}{
+			{"tcp and src host 10.0.0.2 and src port 443", true},
+			{"ip and dst port 40000", true},
+			{"dst host 10.0.0.2", false},
+			{"arp", false},
+			{"udp", false},
+		} {
+			prog, err := CompileBPF(c.filter, linkType)
+			if err != nil {
+				t.Fatalf("%s %q: %v", linkType, c.filter, err)
+			}
+			if got := runBPF(t, prog, pkt) != 0; got != c.want {
+				t.Errorf("%s %q: got %t, want %t", linkType, c.filter, got, c.want)
+			}
+		}
+	}
+}
+
+func TestCompileBPFErrors(t *testing.T) {
+	for _, filter := range []string{
+		"tcp and",
+		"host foo.example",
+		"port 70000",
+		"(tcp or udp",
+		"src tcp",
+		"tcp udp",
+		"net 10.0.0.0/99",
+	} {
+		if _, err := CompileBPF(filter, layers.LinkTypeEthernet); err == nil {
+			t.Errorf("%q: expected an error", filter)
+		}
+	}
+	if _, err := CompileBPF("tcp", layers.LinkTypeFDDI); err == nil {
+		t.Error("expected an error for an unsupported link type")
+	}
+}
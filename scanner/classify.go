@@ -0,0 +1,50 @@
+package portslibK
+
+import (
+	"github.com/google/gopacket/layers"
+)
+
+// what a probe ends as when nothing came back, the same for the live scanners and the capture analysis
+const (
+	synNoReply = "filtered"
+	udpNoReply = "open|filtered"
+	ackNoReply = AckFiltered
+)
+
+// the state of the port from the answer to a SYN, empty when the packet is not an answer
+func synReplyState(tcp *layers.TCP) string {
+	switch {
+	case tcp.SYN && tcp.ACK:
+		return "open"
+	case tcp.RST:
+		return "closed"
+	}
+	return ""
+}
+
+// an ACK is answered with a RST whether the port is open or not, so it only tells there's no firewall
+func ackReplyState(tcp *layers.TCP) ACKState {
+	if tcp.RST {
+		return AckUnfiltered
+	}
+	return ""
+}
+
+// the state from an ICMP unreachable about a probe, the port unreachable is the closed UDP port and the rest are firewalls.
+// The codes are the ones nmap takes as filtered, the other unreachables say nothing about the port and give ""
+func icmpProbeState(icmp *layers.ICMPv4, proto layers.IPProtocol) string {
+	if icmp.TypeCode.Type() != layers.ICMPv4TypeDestinationUnreachable {
+		return ""
+	}
+	switch icmp.TypeCode.Code() {
+	case layers.ICMPv4CodePort:
+		if proto == layers.IPProtocolUDP {
+			return "closed"
+		}
+		return "filtered"
+	case layers.ICMPv4CodeNet, layers.ICMPv4CodeHost, layers.ICMPv4CodeProtocol, layers.ICMPv4CodeNetAdminProhibited,
+		layers.ICMPv4CodeHostAdminProhibited, layers.ICMPv4CodeCommAdminProhibited:
+		return "filtered"
+	}
+	return ""
+}
@@ -0,0 +1,663 @@
+package portslibK
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DBInfo is what the database told us before any credentials were needed
+type DBInfo struct {
+	Product     string
+	Version     string
+	TLS         bool // the server can do TLS
+	TLSRequired bool
+	Fields      map[string]string // the rest of the handshake, like the auth method or the error the server sent
+}
+
+// DBProbe reads the handshakes of MySQL, PostgreSQL, MongoDB and MSSQL, it is a PortProbe
+type DBProbe struct {
+	Timeout time.Duration
+}
+
+type dbFunc func(addr string, timeout time.Duration, info *DBInfo) error
+
+var dbProtocols = map[string]dbFunc{
+	"mysql":    dbMySQL,
+	"postgres": dbPostgres,
+	"mongodb":  dbMongo,
+	"mssql":    dbMSSQL,
+}
+
+var dbPorts = map[int]string{
+	1433:  "mssql",
+	3306:  "mysql",
+	5432:  "postgres",
+	27017: "mongodb",
+	27018: "mongodb",
+}
+
+// names from the service detection
+var dbServices = map[string]string{
+	"mysql":      "mysql",
+	"postgresql": "postgres",
+	"mongodb":    "mongodb",
+	"ms-sql-s":   "mssql",
+	"mssql":      "mssql",
+}
+
+func NewDBProbe(timeout time.Duration) *DBProbe {
+	return &DBProbe{
+		Timeout: timeout,
+	}
+}
+
+func (p *DBProbe) Name() string {
+	return "database"
+}
+
+func (p *DBProbe) Probe(targetIP net.IP, r *TCPResult) error {
+	var proto string
+	if r.service != nil {
+		proto = dbServices[r.service.Service]
+	} else {
+		proto = dbPorts[r.port]
+	}
+	if proto == "" {
+		return nil
+	}
+
+	info, err := p.Handshake(targetIP, r.port, proto)
+	if err != nil {
+		return err
+	}
+	r.db = info
+	return nil
+}
+
+// DBHandshake reads the handshake of the database on the port, protocol is one of mysql, postgres, mongodb and mssql
+func DBHandshake(targetIP net.IP, port int, protocol string, timeout time.Duration) (*DBInfo, error) {
+	return NewDBProbe(timeout).Handshake(targetIP, port, protocol)
+}
+
+func (p *DBProbe) Handshake(targetIP net.IP, port int, protocol string) (*DBInfo, error) {
+	f, ok := dbProtocols[protocol]
+	if !ok {
+		return nil, fmt.Errorf("No database probe for %s", protocol)
+	}
+	info := &DBInfo{
+		Fields: make(map[string]string),
+	}
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	if err := f(addr, p.Timeout, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// mysql talks first, the greeting has the version and the capability flags
+func dbMySQL(addr string, timeout time.Duration, info *DBInfo) error {
+	info.Product = "MySQL"
+
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return fmt.Errorf("Error reading MySQL greeting: %v", err)
+	}
+	l := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+	if l > 64*1024 {
+		return fmt.Errorf("MySQL greeting too long")
+	}
+	pkt := make([]byte, l)
+	if _, err := io.ReadFull(c, pkt); err != nil {
+		return fmt.Errorf("Error reading MySQL greeting: %v", err)
+	}
+	return parseMySQLGreeting(pkt, info)
+}
+
+func parseMySQLGreeting(pkt []byte, info *DBInfo) error {
+	if len(pkt) == 0 {
+		return fmt.Errorf("Empty MySQL greeting")
+	}
+	// error packet, usually the host is not allowed to connect
+	if pkt[0] == 0xff {
+		if len(pkt) >= 3 {
+			info.Fields["error code"] = strconv.Itoa(int(binary.LittleEndian.Uint16(pkt[1:3])))
+			info.Fields["error"] = string(pkt[3:])
+		}
+		return nil
+	}
+	info.Fields["protocol"] = strconv.Itoa(int(pkt[0]))
+	if pkt[0] != 10 {
+		return nil
+	}
+
+	end := bytes.IndexByte(pkt[1:], 0)
+	if end < 0 {
+		return fmt.Errorf("MySQL greeting truncated")
+	}
+	info.Version = string(pkt[1 : 1+end])
+	if strings.Contains(strings.ToLower(info.Version), "mariadb") {
+		info.Product = "MariaDB"
+	}
+
+	// thread id, the first part of the salt and a filler before the capabilities
+	off := 1 + end + 1 + 4 + 8 + 1
+	if len(pkt) < off+2 {
+		return nil
+	}
+	caps := uint32(binary.LittleEndian.Uint16(pkt[off : off+2]))
+	off += 2
+	// charset and status, then the upper half of the capabilities
+	if len(pkt) >= off+5 {
+		caps |= uint32(binary.LittleEndian.Uint16(pkt[off+3:off+5])) << 16
+	}
+	info.TLS = caps&0x800 != 0
+	info.Fields["capabilities"] = fmt.Sprintf("0x%08x", caps)
+
+	// the auth plugin name is the last NUL terminated string
+	if caps&0x80000 != 0 && len(pkt) > off+5 {
+		rest := bytes.TrimRight(pkt[off+5:], "\x00")
+		if i := bytes.LastIndexByte(rest, 0); i >= 0 {
+			info.Fields["auth plugin"] = string(rest[i+1:])
+		}
+	}
+	return nil
+}
+
+// postgres has no greeting, the SSLRequest tells about TLS and the error to a startup message about the rest
+func dbPostgres(addr string, timeout time.Duration, info *DBInfo) error {
+	info.Product = "PostgreSQL"
+
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	info.TLS = startTLSPostgres(c, timeout) == nil
+	c.Close()
+
+	c, err = net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+
+	var params []byte
+	for _, kv := range []string{"user", "portslibk", "database", "portslibk", "application_name", "portslibk"} {
+		params = append(append(params, kv...), 0)
+	}
+	params = append(params, 0)
+	startup := make([]byte, 8, 8+len(params))
+	binary.BigEndian.PutUint32(startup[0:4], uint32(8+len(params)))
+	binary.BigEndian.PutUint32(startup[4:8], 3<<16) // protocol 3.0
+	startup = append(startup, params...)
+	if _, err := c.Write(startup); err != nil {
+		return fmt.Errorf("Error sending startup message: %v", err)
+	}
+
+	for {
+		typ, msg, err := readPostgresMessage(c)
+		if err != nil {
+			if len(info.Fields) > 0 {
+				return nil
+			}
+			return fmt.Errorf("Error reading PostgreSQL reply: %v", err)
+		}
+
+		switch typ {
+		case 'E':
+			parsePostgresError(msg, info)
+			return nil
+		case 'R':
+			if len(msg) < 4 {
+				return fmt.Errorf("PostgreSQL auth request truncated")
+			}
+			auth := binary.BigEndian.Uint32(msg)
+			info.Fields["auth"] = postgresAuth(auth)
+			if auth != 0 {
+				// it wants a password, we stop here
+				return nil
+			}
+		case 'S':
+			// parameter status, only sent when we got in without a password
+			parts := bytes.Split(msg, []byte{0})
+			if len(parts) >= 2 && string(parts[0]) == "server_version" {
+				info.Version = string(parts[1])
+			}
+		case 'Z':
+			c.Write([]byte{'X', 0, 0, 0, 4})
+			return nil
+		}
+	}
+}
+
+func readPostgresMessage(c net.Conn) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return 0, nil, err
+	}
+	l := int(binary.BigEndian.Uint32(header[1:5]))
+	if l < 4 || l > 64*1024 {
+		return 0, nil, fmt.Errorf("Bad message length %d", l)
+	}
+	msg := make([]byte, l-4)
+	if _, err := io.ReadFull(c, msg); err != nil {
+		return 0, nil, err
+	}
+	return header[0], msg, nil
+}
+
+func postgresAuth(auth uint32) string {
+	switch auth {
+	case 0:
+		return "none"
+	case 2:
+		return "kerberos"
+	case 3:
+		return "cleartext"
+	case 5:
+		return "md5"
+	case 7:
+		return "gss"
+	case 9:
+		return "sspi"
+	case 10:
+		return "sasl"
+	}
+	return strconv.Itoa(int(auth))
+}
+
+// the error fields are a type byte and a string each, the file and routine hint the version when the user does not exist
+func parsePostgresError(msg []byte, info *DBInfo) {
+	names := map[byte]string{'S': "severity", 'C': "code", 'M': "error", 'F': "file", 'L': "line", 'R': "routine"}
+	for _, f := range bytes.Split(msg, []byte{0}) {
+		if len(f) < 2 {
+			continue
+		}
+		if name, ok := names[f[0]]; ok {
+			info.Fields[name] = string(f[1:])
+		}
+	}
+}
+
+// mongodb answers isMaster over the legacy OP_QUERY on every version, buildInfo needs OP_MSG on the new ones
+func dbMongo(addr string, timeout time.Duration, info *DBInfo) error {
+	info.Product = "MongoDB"
+
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+
+	hello, err := mongoQuery(c, 1, bsonDoc("isMaster", int32(1)))
+	if err != nil {
+		// a server that only takes TLS drops us right away
+		if tc, terr := dialProbe(addr, timeout, true); terr == nil {
+			tc.Close()
+			info.TLS = true
+			info.TLSRequired = true
+			return nil
+		}
+		return err
+	}
+
+	for _, k := range []string{"ismaster", "isWritablePrimary", "secondary", "setName", "msg", "maxWireVersion", "minWireVersion"} {
+		if v, ok := hello[k]; ok {
+			info.Fields[k] = fmt.Sprint(v)
+		}
+	}
+
+	var build map[string]interface{}
+	if wire, _ := hello["maxWireVersion"].(int32); wire >= 6 {
+		build, err = mongoMsg(c, 2, bsonDoc("buildInfo", int32(1), "$db", "admin"))
+	} else {
+		build, err = mongoQuery(c, 2, bsonDoc("buildInfo", int32(1)))
+	}
+	if err == nil {
+		if v, ok := build["version"].(string); ok {
+			info.Version = v
+		}
+		if v, ok := build["gitVersion"].(string); ok {
+			info.Fields["git version"] = v
+		}
+	}
+
+	if tc, err := dialProbe(addr, timeout, true); err == nil {
+		tc.Close()
+		info.TLS = true
+	}
+	return nil
+}
+
+const (
+	mongoOpReply = 1
+	mongoOpQuery = 2004
+	mongoOpMsg   = 2013
+)
+
+func mongoHeader(length, id, op int) []byte {
+	h := make([]byte, 16)
+	binary.LittleEndian.PutUint32(h[0:4], uint32(length))
+	binary.LittleEndian.PutUint32(h[4:8], uint32(id))
+	binary.LittleEndian.PutUint32(h[12:16], uint32(op))
+	return h
+}
+
+func mongoQuery(c net.Conn, id int, doc []byte) (map[string]interface{}, error) {
+	body := make([]byte, 4) // flags
+	body = append(body, "admin.$cmd\x00"...)
+	body = binary.LittleEndian.AppendUint32(body, 0) // skip
+	body = binary.LittleEndian.AppendUint32(body, 1) // return one
+	body = append(body, doc...)
+
+	if _, err := c.Write(append(mongoHeader(16+len(body), id, mongoOpQuery), body...)); err != nil {
+		return nil, err
+	}
+	op, reply, err := readMongoMessage(c)
+	if err != nil {
+		return nil, err
+	}
+	// flags, cursor id, starting from and the number of documents
+	if op != mongoOpReply || len(reply) < 20 {
+		return nil, fmt.Errorf("Unexpected MongoDB reply")
+	}
+	return parseBSON(reply[20:])
+}
+
+func mongoMsg(c net.Conn, id int, doc []byte) (map[string]interface{}, error) {
+	body := make([]byte, 4)     // flags
+	body = append(body, 0)      // a single body section
+	body = append(body, doc...) // with the command
+
+	if _, err := c.Write(append(mongoHeader(16+len(body), id, mongoOpMsg), body...)); err != nil {
+		return nil, err
+	}
+	op, reply, err := readMongoMessage(c)
+	if err != nil {
+		return nil, err
+	}
+	if op != mongoOpMsg || len(reply) < 5 || reply[4] != 0 {
+		return nil, fmt.Errorf("Unexpected MongoDB reply")
+	}
+	return parseBSON(reply[5:])
+}
+
+func readMongoMessage(c net.Conn) (int, []byte, error) {
+	h := make([]byte, 16)
+	if _, err := io.ReadFull(c, h); err != nil {
+		return 0, nil, fmt.Errorf("Error reading MongoDB reply: %v", err)
+	}
+	l := int(binary.LittleEndian.Uint32(h[0:4]))
+	if l < 16 || l > 1024*1024 {
+		return 0, nil, fmt.Errorf("Bad MongoDB message length %d", l)
+	}
+	body := make([]byte, l-16)
+	if _, err := io.ReadFull(c, body); err != nil {
+		return 0, nil, fmt.Errorf("Error reading MongoDB reply: %v", err)
+	}
+	return int(binary.LittleEndian.Uint32(h[12:16])), body, nil
+}
+
+// bsonDoc builds a document from key, value pairs, only int32 and string values are needed for the commands
+func bsonDoc(kv ...interface{}) []byte {
+	var e []byte
+	for i := 0; i+1 < len(kv); i += 2 {
+		key := kv[i].(string)
+		switch v := kv[i+1].(type) {
+		case int32:
+			e = append(append(append(e, 0x10), key...), 0)
+			e = binary.LittleEndian.AppendUint32(e, uint32(v))
+		case string:
+			e = append(append(append(e, 0x02), key...), 0)
+			e = binary.LittleEndian.AppendUint32(e, uint32(len(v)+1))
+			e = append(append(e, v...), 0)
+		}
+	}
+	doc := binary.LittleEndian.AppendUint32(nil, uint32(4+len(e)+1))
+	return append(append(doc, e...), 0)
+}
+
+// parseBSON decodes the top level of a document, nested documents and binary data are skipped
+func parseBSON(data []byte) (map[string]interface{}, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("BSON document too short")
+	}
+	l := int(binary.LittleEndian.Uint32(data))
+	if l < 5 || l > len(data) {
+		return nil, fmt.Errorf("Bad BSON document length")
+	}
+	data = data[4 : l-1]
+
+	doc := make(map[string]interface{})
+	for len(data) > 0 {
+		typ := data[0]
+		end := bytes.IndexByte(data[1:], 0)
+		if end < 0 {
+			return doc, fmt.Errorf("BSON key truncated")
+		}
+		key := string(data[1 : 1+end])
+		data = data[1+end+1:]
+
+		var size int
+		switch typ {
+		case 0x01, 0x09, 0x11, 0x12: // double, datetime, timestamp, int64
+			size = 8
+			if len(data) >= 8 && typ == 0x12 {
+				doc[key] = int64(binary.LittleEndian.Uint64(data))
+			}
+		case 0x02: // string
+			if len(data) < 4 {
+				return doc, fmt.Errorf("BSON string truncated")
+			}
+			size = 4 + int(binary.LittleEndian.Uint32(data))
+			if size >= 5 && len(data) >= size {
+				doc[key] = string(data[4 : size-1])
+			}
+		case 0x03, 0x04: // document, array
+			if len(data) < 4 {
+				return doc, fmt.Errorf("BSON document truncated")
+			}
+			size = int(binary.LittleEndian.Uint32(data))
+		case 0x05: // binary
+			if len(data) < 4 {
+				return doc, fmt.Errorf("BSON binary truncated")
+			}
+			size = 5 + int(binary.LittleEndian.Uint32(data))
+		case 0x07: // object id
+			size = 12
+		case 0x08: // bool
+			size = 1
+			if len(data) >= 1 {
+				doc[key] = data[0] == 1
+			}
+		case 0x0a: // null
+			doc[key] = nil
+		case 0x10: // int32
+			size = 4
+			if len(data) >= 4 {
+				doc[key] = int32(binary.LittleEndian.Uint32(data))
+			}
+		case 0x13: // decimal128
+			size = 16
+		default:
+			return doc, fmt.Errorf("Unsupported BSON type 0x%02x", typ)
+		}
+		if size < 0 || size > len(data) {
+			return doc, fmt.Errorf("BSON element truncated")
+		}
+		data = data[size:]
+	}
+	return doc, nil
+}
+
+// mssql prelogin options
+const (
+	tdsVersion    = 0x00
+	tdsEncryption = 0x01
+	tdsInstOpt    = 0x02
+	tdsThreadID   = 0x03
+	tdsMARS       = 0x04
+	tdsTerminator = 0xff
+)
+
+var mssqlProducts = map[int]string{
+	8:  "2000",
+	9:  "2005",
+	10: "2008",
+	11: "2012",
+	12: "2014",
+	13: "2016",
+	14: "2017",
+	15: "2019",
+	16: "2022",
+}
+
+func dbMSSQL(addr string, timeout time.Duration, info *DBInfo) error {
+	info.Product = "Microsoft SQL Server"
+
+	c, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := c.Write(mssqlPrelogin()); err != nil {
+		return fmt.Errorf("Error sending prelogin: %v", err)
+	}
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(c, header); err != nil {
+		return fmt.Errorf("Error reading prelogin response: %v", err)
+	}
+	if header[0] != 0x04 {
+		return fmt.Errorf("Unexpected TDS packet type 0x%02x", header[0])
+	}
+	l := int(binary.BigEndian.Uint16(header[2:4]))
+	if l < 8 {
+		return fmt.Errorf("Bad TDS packet length %d", l)
+	}
+	payload := make([]byte, l-8)
+	if _, err := io.ReadFull(c, payload); err != nil {
+		return fmt.Errorf("Error reading prelogin response: %v", err)
+	}
+	return parseMSSQLPrelogin(payload, info)
+}
+
+// the prelogin option table points into the same payload, the client side sends encryption off to see what the server wants
+func mssqlPrelogin() []byte {
+	type option struct {
+		token byte
+		data  []byte
+	}
+	opts := []option{
+		{tdsVersion, []byte{0, 0, 0, 0, 0, 0}},
+		{tdsEncryption, []byte{0x00}},
+		{tdsInstOpt, []byte{0x00}},
+		{tdsThreadID, []byte{0, 0, 0, 0}},
+		{tdsMARS, []byte{0x00}},
+	}
+
+	off := len(opts)*5 + 1
+	var table, data []byte
+	for _, o := range opts {
+		table = append(table, o.token)
+		table = binary.BigEndian.AppendUint16(table, uint16(off+len(data)))
+		table = binary.BigEndian.AppendUint16(table, uint16(len(o.data)))
+		data = append(data, o.data...)
+	}
+	payload := append(append(table, tdsTerminator), data...)
+
+	// prelogin, end of message, length, spid, packet id and window
+	pkt := []byte{0x12, 0x01, 0, 0, 0, 0, 0x01, 0x00}
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(8+len(payload)))
+	return append(pkt, payload...)
+}
+
+func parseMSSQLPrelogin(payload []byte, info *DBInfo) error {
+	for i := 0; i+5 <= len(payload) && payload[i] != tdsTerminator; i += 5 {
+		off := int(binary.BigEndian.Uint16(payload[i+1 : i+3]))
+		l := int(binary.BigEndian.Uint16(payload[i+3 : i+5]))
+		if off+l > len(payload) {
+			return fmt.Errorf("Prelogin option out of bounds")
+		}
+		data := payload[off : off+l]
+
+		switch payload[i] {
+		case tdsVersion:
+			if l < 6 {
+				continue
+			}
+			major := int(data[0])
+			info.Version = fmt.Sprintf("%d.%d.%d", major, data[1], binary.BigEndian.Uint16(data[2:4]))
+			if name, ok := mssqlProducts[major]; ok {
+				if major == 10 && data[1] == 50 {
+					name += " R2"
+				}
+				info.Product = "Microsoft SQL Server " + name
+			}
+		case tdsEncryption:
+			if l < 1 {
+				continue
+			}
+			switch data[0] {
+			case 0x00:
+				info.Fields["encryption"] = "off"
+				info.TLS = true // only the login packet is encrypted
+			case 0x01:
+				info.Fields["encryption"] = "on"
+				info.TLS = true
+			case 0x02:
+				info.Fields["encryption"] = "not supported"
+			case 0x03:
+				info.Fields["encryption"] = "required"
+				info.TLS = true
+				info.TLSRequired = true
+			}
+		case tdsInstOpt:
+			if l > 1 {
+				info.Fields["instance"] = string(bytes.TrimRight(data, "\x00"))
+			}
+		}
+	}
+	return nil
+}
+
+func (i *DBInfo) String() string {
+	s := i.Product
+	if i.Version != "" {
+		s += " " + i.Version
+	}
+	switch {
+	case i.TLSRequired:
+		s += ", TLS required"
+	case i.TLS:
+		s += ", TLS supported"
+	default:
+		s += ", no TLS"
+	}
+	keys := make([]string, 0, len(i.Fields))
+	for k := range i.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s += fmt.Sprintf("\n  %s: %s", k, i.Fields[k])
+	}
+	return s
+}
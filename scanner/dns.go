@@ -0,0 +1,356 @@
+package portslibK
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// DNSInfo is what the DNS server told about itself, if it resolves for others and which zones it transfers
+type DNSInfo struct {
+	Version      string // version.bind
+	ServerID     string // id.server or hostname.bind
+	Recursion    bool   // it resolved the external name for us
+	RecursionRA  bool   // it says recursion is available, even when it refused the name
+	Resolved     []string
+	Transfers    map[string]*ZoneTransfer
+	Transport    string // udp or tcp
+	ResponseCode string // of the recursion test
+}
+
+// ZoneTransfer is the result of an AXFR attempt for a zone
+type ZoneTransfer struct {
+	Allowed bool
+	Records int
+	Names   []string // the first names of the zone so the report shows what leaked
+	Error   string
+}
+
+// DNSProbe checks DNS servers on TCP and UDP, it is a PortProbe and an UDPProbe
+type DNSProbe struct {
+	Timeout       time.Duration
+	RecursionName string   // external name used for the recursion test
+	Zones         []string // zones to try AXFR for, none by default as it is noisy
+}
+
+// gopacket has no constant for the AXFR query type
+const dnsTypeAXFR layers.DNSType = 252
+
+// how many names of a transferred zone are kept
+const dnsTransferNames = 20
+
+func NewDNSProbe(timeout time.Duration) *DNSProbe {
+	return &DNSProbe{
+		Timeout:       timeout,
+		RecursionName: "www.example.com",
+	}
+}
+
+func (p *DNSProbe) Name() string {
+	return "dns"
+}
+
+func (p *DNSProbe) Probe(targetIP net.IP, r *TCPResult) error {
+	if r.service != nil {
+		if r.service.Service != "domain" && r.service.Service != "dns" {
+			return nil
+		}
+	} else if r.port != 53 {
+		return nil
+	}
+
+	info, err := p.Analyze(targetIP, r.port, true)
+	if err != nil {
+		return err
+	}
+	r.dns = info
+	return nil
+}
+
+func (p *DNSProbe) ProbeUDP(targetIP net.IP, r *UDPResult) error {
+	if r.port != 53 && r.service != "domain" {
+		return nil
+	}
+
+	info, err := p.Analyze(targetIP, r.port, false)
+	if err != nil {
+		return err
+	}
+	if r.info == nil {
+		r.info = make(map[string]string)
+	}
+	r.service = "domain"
+	if info.Version != "" {
+		r.version = info.Version
+	}
+	if info.ServerID != "" {
+		r.info["server id"] = info.ServerID
+	}
+	r.info["recursion"] = fmt.Sprintf("%t", info.Recursion)
+	r.info["recursion available"] = fmt.Sprintf("%t", info.RecursionRA)
+	if len(info.Resolved) > 0 {
+		r.info["resolved"] = strings.Join(info.Resolved, ", ")
+	}
+	for zone, t := range info.Transfers {
+		r.info["axfr "+zone] = t.summary()
+	}
+	return nil
+}
+
+// AnalyzeDNS runs the version, recursion and (for the zones given) AXFR checks over UDP or TCP
+func AnalyzeDNS(targetIP net.IP, port int, useTCP bool, zones []string, timeout time.Duration) (*DNSInfo, error) {
+	p := NewDNSProbe(timeout)
+	p.Zones = zones
+	return p.Analyze(targetIP, port, useTCP)
+}
+
+func (p *DNSProbe) Analyze(targetIP net.IP, port int, useTCP bool) (*DNSInfo, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	info := &DNSInfo{
+		Transport: "udp",
+		Transfers: make(map[string]*ZoneTransfer),
+	}
+	if useTCP {
+		info.Transport = "tcp"
+	}
+
+	answered := false
+	if resp, err := p.query(addr, useTCP, "version.bind", layers.DNSTypeTXT, layers.DNSClassCH, false); err == nil {
+		answered = true
+		info.Version = dnsTXT(resp)
+	}
+	for _, name := range []string{"id.server", "hostname.bind"} {
+		resp, err := p.query(addr, useTCP, name, layers.DNSTypeTXT, layers.DNSClassCH, false)
+		if err != nil {
+			continue
+		}
+		answered = true
+		if id := dnsTXT(resp); id != "" {
+			info.ServerID = id
+			break
+		}
+	}
+
+	if p.RecursionName != "" {
+		resp, err := p.query(addr, useTCP, p.RecursionName, layers.DNSTypeA, layers.DNSClassIN, true)
+		if err == nil {
+			answered = true
+			info.ResponseCode = resp.ResponseCode.String()
+			info.RecursionRA = resp.RA
+			for _, a := range resp.Answers {
+				switch a.Type {
+				case layers.DNSTypeA, layers.DNSTypeAAAA:
+					info.Resolved = append(info.Resolved, a.IP.String())
+				case layers.DNSTypeCNAME:
+					info.Resolved = append(info.Resolved, string(a.CNAME))
+				}
+			}
+			// an authoritative answer for its own zone is not recursion
+			info.Recursion = resp.ResponseCode == layers.DNSResponseCodeNoErr && len(resp.Answers) > 0 && !resp.AA
+		}
+	}
+
+	for _, zone := range p.Zones {
+		info.Transfers[zone] = p.axfr(addr, zone)
+		if info.Transfers[zone].Error == "" || info.Transfers[zone].Allowed {
+			answered = true
+		}
+	}
+
+	if !answered {
+		return nil, fmt.Errorf("No answer from the DNS server")
+	}
+	return info, nil
+}
+
+func (p *DNSProbe) query(addr string, useTCP bool, name string, qType layers.DNSType, qClass layers.DNSClass, recursion bool) (*layers.DNS, error) {
+	id := uint16(rand.Intn(0x10000))
+	q := dnsQuery(id, name, qType, qClass, recursion)
+
+	network := "udp"
+	if useTCP {
+		network = "tcp"
+	}
+	c, err := net.DialTimeout(network, addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(p.Timeout))
+
+	if useTCP {
+		if err := writeDNSTCP(c, q); err != nil {
+			return nil, err
+		}
+		data, err := readDNSTCP(c)
+		if err != nil {
+			return nil, err
+		}
+		return decodeDNSMessage(data, id)
+	}
+
+	if _, err := c.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// late answers to the earlier queries can still arrive
+		if resp, err := decodeDNSMessage(buf[:n], id); err == nil {
+			return resp, nil
+		}
+	}
+}
+
+// AXFR is TCP only, the transfer ends with the SOA it started with
+func (p *DNSProbe) axfr(addr, zone string) *ZoneTransfer {
+	t := &ZoneTransfer{}
+	id := uint16(rand.Intn(0x10000))
+
+	c, err := net.DialTimeout("tcp", addr, p.Timeout)
+	if err != nil {
+		t.Error = err.Error()
+		return t
+	}
+	defer c.Close()
+
+	if err := writeDNSTCP(c, dnsQuery(id, strings.TrimSuffix(zone, "."), dnsTypeAXFR, layers.DNSClassIN, false)); err != nil {
+		t.Error = err.Error()
+		return t
+	}
+
+	soas := 0
+	seen := make(map[string]bool)
+	for soas < 2 {
+		c.SetReadDeadline(time.Now().Add(p.Timeout))
+		data, err := readDNSTCP(c)
+		if err != nil {
+			if !t.Allowed {
+				t.Error = err.Error()
+			}
+			return t
+		}
+		resp, err := decodeDNSMessage(data, id)
+		if err != nil {
+			t.Error = err.Error()
+			return t
+		}
+		if resp.ResponseCode != layers.DNSResponseCodeNoErr {
+			t.Error = resp.ResponseCode.String()
+			return t
+		}
+		if len(resp.Answers) == 0 {
+			if !t.Allowed {
+				t.Error = "empty answer"
+			}
+			return t
+		}
+
+		t.Allowed = true
+		for _, a := range resp.Answers {
+			if a.Type == layers.DNSTypeSOA {
+				soas++
+			}
+			t.Records++
+			name := string(a.Name)
+			if !seen[name] && len(t.Names) < dnsTransferNames {
+				seen[name] = true
+				t.Names = append(t.Names, name)
+			}
+		}
+	}
+	// both SOAs are counted as records but it is the same one
+	t.Records--
+	return t
+}
+
+func writeDNSTCP(c net.Conn, msg []byte) error {
+	_, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...))
+	return err
+}
+
+func readDNSTCP(c net.Conn) ([]byte, error) {
+	l := make([]byte, 2)
+	if _, err := io.ReadFull(c, l); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(l))
+	if _, err := io.ReadFull(c, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func decodeDNSMessage(data []byte, id uint16) (*layers.DNS, error) {
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return nil, err
+	}
+	if !dns.QR || dns.ID != id {
+		return nil, fmt.Errorf("Not the answer to our query")
+	}
+	return dns, nil
+}
+
+func dnsTXT(resp *layers.DNS) string {
+	for _, a := range resp.Answers {
+		if a.Type == layers.DNSTypeTXT && len(a.TXTs) > 0 {
+			var parts []string
+			for _, t := range a.TXTs {
+				parts = append(parts, string(t))
+			}
+			return strings.Join(parts, " ")
+		}
+	}
+	return ""
+}
+
+func (t *ZoneTransfer) summary() string {
+	if !t.Allowed {
+		return "refused (" + t.Error + ")"
+	}
+	s := fmt.Sprintf("allowed, %d records", t.Records)
+	if len(t.Names) > 0 {
+		s += ": " + strings.Join(t.Names, ", ")
+	}
+	return s
+}
+
+func (i *DNSInfo) String() string {
+	s := fmt.Sprintf("over %s", i.Transport)
+	if i.Version != "" {
+		s += fmt.Sprintf(", version: %s", i.Version)
+	}
+	if i.ServerID != "" {
+		s += fmt.Sprintf(", server id: %s", i.ServerID)
+	}
+	switch {
+	case i.Recursion:
+		s += fmt.Sprintf("\n  recursion: open resolver, resolved %s", strings.Join(i.Resolved, ", "))
+	case i.RecursionRA:
+		s += fmt.Sprintf("\n  recursion: available but not for us (%s)", i.ResponseCode)
+	default:
+		s += "\n  recursion: no"
+	}
+	zones := make([]string, 0, len(i.Transfers))
+	for z := range i.Transfers {
+		zones = append(zones, z)
+	}
+	sort.Strings(zones)
+	for _, z := range zones {
+		s += fmt.Sprintf("\n  axfr %s: %s", z, i.Transfers[z].summary())
+	}
+	return s
+}
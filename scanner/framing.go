@@ -0,0 +1,118 @@
+package portslibK
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// linkFraming is what comes before the IP header on a link. The scanners send and decode with the framing of the
+// link type of their handle, ethernet on a NIC, nothing on tun and wireguard, the 4 byte family on a BSD loopback
+type linkFraming struct {
+	linkType layers.LinkType
+	size     int                // bytes before the IP header
+	first    gopacket.LayerType // the layer decoding starts with
+}
+
+func framingFor(linkType layers.LinkType) (linkFraming, error) {
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return linkFraming{linkType: linkType, size: 14, first: layers.LayerTypeEthernet}, nil
+	case layers.LinkTypeNull, layers.LinkTypeLoop:
+		return linkFraming{linkType: linkType, size: 4, first: layers.LayerTypeLoopback}, nil
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4:
+		return linkFraming{linkType: linkType, size: 0, first: layers.LayerTypeIPv4}, nil
+	case layers.LinkTypeLinuxSLL:
+		return linkFraming{linkType: linkType, size: 16, first: layers.LayerTypeLinuxSLL}, nil
+	}
+	return linkFraming{}, fmt.Errorf("Error framing packets: link type %s is not supported", linkType)
+}
+
+// only ethernet has addresses, the other links don't need the MAC of the target
+func (f linkFraming) ethernet() bool {
+	return f.linkType == layers.LinkTypeEthernet
+}
+
+// header is the layer before the IP one, nil when the packet goes as it is
+func (f linkFraming) header(src, dst net.HardwareAddr) (gopacket.SerializableLayer, error) {
+	switch f.linkType {
+	case layers.LinkTypeEthernet:
+		// the loopback has no address, its frames have zeros
+		if len(src) == 0 {
+			src = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+		}
+		if len(dst) == 0 {
+			dst = net.HardwareAddr{0, 0, 0, 0, 0, 0}
+		}
+		return &layers.Ethernet{SrcMAC: src, DstMAC: dst, EthernetType: layers.EthernetTypeIPv4}, nil
+	case layers.LinkTypeNull:
+		// the family is in host order, gopacket writes it little endian like macOS and the BSDs on x86 and arm
+		return &layers.Loopback{Family: layers.ProtocolFamilyIPv4}, nil
+	case layers.LinkTypeLoop:
+		// OpenBSD has it in network order
+		return gopacket.Payload{0, 0, 0, byte(layers.ProtocolFamilyIPv4)}, nil
+	case layers.LinkTypeLinuxSLL:
+		// libpcap refuses to inject on a cooked capture, the header is made up by the capture and not on the wire
+		return nil, fmt.Errorf("Error framing packets: nothing can be sent on a Linux cooked capture")
+	}
+	return nil, nil
+}
+
+// serialize puts the header of the link in front of the layers
+func (f linkFraming) serialize(src, dst net.HardwareAddr, opts gopacket.SerializeOptions, l ...gopacket.SerializableLayer) ([]byte, error) {
+	hdr, err := f.header(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	if hdr != nil {
+		l = append([]gopacket.SerializableLayer{hdr}, l...)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, opts, l...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// parser decodes the header of the link and then the layers given, IPv4 and what the scanner wants after it
+func (f linkFraming) parser(l ...gopacket.DecodingLayer) *gopacket.DecodingLayerParser {
+	p := gopacket.NewDecodingLayerParser(f.first)
+	switch f.first {
+	case layers.LayerTypeEthernet:
+		p.AddDecodingLayer(&layers.Ethernet{})
+	case layers.LayerTypeLoopback:
+		p.AddDecodingLayer(&layers.Loopback{})
+	case layers.LayerTypeLinuxSLL:
+		p.AddDecodingLayer(&layers.LinuxSLL{})
+	}
+	for _, d := range l {
+		p.AddDecodingLayer(d)
+	}
+	return p
+}
+
+// the layers the parser got through, for the traces of the frames it could not take apart
+func decodedLayers(decoded []gopacket.LayerType) string {
+	if len(decoded) == 0 {
+		return "nothing decoded"
+	}
+	names := make([]string, len(decoded))
+	for i, t := range decoded {
+		names[i] = t.String()
+	}
+	return "decoded " + strings.Join(names, "/")
+}
+
+// the layer the parser got to after IPv4, zero when it didn't get that far
+func transportLayer(decoded []gopacket.LayerType) gopacket.LayerType {
+	for i, t := range decoded {
+		if t == layers.LayerTypeIPv4 && i+1 < len(decoded) {
+			return decoded[i+1]
+		}
+	}
+	return gopacket.LayerTypeZero
+}
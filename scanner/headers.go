@@ -7,25 +7,57 @@ import (
 	"github.com/google/gopacket/layers"
 )
 
+// BuildSYNPacket builds the SYN in an ethernet frame from ifi to destMac. The scanner has no port of its own as the
+// scans of Start run at once, so the destination port is 0
+//
+// Deprecated: use BuildSYNFrame, it takes the port and frames for the other links too
 func (s *SynScanner) BuildSYNPacket(srcPort uint16, ifi *net.Interface, destMac net.HardwareAddr) ([]byte, error) {
 	ipLayer, tcpLayer, ethLayer := s.BuildLayers(srcPort, ifi, destMac)
 
-	tcpLayer.SetNetworkLayerForChecksum(&ipLayer)
-
 	buf := gopacket.NewSerializeBuffer()
-	opts := gopacket.SerializeOptions{
-		FixLengths:       true,
-		ComputeChecksums: true,
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	// the outermost layer goes first
+	if err := gopacket.SerializeLayers(buf, opts, &ethLayer, &ipLayer, &tcpLayer); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	if err := gopacket.SerializeLayers(buf, opts, &ipLayer, &tcpLayer, &ethLayer); err != nil {
+// BuildSYNFrame builds the SYN to port framed for the link type, the MAC of the target is only used on ethernet
+func (s *SynScanner) BuildSYNFrame(srcPort uint16, port int, linkType layers.LinkType, destMac net.HardwareAddr) ([]byte, error) {
+	f, err := framingFor(linkType)
+	if err != nil {
 		return nil, err
 	}
+	return s.buildSYN(nil, f, srcPort, port, destMac)
+}
 
-	return buf.Bytes(), nil
+// the packet is a copy of the template of the scanner written into buf, it is only allocated when buf is too small
+func (s *SynScanner) buildSYN(buf []byte, f linkFraming, srcPort uint16, port int, destMac net.HardwareAddr) ([]byte, error) {
+	t, err := s.synTemplate(f, destMac)
+	if err != nil {
+		return nil, err
+	}
+	return t.packet(t.buffer(buf), s.targetIP, srcPort, uint16(port)), nil
 }
 
+// BuildLayers gives the layers of the SYN with an ethernet header from ifi to destMac, the destination port of the
+// TCP layer is left for the caller to set
 func (s *SynScanner) BuildLayers(srcPort uint16, ifi *net.Interface, destMac net.HardwareAddr) (layers.IPv4, layers.TCP, layers.Ethernet) {
+	ipLayer, tcpLayer := s.synLayers(srcPort)
+
+	ethLayer := layers.Ethernet{
+		EthernetType: layers.EthernetTypeIPv4,
+		DstMAC:       destMac,
+		SrcMAC:       ifi.HardwareAddr,
+	}
+
+	return ipLayer, tcpLayer, ethLayer
+}
+
+// the IP and TCP layers of the SYN without the destination port, the header of the link goes in front of them when
+// they are serialized as it depends on the handle
+func (s *SynScanner) synLayers(srcPort uint16) (layers.IPv4, layers.TCP) {
 	ipLayer := layers.IPv4{
 		SrcIP:    s.sourceIP,
 		DstIP:    s.targetIP,
@@ -36,18 +68,11 @@ func (s *SynScanner) BuildLayers(srcPort uint16, ifi *net.Interface, destMac net
 
 	tcpLayer := layers.TCP{
 		SrcPort: layers.TCPPort(srcPort),
-		DstPort: layers.TCPPort(s.port),
 		SYN:     true,
 		// Window:  14600,
 	}
 
-	ethLayer := layers.Ethernet{
-		EthernetType: layers.EthernetTypeIPv4,
-		DstMAC:       destMac,
-		SrcMAC:       ifi.HardwareAddr,
-	}
-
 	tcpLayer.SetNetworkLayerForChecksum(&ipLayer)
 
-	return ipLayer, tcpLayer, ethLayer
+	return ipLayer, tcpLayer
 }
@@ -0,0 +1,285 @@
+package portslibK
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HTTPInfo is what the HTTP fingerprinting found out about a web port
+type HTTPInfo struct {
+	URL         string
+	TLS         bool
+	Status      int
+	Server      string
+	PoweredBy   string
+	Title       string
+	Redirects   []string // every location we got redirected to, in order
+	Favicon     string   // url of the favicon the hash is from
+	FaviconHash int32    // murmur3 of the base64 encoded favicon, the same hash shodan uses
+	AltSvc      string
+	H3          []string // the HTTP/3 entries of the Alt-Svc, like h3=":443"
+}
+
+// HTTPProbe fingerprints the web ports, it is a PortProbe so it can be added to the TCP and SYN scanners
+type HTTPProbe struct {
+	Timeout      time.Duration
+	MaxRedirects int
+}
+
+// ports tried as web ports when the service detection did not run
+var webPorts = map[int]bool{80: true, 81: true, 443: true, 591: true, 3000: true, 5000: true, 8000: true, 8008: true, 8080: true, 8081: true, 8443: true, 8888: true, 9000: true, 9443: true}
+var webTLSPorts = map[int]bool{443: true, 8443: true, 9443: true}
+
+var titleRe = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+var iconRe = regexp.MustCompile(`(?is)<link[^>]+rel=["']?(?:shortcut )?icon["']?[^>]*>`)
+var hrefRe = regexp.MustCompile(`(?is)href=["']?([^"' >]+)`)
+
+func NewHTTPProbe(timeout time.Duration) *HTTPProbe {
+	return &HTTPProbe{
+		Timeout:      timeout,
+		MaxRedirects: 5,
+	}
+}
+
+func (p *HTTPProbe) Name() string {
+	return "http"
+}
+
+func (p *HTTPProbe) Probe(targetIP net.IP, r *TCPResult) error {
+	useTLS := webTLSPorts[r.port]
+	if r.service != nil {
+		if r.service.Service != "http" {
+			return nil
+		}
+		useTLS = r.service.TLS
+	} else if !webPorts[r.port] {
+		return nil
+	}
+
+	info, err := p.fingerprint(targetIP, r.port, useTLS)
+	if err != nil && r.service == nil {
+		// we were only guessing by the port, so try the other scheme too
+		info, err = p.fingerprint(targetIP, r.port, !useTLS)
+	}
+	if err != nil {
+		return err
+	}
+	r.http = info
+	return nil
+}
+
+// FingerprintHTTP requests the root page of the port (and its favicon) over plain HTTP or TLS
+func FingerprintHTTP(targetIP net.IP, port int, useTLS bool, timeout time.Duration) (*HTTPInfo, error) {
+	return NewHTTPProbe(timeout).fingerprint(targetIP, port, useTLS)
+}
+
+func (p *HTTPProbe) fingerprint(targetIP net.IP, port int, useTLS bool) (*HTTPInfo, error) {
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	info := &HTTPInfo{
+		URL: fmt.Sprintf("%s://%s/", scheme, net.JoinHostPort(targetIP.String(), strconv.Itoa(port))),
+		TLS: useTLS,
+	}
+
+	client := p.client(targetIP.String(), &info.Redirects)
+
+	// HEAD first so we don't download bodies that are not pages
+	resp, err := client.Head(info.URL)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if err != nil || resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented ||
+		strings.Contains(resp.Header.Get("Content-Type"), "html") {
+		info.Redirects = nil
+		resp, err = client.Get(info.URL)
+		if err != nil {
+			return nil, fmt.Errorf("Error requesting %s: %v", info.URL, err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+		if m := titleRe.FindSubmatch(body); m != nil {
+			info.Title = strings.Join(strings.Fields(html.UnescapeString(string(m[1]))), " ")
+		}
+		info.Favicon = faviconURL(resp.Request.URL, body)
+	} else {
+		info.Favicon = faviconURL(resp.Request.URL, nil)
+	}
+
+	info.Status = resp.StatusCode
+	info.Server = resp.Header.Get("Server")
+	info.PoweredBy = resp.Header.Get("X-Powered-By")
+	info.AltSvc = resp.Header.Get("Alt-Svc")
+	info.H3 = altSvcH3(info.AltSvc)
+
+	if info.Favicon != "" {
+		// a client of its own, the redirects of the favicon are not the ones of the page
+		info.FaviconHash, _ = p.faviconHash(p.client(targetIP.String(), nil), targetIP.String(), info.Favicon)
+	}
+
+	return info, nil
+}
+
+// entries look like h3=":443"; ma=86400, the drafts are h3-29 and so on
+func altSvcH3(altSvc string) []string {
+	var h3 []string
+	for _, entry := range strings.Split(altSvc, ",") {
+		alt, _, _ := strings.Cut(strings.TrimSpace(entry), ";")
+		if strings.HasPrefix(alt, "h3") {
+			h3 = append(h3, alt)
+		}
+	}
+	return h3
+}
+
+// the client follows redirects on the target only, one to another host is recorded (when redirects is not nil) but
+// not requested, the scan doesn't send anything to hosts that are not the target
+func (p *HTTPProbe) client(host string, redirects *[]string) *http.Client {
+	dialer := &net.Dialer{Timeout: p.Timeout}
+	return &http.Client{
+		Timeout: p.Timeout * 2,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if redirects != nil {
+				*redirects = append(*redirects, req.URL.String())
+			}
+			if req.URL.Hostname() != host || len(via) > p.MaxRedirects {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+}
+
+// the icon from the page if it has one, /favicon.ico otherwise
+func faviconURL(base *url.URL, body []byte) string {
+	ref := "/favicon.ico"
+	if link := iconRe.Find(body); link != nil {
+		if m := hrefRe.FindSubmatch(link); m != nil {
+			ref = html.UnescapeString(string(m[1]))
+		}
+	}
+	u, err := base.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	return u.String()
+}
+
+func (p *HTTPProbe) faviconHash(client *http.Client, host, u string) (int32, error) {
+	// the page can link an icon on a CDN, that's not the target
+	if fu, err := url.Parse(u); err != nil || fu.Hostname() != host {
+		return 0, fmt.Errorf("Favicon %s is not on %s", u, host)
+	}
+	resp, err := client.Get(u)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Favicon returned %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil || len(data) == 0 {
+		return 0, fmt.Errorf("Error reading favicon: %v", err)
+	}
+	return faviconMurmur(data), nil
+}
+
+// shodan hashes the favicon base64 encoded with a newline after every 76 characters (python's encodebytes)
+func faviconMurmur(data []byte) int32 {
+	enc := base64.StdEncoding.EncodeToString(data)
+	var b strings.Builder
+	for len(enc) > 76 {
+		b.WriteString(enc[:76])
+		b.WriteByte('\n')
+		enc = enc[76:]
+	}
+	b.WriteString(enc)
+	b.WriteByte('\n')
+	return int32(murmur3([]byte(b.String()), 0))
+}
+
+// 32 bit murmur3 hash
+func murmur3(data []byte, seed uint32) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+	h := seed
+	n := len(data) / 4
+
+	for i := 0; i < n; i++ {
+		k := uint32(data[i*4]) | uint32(data[i*4+1])<<8 | uint32(data[i*4+2])<<16 | uint32(data[i*4+3])<<24
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+		h ^= k
+		h = h<<13 | h>>19
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[n*4:]
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+func (i *HTTPInfo) String() string {
+	s := fmt.Sprintf("%s %d", i.URL, i.Status)
+	if i.Server != "" {
+		s += fmt.Sprintf(", server: %s", i.Server)
+	}
+	if i.PoweredBy != "" {
+		s += fmt.Sprintf(", powered by: %s", i.PoweredBy)
+	}
+	if i.Title != "" {
+		s += fmt.Sprintf(", title: %q", i.Title)
+	}
+	if len(i.Redirects) > 0 {
+		s += fmt.Sprintf(", redirects: %s", strings.Join(i.Redirects, " -> "))
+	}
+	if len(i.H3) > 0 {
+		s += fmt.Sprintf(", http/3: %s", strings.Join(i.H3, " "))
+	}
+	if i.FaviconHash != 0 {
+		s += fmt.Sprintf(", favicon hash: %d", i.FaviconHash)
+	}
+	return s
+}
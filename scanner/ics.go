@@ -0,0 +1,321 @@
+package portslibK
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ICSInfo is the identification of an industrial or IoT service, nothing sent to get it changes the device
+type ICSInfo struct {
+	Protocol string
+	Vendor   string
+	Product  string
+	Version  string
+	Fields   map[string]string
+}
+
+// ICSProbe identifies Modbus/TCP and MQTT, CoAP and BACnet are UDP and done by the payloads of the UDP scanner, it is a PortProbe
+type ICSProbe struct {
+	Timeout time.Duration
+}
+
+type icsFunc func(c net.Conn, timeout time.Duration, info *ICSInfo) error
+
+var icsProtocols = map[string]icsFunc{
+	"modbus": icsModbus,
+	"mqtt":   icsMQTT,
+}
+
+var icsPorts = map[int]string{
+	502:  "modbus",
+	1883: "mqtt",
+	8883: "mqtt",
+}
+
+// names from the service detection
+var icsServices = map[string]string{
+	"modbus": "modbus",
+	"mbap":   "modbus",
+	"mqtt":   "mqtt",
+}
+
+func NewICSProbe(timeout time.Duration) *ICSProbe {
+	return &ICSProbe{
+		Timeout: timeout,
+	}
+}
+
+func (p *ICSProbe) Name() string {
+	return "ics"
+}
+
+func (p *ICSProbe) Probe(targetIP net.IP, r *TCPResult) error {
+	useTLS := r.port == 8883
+	var proto string
+	if r.service != nil {
+		proto = icsServices[r.service.Service]
+		useTLS = r.service.TLS
+	} else {
+		proto = icsPorts[r.port]
+	}
+	if proto == "" {
+		return nil
+	}
+
+	info, err := p.Identify(targetIP, r.port, proto, useTLS)
+	if err != nil {
+		return err
+	}
+	r.ics = info
+	return nil
+}
+
+// IdentifyICS asks the device on the port who it is, protocol is modbus or mqtt
+func IdentifyICS(targetIP net.IP, port int, protocol string, useTLS bool, timeout time.Duration) (*ICSInfo, error) {
+	return NewICSProbe(timeout).Identify(targetIP, port, protocol, useTLS)
+}
+
+func (p *ICSProbe) Identify(targetIP net.IP, port int, protocol string, useTLS bool) (*ICSInfo, error) {
+	f, ok := icsProtocols[protocol]
+	if !ok {
+		return nil, fmt.Errorf("No ICS probe for %s", protocol)
+	}
+
+	c, err := dialProbe(net.JoinHostPort(targetIP.String(), strconv.Itoa(port)), p.Timeout, useTLS)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(p.Timeout * 3))
+
+	info := &ICSInfo{
+		Protocol: protocol,
+		Fields:   make(map[string]string),
+	}
+	if err := f(c, p.Timeout, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// objects of the Modbus read device identification
+var modbusObjects = map[byte]string{
+	0x00: "vendor",
+	0x01: "product code",
+	0x02: "revision",
+	0x03: "vendor url",
+	0x04: "product name",
+	0x05: "model name",
+	0x06: "application name",
+}
+
+var modbusExceptions = map[byte]string{
+	0x01: "illegal function",
+	0x02: "illegal data address",
+	0x03: "illegal data value",
+	0x04: "server device failure",
+	0x0a: "gateway path unavailable",
+	0x0b: "gateway target failed to respond",
+}
+
+// read device identification (function 43/14) is read only, gateways need the right unit id so a few common ones are tried
+func icsModbus(c net.Conn, timeout time.Duration, info *ICSInfo) error {
+	var lastErr error
+	for i, unit := range []byte{0x00, 0x01, 0xff} {
+		objects, err := modbusDeviceID(c, timeout, uint16(i+1), unit)
+		if err != nil {
+			lastErr = err
+			if _, ok := err.(*modbusException); ok {
+				// it speaks modbus, it just does not do the identification
+				info.Fields["exception"] = err.Error()
+				info.Fields["unit id"] = strconv.Itoa(int(unit))
+				continue
+			}
+			if isTimeout(err) {
+				continue
+			}
+			break
+		}
+
+		delete(info.Fields, "exception")
+		info.Fields["unit id"] = strconv.Itoa(int(unit))
+		for id, v := range objects {
+			switch id {
+			case 0x00:
+				info.Vendor = v
+			case 0x01:
+				info.Product = v
+			case 0x02:
+				info.Version = v
+			case 0x04:
+				if info.Product == "" {
+					info.Product = v
+				} else {
+					info.Fields["product name"] = v
+				}
+			default:
+				name, ok := modbusObjects[id]
+				if !ok {
+					name = fmt.Sprintf("object 0x%02x", id)
+				}
+				info.Fields[name] = v
+			}
+		}
+		return nil
+	}
+	if _, ok := info.Fields["exception"]; ok {
+		return nil
+	}
+	return fmt.Errorf("No Modbus reply: %v", lastErr)
+}
+
+type modbusException struct {
+	code byte
+}
+
+func (e *modbusException) Error() string {
+	if name, ok := modbusExceptions[e.code]; ok {
+		return name
+	}
+	return fmt.Sprintf("exception 0x%02x", e.code)
+}
+
+func modbusDeviceID(c net.Conn, timeout time.Duration, tid uint16, unit byte) (map[byte]string, error) {
+	objects := make(map[byte]string)
+	next := byte(0x00)
+	code := byte(0x02) // regular identification, it includes the basic objects
+
+	for n := 0; n < 8; n++ {
+		req := make([]byte, 7, 12)
+		binary.BigEndian.PutUint16(req[0:2], tid)
+		binary.BigEndian.PutUint16(req[4:6], 5) // unit id and the pdu
+		req[6] = unit
+		req = append(req, 0x2b, 0x0e, code, next)
+
+		c.SetDeadline(time.Now().Add(timeout))
+		if _, err := c.Write(req); err != nil {
+			return nil, err
+		}
+		header := make([]byte, 7)
+		if _, err := io.ReadFull(c, header); err != nil {
+			return nil, err
+		}
+		l := int(binary.BigEndian.Uint16(header[4:6]))
+		if binary.BigEndian.Uint16(header[2:4]) != 0 || l < 2 || l > 260 {
+			return nil, fmt.Errorf("Not a Modbus reply")
+		}
+		pdu := make([]byte, l-1)
+		if _, err := io.ReadFull(c, pdu); err != nil {
+			return nil, err
+		}
+
+		if pdu[0] == 0xab {
+			if code == 0x02 && len(pdu) >= 2 && pdu[1] == 0x03 {
+				// some devices only know the basic identification
+				code = 0x01
+				continue
+			}
+			return nil, &modbusException{code: pdu[len(pdu)-1]}
+		}
+		// function, MEI type, code, conformity, more follows, next object and the number of objects
+		if pdu[0] != 0x2b || len(pdu) < 7 {
+			return nil, fmt.Errorf("Unexpected Modbus function 0x%02x", pdu[0])
+		}
+		more, count := pdu[4], int(pdu[6])
+		next = pdu[5]
+		off := 7
+		for i := 0; i < count && off+2 <= len(pdu); i++ {
+			id, ol := pdu[off], int(pdu[off+1])
+			if off+2+ol > len(pdu) {
+				break
+			}
+			objects[id] = strings.TrimSpace(string(pdu[off+2 : off+2+ol]))
+			off += 2 + ol
+		}
+		if more != 0xff {
+			break
+		}
+	}
+	return objects, nil
+}
+
+var mqttReturnCodes = map[byte]string{
+	0: "accepted",
+	1: "unacceptable protocol version",
+	2: "identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// a clean session without a will, the broker keeps nothing after we disconnect
+func icsMQTT(c net.Conn, timeout time.Duration, info *ICSInfo) error {
+	id := make([]byte, 4)
+	rand.Read(id)
+	clientID := "portslibk-" + hex.EncodeToString(id)
+
+	var v []byte
+	v = binary.BigEndian.AppendUint16(v, 4)
+	v = append(v, "MQTT"...)
+	v = append(v, 4)    // 3.1.1
+	v = append(v, 0x02) // clean session
+	v = binary.BigEndian.AppendUint16(v, 30)
+	v = binary.BigEndian.AppendUint16(v, uint16(len(clientID)))
+	v = append(v, clientID...)
+
+	connect := append([]byte{0x10, byte(len(v))}, v...)
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write(connect); err != nil {
+		return err
+	}
+
+	connack := make([]byte, 4)
+	if _, err := io.ReadFull(c, connack); err != nil {
+		return fmt.Errorf("Error reading CONNACK: %v", err)
+	}
+	if connack[0] != 0x20 || connack[1] != 0x02 {
+		return fmt.Errorf("Not an MQTT CONNACK")
+	}
+
+	rc := connack[3]
+	name, ok := mqttReturnCodes[rc]
+	if !ok {
+		name = strconv.Itoa(int(rc))
+	}
+	info.Version = "3.1.1"
+	info.Fields["connect"] = name
+	switch rc {
+	case 0:
+		info.Fields["auth"] = "none"
+		c.Write([]byte{0xe0, 0x00})
+	case 4, 5:
+		info.Fields["auth"] = "required"
+	}
+	return nil
+}
+
+func (i *ICSInfo) String() string {
+	s := i.Protocol
+	for _, v := range []string{i.Vendor, i.Product, i.Version} {
+		if v != "" {
+			s += " " + v
+		}
+	}
+	keys := make([]string, 0, len(i.Fields))
+	for k := range i.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s += fmt.Sprintf("\n  %s: %s", k, i.Fields[k])
+	}
+	return s
+}
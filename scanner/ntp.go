@@ -0,0 +1,391 @@
+package portslibK
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// seconds between the NTP epoch (1900) and the unix one
+const ntpEpochOffset = 2208988800
+
+// NTPInfo is the parsed server reply and what the control (mode 6) and private (mode 7) queries exposed
+type NTPInfo struct {
+	Version        int
+	Mode           int
+	Stratum        int
+	ReferenceID    string
+	Precision      int // log2 seconds
+	RootDelay      time.Duration
+	RootDispersion time.Duration
+	ReferenceTime  time.Time
+	Time           time.Time // transmit time of the server
+	Offset         time.Duration
+
+	ReadVar *NTPAmplification // mode 6 readvar
+	Monlist *NTPAmplification // mode 7 monlist
+}
+
+// NTPAmplification is what a mode 6 or 7 query returned and how much bigger the answer was than the request
+type NTPAmplification struct {
+	RequestSize   int
+	ResponseSize  int // all the packets together
+	Packets       int
+	Amplification float64
+	Variables     map[string]string // readvar only
+	Clients       []string          // monlist only, the first addresses of the list
+	Entries       int               // monlist only
+}
+
+// NTPProbe asks the server for the time and optionally the mode 6 and 7 queries used for amplification, it is an UDPProbe
+type NTPProbe struct {
+	Timeout time.Duration
+	ReadVar bool // off by default, the server answers it with more than it got
+	Monlist bool // off by default, same as ReadVar but the answer can be a hundred times bigger
+}
+
+// how many monlist clients are kept for the report
+const ntpMonlistClients = 10
+
+func NewNTPProbe(timeout time.Duration) *NTPProbe {
+	return &NTPProbe{
+		Timeout: timeout,
+	}
+}
+
+func (p *NTPProbe) Name() string {
+	return "ntp"
+}
+
+func (p *NTPProbe) ProbeUDP(targetIP net.IP, r *UDPResult) error {
+	if r.port != 123 && r.service != "ntp" {
+		return nil
+	}
+
+	info, err := p.Analyze(targetIP, r.port)
+	if err != nil {
+		return err
+	}
+	if r.info == nil {
+		r.info = make(map[string]string)
+	}
+	r.service = "ntp"
+	if info.Version != 0 {
+		info.fill(r)
+	}
+	if a := info.ReadVar; a != nil {
+		r.info["readvar"] = a.summary()
+		if v, ok := a.Variables["version"]; ok {
+			r.version = v
+		}
+		if v, ok := a.Variables["system"]; ok {
+			r.info["system"] = v
+		}
+	}
+	if a := info.Monlist; a != nil {
+		r.info["monlist"] = a.summary()
+	}
+	return nil
+}
+
+// AnalyzeNTP asks for the time and tries readvar and monlist
+func AnalyzeNTP(targetIP net.IP, port int, timeout time.Duration) (*NTPInfo, error) {
+	return NewNTPProbe(timeout).Analyze(targetIP, port)
+}
+
+func (p *NTPProbe) Analyze(targetIP net.IP, port int) (*NTPInfo, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	info := &NTPInfo{}
+	answered := false
+
+	req := ntpClientRequest()
+	sent := time.Now()
+	if resp, err := p.exchange(addr, req, func([]byte) bool { return false }); err == nil && len(resp) > 0 {
+		received := time.Now()
+		if parsed, err := parseNTP(resp[0]); err == nil {
+			*info = *parsed
+			// a rough offset, the round trip is split in half
+			info.Offset = info.Time.Sub(sent.Add(received.Sub(sent) / 2))
+			answered = true
+		}
+	}
+
+	if p.ReadVar {
+		req := ntpReadVarRequest()
+		resp, err := p.exchange(addr, req, func(b []byte) bool {
+			// the last fragment does not have the more bit
+			return len(b) >= 2 && b[1]&0x20 != 0
+		})
+		if err == nil {
+			if a := ntpAmplification(req, resp, 6); a != nil {
+				a.Variables = parseReadVar(resp)
+				info.ReadVar = a
+				answered = true
+			}
+		}
+	}
+
+	if p.Monlist {
+		req := ntpMonlistRequest()
+		resp, err := p.exchange(addr, req, func(b []byte) bool {
+			return len(b) >= 2 && b[0]&0x40 != 0
+		})
+		if err == nil {
+			if a := ntpAmplification(req, resp, 7); a != nil {
+				a.Entries, a.Clients = parseMonlist(resp)
+				if a.Entries > 0 {
+					info.Monlist = a
+				}
+				answered = true
+			}
+		}
+	}
+
+	if !answered {
+		return nil, fmt.Errorf("No answer from the NTP server")
+	}
+	return info, nil
+}
+
+// sends the request and reads replies until more says there are no more or the timeout
+func (p *NTPProbe) exchange(addr string, req []byte, more func([]byte) bool) ([][]byte, error) {
+	c, err := net.DialTimeout("udp", addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if _, err := c.Write(req); err != nil {
+		return nil, err
+	}
+
+	var resp [][]byte
+	buf := make([]byte, 65535)
+	c.SetReadDeadline(time.Now().Add(p.Timeout))
+	for len(resp) < 1000 {
+		n, err := c.Read(buf)
+		if err != nil {
+			if len(resp) > 0 && isTimeout(err) {
+				break
+			}
+			return resp, err
+		}
+		pkt := append([]byte(nil), buf[:n]...)
+		resp = append(resp, pkt)
+		if !more(pkt) {
+			break
+		}
+		// the next fragments come right after each other
+		c.SetReadDeadline(time.Now().Add(p.Timeout))
+	}
+	return resp, nil
+}
+
+// v4 client request with our transmit time so the reply can be matched
+func ntpClientRequest() []byte {
+	req := make([]byte, 48)
+	req[0] = 0x23 // v4, client
+	binary.BigEndian.PutUint64(req[40:48], ntpTimestamp(time.Now()))
+	return req
+}
+
+// mode 6 read variables for the system association
+func ntpReadVarRequest() []byte {
+	req := make([]byte, 12)
+	req[0] = 0x16 // v2, control
+	req[1] = 0x02 // read variables
+	binary.BigEndian.PutUint16(req[2:4], 1)
+	return req
+}
+
+// mode 7 MON_GETLIST_1 for the xntpd implementation, padded like ntpdc does
+func ntpMonlistRequest() []byte {
+	req := make([]byte, 48)
+	req[0] = 0x17 // v2, private
+	req[2] = 0x03 // xntpd
+	req[3] = 0x2a // MON_GETLIST_1
+	return req
+}
+
+// only the replies of the right mode count
+func ntpAmplification(req []byte, resp [][]byte, mode byte) *NTPAmplification {
+	a := &NTPAmplification{RequestSize: len(req)}
+	for _, r := range resp {
+		if len(r) < 4 || r[0]&0x07 != mode {
+			continue
+		}
+		// mode 7 errors are in the top bits of the item count, the header is 8 bytes
+		if mode == 7 && (len(r) < 8 || r[4]>>4 != 0) {
+			continue
+		}
+		a.Packets++
+		a.ResponseSize += len(r)
+	}
+	if a.Packets == 0 {
+		return nil
+	}
+	a.Amplification = float64(a.ResponseSize) / float64(a.RequestSize)
+	return a
+}
+
+func parseNTP(data []byte) (*NTPInfo, error) {
+	if len(data) < 48 {
+		return nil, fmt.Errorf("NTP response too short: %d bytes", len(data))
+	}
+	info := &NTPInfo{
+		Version:        int(data[0]>>3) & 0x07,
+		Mode:           int(data[0] & 0x07),
+		Stratum:        int(data[1]),
+		Precision:      int(int8(data[3])),
+		RootDelay:      ntpShort(binary.BigEndian.Uint32(data[4:8])),
+		RootDispersion: ntpShort(binary.BigEndian.Uint32(data[8:12])),
+		ReferenceTime:  ntpTime(binary.BigEndian.Uint64(data[16:24])),
+		Time:           ntpTime(binary.BigEndian.Uint64(data[40:48])),
+	}
+
+	// stratum 0 and 1 have an ascii identifier of the clock, the others the IP of their upstream server
+	refID := data[12:16]
+	if info.Stratum <= 1 {
+		info.ReferenceID = strings.TrimRight(string(refID), "\x00")
+	} else {
+		info.ReferenceID = net.IP(refID).String()
+	}
+	return info, nil
+}
+
+// 16.16 fixed point seconds
+func ntpShort(v uint32) time.Duration {
+	return time.Duration(float64(v) / 65536 * float64(time.Second))
+}
+
+// 32.32 fixed point seconds since 1900
+func ntpTime(v uint64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	secs := int64(v>>32) - ntpEpochOffset
+	frac := float64(v&0xffffffff) / math.Exp2(32)
+	return time.Unix(secs, int64(frac*1e9)).UTC()
+}
+
+func ntpTimestamp(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(float64(t.Nanosecond()) / 1e9 * math.Exp2(32))
+	return secs<<32 | frac
+}
+
+// the data of the fragments is a comma separated list of name=value, values can be quoted
+func parseReadVar(resp [][]byte) map[string]string {
+	var data []byte
+	for _, r := range resp {
+		if len(r) < 12 || r[0]&0x07 != 6 {
+			continue
+		}
+		count := int(binary.BigEndian.Uint16(r[10:12]))
+		off := int(binary.BigEndian.Uint16(r[8:10]))
+		if 12+count > len(r) || off > 64*1024 {
+			continue
+		}
+		if len(data) < off+count {
+			data = append(data, make([]byte, off+count-len(data))...)
+		}
+		copy(data[off:], r[12:12+count])
+	}
+
+	vars := make(map[string]string)
+	var field strings.Builder
+	quoted := false
+	flush := func() {
+		k, v, _ := strings.Cut(strings.TrimSpace(field.String()), "=")
+		if k != "" {
+			vars[k] = strings.Trim(v, "\"")
+		}
+		field.Reset()
+	}
+	for _, b := range data {
+		switch {
+		case b == '"':
+			quoted = !quoted
+			field.WriteByte(b)
+		case b == ',' && !quoted:
+			flush()
+		case b == '\r' || b == '\n' || b == 0:
+		default:
+			field.WriteByte(b)
+		}
+	}
+	flush()
+	return vars
+}
+
+// items of MON_GETLIST_1 are 72 bytes with the client address at 16
+func parseMonlist(resp [][]byte) (int, []string) {
+	entries := 0
+	var clients []string
+	for _, r := range resp {
+		if len(r) < 8 || r[0]&0x07 != 7 || r[4]>>4 != 0 {
+			continue
+		}
+		items := int(binary.BigEndian.Uint16(r[4:6]) & 0x0fff)
+		size := int(binary.BigEndian.Uint16(r[6:8]) & 0x0fff)
+		entries += items
+		for i := 0; i < items && size >= 20; i++ {
+			off := 8 + i*size
+			if off+20 > len(r) || len(clients) >= ntpMonlistClients {
+				break
+			}
+			clients = append(clients, net.IP(r[off+16:off+20]).String())
+		}
+	}
+	return entries, clients
+}
+
+// fills the result of the UDP scan with the parsed reply
+func (i *NTPInfo) fill(r *UDPResult) {
+	r.service = "ntp"
+	r.version = fmt.Sprintf("v%d", i.Version)
+	r.info["stratum"] = strconv.Itoa(i.Stratum)
+	r.info["mode"] = strconv.Itoa(i.Mode)
+	r.info["precision"] = strconv.Itoa(i.Precision)
+	r.info["reference id"] = i.ReferenceID
+	r.info["root delay"] = i.RootDelay.String()
+	r.info["root dispersion"] = i.RootDispersion.String()
+	if !i.Time.IsZero() {
+		r.info["time"] = i.Time.Format(time.RFC3339Nano)
+	}
+	if i.Offset != 0 {
+		r.info["offset"] = i.Offset.String()
+	}
+}
+
+func (a *NTPAmplification) summary() string {
+	s := fmt.Sprintf("%d bytes in %d packets for a %d byte request, amplification %.1fx", a.ResponseSize, a.Packets, a.RequestSize, a.Amplification)
+	if a.Entries > 0 {
+		s += fmt.Sprintf(", %d clients", a.Entries)
+		if len(a.Clients) > 0 {
+			s += ": " + strings.Join(a.Clients, ", ")
+		}
+	}
+	return s
+}
+
+func (i *NTPInfo) String() string {
+	s := fmt.Sprintf("v%d stratum %d, reference %s, precision 2^%d", i.Version, i.Stratum, i.ReferenceID, i.Precision)
+	if !i.Time.IsZero() {
+		s += fmt.Sprintf(", time %s (offset %s)", i.Time.Format(time.RFC3339), i.Offset)
+	}
+	if i.ReadVar != nil {
+		s += "\n  readvar: " + i.ReadVar.summary()
+		if v, ok := i.ReadVar.Variables["version"]; ok {
+			s += fmt.Sprintf("\n  version: %s", v)
+		}
+	}
+	if i.Monlist != nil {
+		s += "\n  monlist: " + i.Monlist.summary()
+	}
+	return s
+}
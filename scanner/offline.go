@@ -0,0 +1,303 @@
+package portslibK
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// OfflineAnalyzer reads a capture and works out the port states of the probes in it like the scanners would have,
+// on top of everything the passive mode gets from the traffic
+type OfflineAnalyzer struct {
+	path   string
+	source net.IP // only the probes sent from here count, all of them when nil
+	portR  []int
+	inv    *inventory
+	probes map[string]*offlineProbe
+	order  []*offlineProbe
+	flows  map[string]bool // TCP connections seen doing something else than a bare ACK
+}
+
+// what the capture file is read with, libpcap or pcapgo when built without it
+type captureReader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+	Close()
+}
+
+// a probe seen in the capture and how it was answered
+type offlineProbe struct {
+	kind    string // syn, ack or udp
+	target  net.IP
+	port    int
+	source  net.IP
+	state   string // empty until answered
+	details string
+	payload []byte // the UDP answer
+}
+
+// AnalyzePcap reads the capture file and returns the hosts with the ports probed in it
+func AnalyzePcap(path string, portArr []int) ([]*HostResult, error) {
+	return NewOfflineAnalyzer(path, portArr).Analyze()
+}
+
+func NewOfflineAnalyzer(path string, portArr []int) *OfflineAnalyzer {
+	return &OfflineAnalyzer{
+		path:  path,
+		portR: portArr,
+	}
+}
+
+// SetSource keeps only the probes the scanner at this address sent, the rest of the traffic still counts passively
+func (a *OfflineAnalyzer) SetSource(ip net.IP) {
+	a.source = ip
+}
+
+func (a *OfflineAnalyzer) Analyze() ([]*HostResult, error) {
+	handle, err := openCapture(a.path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening capture %s: %v\n", a.path, err)
+	}
+	defer handle.Close()
+
+	a.inv = newInventory(a.portR)
+	a.probes = make(map[string]*offlineProbe)
+	a.order = nil
+	a.flows = make(map[string]bool)
+
+	linkType := handle.LinkType()
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Error reading packet from %s: %v\n", a.path, err)
+		}
+		packet := gopacket.NewPacket(data, packetLinkType(linkType, ci), gopacket.Default)
+		packet.Metadata().CaptureInfo = ci
+		a.inv.observe(packet)
+		a.observe(packet)
+	}
+
+	a.finish()
+	return a.inv.results(), nil
+}
+
+// pcapgo reading a pcapng with more than one link type gives the one of the packet in the capture info
+func packetLinkType(linkType layers.LinkType, ci gopacket.CaptureInfo) layers.LinkType {
+	if len(ci.AncillaryData) > 0 {
+		if l, ok := ci.AncillaryData[0].(layers.LinkType); ok {
+			return l
+		}
+	}
+	return linkType
+}
+
+func probeKey(proto string, target net.IP, port int, source net.IP, srcPort int) string {
+	return fmt.Sprintf("%s %s:%d-%s:%d", proto, target, port, source, srcPort)
+}
+
+func (a *OfflineAnalyzer) observe(packet gopacket.Packet) {
+	ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return
+	}
+
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		a.observeICMP(ip4, icmp)
+		return
+	}
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		a.observeTCP(ip4, tcp)
+		return
+	}
+	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		a.observeUDP(ip4, udp)
+	}
+}
+
+func (a *OfflineAnalyzer) addProbe(key, kind string, ip4 *layers.IPv4, port int) {
+	if _, ok := a.probes[key]; ok {
+		return
+	}
+	if a.source != nil && !ip4.SrcIP.Equal(a.source) {
+		return
+	}
+	if !a.inv.wanted(port) {
+		return
+	}
+	p := &offlineProbe{
+		kind:   kind,
+		target: append(net.IP(nil), ip4.DstIP.To4()...),
+		port:   port,
+		source: append(net.IP(nil), ip4.SrcIP.To4()...),
+	}
+	a.probes[key] = p
+	a.order = append(a.order, p)
+}
+
+func (a *OfflineAnalyzer) observeTCP(ip4 *layers.IPv4, tcp *layers.TCP) {
+	sent := probeKey("tcp", ip4.DstIP, int(tcp.DstPort), ip4.SrcIP, int(tcp.SrcPort))
+	reply := probeKey("tcp", ip4.SrcIP, int(tcp.SrcPort), ip4.DstIP, int(tcp.DstPort))
+
+	if p, ok := a.probes[reply]; ok {
+		switch p.kind {
+		case "syn":
+			if state := synReplyState(tcp); state != "" && p.state == "" {
+				p.state = state
+				p.details = fmt.Sprintf("SYN from %s answered with %s", p.source, tcpFlags(tcp))
+			}
+		case "ack":
+			if state := ackReplyState(tcp); state != "" {
+				if p.state == "" {
+					p.state = string(state)
+					p.details = fmt.Sprintf("ACK from %s answered with RST", p.source)
+				}
+			} else {
+				// the ACK was part of a connection we saw from the middle, not a probe
+				delete(a.probes, reply)
+				p.kind = ""
+			}
+		}
+		return
+	}
+
+	bareACK := tcp.ACK && !tcp.SYN && !tcp.RST && !tcp.FIN && len(tcp.Payload) == 0
+	if !bareACK {
+		a.flows[sent] = true
+		a.flows[reply] = true
+	}
+
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		a.addProbe(sent, "syn", ip4, int(tcp.DstPort))
+	case bareACK && !a.flows[sent]:
+		// a bare ACK without a connection before it is what the ACK scanner sends
+		a.addProbe(sent, "ack", ip4, int(tcp.DstPort))
+	}
+}
+
+func (a *OfflineAnalyzer) observeUDP(ip4 *layers.IPv4, udp *layers.UDP) {
+	sent := probeKey("udp", ip4.DstIP, int(udp.DstPort), ip4.SrcIP, int(udp.SrcPort))
+	reply := probeKey("udp", ip4.SrcIP, int(udp.SrcPort), ip4.DstIP, int(udp.DstPort))
+
+	if p, ok := a.probes[reply]; ok {
+		if p.state == "" {
+			p.state = "open"
+			p.details = fmt.Sprintf("Response of %d bytes seen to %s", len(udp.Payload), p.source)
+			p.payload = append([]byte(nil), udp.Payload...)
+		}
+		return
+	}
+	// multicast and broadcast never answer from the address they were sent to
+	if ip4.DstIP.IsMulticast() || ip4.DstIP.Equal(net.IPv4bcast) {
+		return
+	}
+	a.addProbe(sent, "udp", ip4, int(udp.DstPort))
+}
+
+func (a *OfflineAnalyzer) observeICMP(ip4 *layers.IPv4, icmp *layers.ICMPv4) {
+	if len(icmp.Payload) < 20 {
+		return
+	}
+	inner := gopacket.NewPacket(icmp.Payload, layers.LayerTypeIPv4, gopacket.Default)
+	innerIP, ok := inner.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return
+	}
+	srcPort, port, ok := innerPorts(innerIP)
+	if !ok {
+		return
+	}
+	proto := "tcp"
+	if innerIP.Protocol == layers.IPProtocolUDP {
+		proto = "udp"
+	}
+
+	p, ok := a.probes[probeKey(proto, innerIP.DstIP, port, innerIP.SrcIP, srcPort)]
+	if !ok || p.state != "" {
+		return
+	}
+	state := icmpProbeState(icmp, innerIP.Protocol)
+	if state == "" {
+		return
+	}
+	if p.kind == "ack" {
+		state = string(AckFiltered)
+	}
+	p.state = state
+	p.details = fmt.Sprintf("ICMP %s from %s", icmp.TypeCode, ip4.SrcIP)
+}
+
+// puts the probes into the hosts, the answered ones first so a retry that got lost does not hide the answer
+func (a *OfflineAnalyzer) finish() {
+	a.inv.mu.Lock()
+	defer a.inv.mu.Unlock()
+
+	for _, answered := range []bool{true, false} {
+		for _, p := range a.order {
+			if p.kind == "" || (p.state != "") != answered {
+				continue
+			}
+			if !answered {
+				p.details = fmt.Sprintf("%s probe from %s got no answer", strings.ToUpper(p.kind), p.source)
+				switch p.kind {
+				case "syn":
+					p.state = synNoReply
+				case "ack":
+					p.state = string(ackNoReply)
+				case "udp":
+					p.state = udpNoReply
+				}
+			}
+			a.apply(p)
+		}
+	}
+}
+
+func (a *OfflineAnalyzer) apply(p *offlineProbe) {
+	h := a.inv.host(p.target)
+
+	if p.kind == "udp" {
+		if r, ok := h.UDP[p.port]; ok {
+			// the passive part already decoded the answer
+			if r.state == "" {
+				r.state = p.state
+			}
+			return
+		}
+		r := &UDPResult{port: p.port, state: p.state, details: p.details}
+		if p.payload != nil {
+			decodeUDPResponse(p.port, p.payload, r)
+		}
+		h.UDP[p.port] = r
+		return
+	}
+
+	r, ok := h.TCP[p.port]
+	if !ok {
+		h.TCP[p.port] = &TCPResult{port: p.port, state: p.state, details: p.details}
+		return
+	}
+	// an ACK probe to a port we already know from a SYN only tells about the firewall
+	if p.kind == "ack" && !strings.Contains(r.details, p.details) {
+		r.details = fmt.Sprintf("%s\nACK scan: %s (%s)", r.details, p.state, p.details)
+	}
+}
+
+func tcpFlags(tcp *layers.TCP) string {
+	var flags []string
+	for _, f := range []struct {
+		set  bool
+		name string
+	}{{tcp.SYN, "SYN"}, {tcp.ACK, "ACK"}, {tcp.RST, "RST"}, {tcp.FIN, "FIN"}} {
+		if f.set {
+			flags = append(flags, f.name)
+		}
+	}
+	return strings.Join(flags, "-")
+}
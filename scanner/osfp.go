@@ -0,0 +1,436 @@
+package portslibK
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+//go:embed os-fingerprints
+var osFingerprints string
+
+// TCPFingerprint is what the TCP/IP stack of the host showed in a single answer
+type TCPFingerprint struct {
+	Probe      string // syn for the scan SYN, options for the SYN with options and rst for the closed port
+	Port       int
+	TTL        uint8
+	InitialTTL int // the TTL rounded up to 32, 64, 128 or 255
+	Window     uint16
+	Options    string // order of the options, like M,S,T,N,W
+	MSS        int    // -1 when not there
+	WScale     int    // -1 when not there
+	Timestamps bool
+	DF         bool
+	RST        bool
+}
+
+// OSGuess is the best matching signature for a host
+type OSGuess struct {
+	Name         string
+	Class        string
+	Confidence   float64 // 0 to 1
+	Fingerprints []*TCPFingerprint
+}
+
+type osSignature struct {
+	name    string
+	class   string
+	ttl     int
+	windows []string
+	options string
+	mss     string
+	wscale  string
+	df      bool
+}
+
+// weights of the fields in the score
+const (
+	osWeightTTL     = 3
+	osWeightWindow  = 2
+	osWeightOptions = 3
+	osWeightWScale  = 2
+	osWeightMSS     = 1
+	osWeightDF      = 1
+)
+
+var (
+	osSignaturesOnce sync.Once
+	osSignatures     []osSignature
+)
+
+func defaultOSSignatures() []osSignature {
+	osSignaturesOnce.Do(func() {
+		osSignatures = parseOSSignatures(osFingerprints)
+	})
+	return osSignatures
+}
+
+func parseOSSignatures(data string) []osSignature {
+	var sigs []osSignature
+	sc := bufio.NewScanner(strings.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Split(line, "|")
+		if len(f) != 8 {
+			continue
+		}
+		for i := range f {
+			f[i] = strings.TrimSpace(f[i])
+		}
+		ttl, err := strconv.Atoi(f[2])
+		if err != nil {
+			continue
+		}
+		sigs = append(sigs, osSignature{
+			name:    f[0],
+			class:   f[1],
+			ttl:     ttl,
+			windows: strings.Split(strings.ReplaceAll(f[3], " ", ""), ","),
+			options: strings.ReplaceAll(f[4], " ", ""),
+			mss:     f[5],
+			wscale:  f[6],
+			df:      f[7] == "1",
+		})
+	}
+	return sigs
+}
+
+// FingerprintPacket takes the fingerprint from a SYN-ACK or RST, nil for other packets
+func FingerprintPacket(packet gopacket.Packet) *TCPFingerprint {
+	ipLayer, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return nil
+	}
+	tcpLayer, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || !(tcpLayer.SYN && tcpLayer.ACK) && !tcpLayer.RST {
+		return nil
+	}
+	// the RST of a closed port matches the rst signatures, not the ones of the SYN-ACK
+	probe := "syn"
+	if tcpLayer.RST {
+		probe = "rst"
+	}
+	return tcpFingerprint(ipLayer, tcpLayer, probe)
+}
+
+func tcpFingerprint(ip *layers.IPv4, tcp *layers.TCP, probe string) *TCPFingerprint {
+	fp := &TCPFingerprint{
+		Probe:      probe,
+		Port:       int(tcp.SrcPort),
+		TTL:        ip.TTL,
+		InitialTTL: initialTTL(ip.TTL),
+		Window:     tcp.Window,
+		MSS:        -1,
+		WScale:     -1,
+		DF:         ip.Flags&layers.IPv4DontFragment != 0,
+		RST:        tcp.RST,
+	}
+
+	var opts []string
+	for _, o := range tcp.Options {
+		switch o.OptionType {
+		case layers.TCPOptionKindMSS:
+			opts = append(opts, "M")
+			if len(o.OptionData) == 2 {
+				fp.MSS = int(o.OptionData[0])<<8 | int(o.OptionData[1])
+			}
+		case layers.TCPOptionKindNop:
+			opts = append(opts, "N")
+		case layers.TCPOptionKindWindowScale:
+			opts = append(opts, "W")
+			if len(o.OptionData) == 1 {
+				fp.WScale = int(o.OptionData[0])
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			opts = append(opts, "S")
+		case layers.TCPOptionKindTimestamps:
+			opts = append(opts, "T")
+			fp.Timestamps = true
+		case layers.TCPOptionKindEndList:
+			opts = append(opts, "E")
+		default:
+			opts = append(opts, "?"+strconv.Itoa(int(o.OptionType)))
+		}
+	}
+	// gopacket pads the options it decodes with end of list, only the one right after the others counts
+	for len(opts) > 1 && opts[len(opts)-1] == "E" && opts[len(opts)-2] == "E" {
+		opts = opts[:len(opts)-1]
+	}
+	fp.Options = strings.Join(opts, ",")
+	return fp
+}
+
+func initialTTL(ttl uint8) int {
+	for _, t := range []int{32, 64, 128} {
+		if int(ttl) <= t {
+			return t
+		}
+	}
+	return 255
+}
+
+// score and the maximum possible for the fields the probe can tell
+func (sig *osSignature) score(fp *TCPFingerprint) (int, int) {
+	score, max := 0, 0
+
+	max += osWeightTTL
+	if fp.InitialTTL == sig.ttl {
+		score += osWeightTTL
+	}
+	max += osWeightDF
+	if fp.DF == sig.df {
+		score += osWeightDF
+	}
+	// the RST only tells the TTL and DF
+	if fp.RST {
+		return score, max
+	}
+
+	max += osWeightWindow
+	if sig.windowMatch(fp) {
+		score += osWeightWindow
+	}
+
+	// the answer to a SYN without options only has the MSS
+	if fp.Probe == "options" {
+		max += osWeightOptions
+		if sig.options == "*" || sig.options == fp.Options {
+			score += osWeightOptions
+		}
+		max += osWeightWScale
+		if sig.wscale == "*" || sig.wscale == strconv.Itoa(fp.WScale) {
+			score += osWeightWScale
+		}
+	}
+	if sig.mss != "*" {
+		max += osWeightMSS
+		if sig.mss == strconv.Itoa(fp.MSS) {
+			score += osWeightMSS
+		}
+	}
+	return score, max
+}
+
+func (sig *osSignature) windowMatch(fp *TCPFingerprint) bool {
+	for _, w := range sig.windows {
+		switch {
+		case w == "*":
+			return true
+		case strings.HasPrefix(w, "mss*"):
+			n, err := strconv.Atoi(w[4:])
+			if err == nil && fp.MSS > 0 && int(fp.Window) == fp.MSS*n {
+				return true
+			}
+		default:
+			if w == strconv.Itoa(int(fp.Window)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// GuessOS matches all the fingerprints of a host together against the embedded signatures
+func GuessOS(fps []*TCPFingerprint) *OSGuess {
+	if len(fps) == 0 {
+		return nil
+	}
+
+	var best *OSGuess
+	for i := range defaultOSSignatures() {
+		sig := &osSignatures[i]
+		score, max := 0, 0
+		for _, fp := range fps {
+			s, m := sig.score(fp)
+			score += s
+			max += m
+		}
+		confidence := float64(score) / float64(max)
+		if best == nil || confidence > best.Confidence {
+			best = &OSGuess{Name: sig.name, Class: sig.class, Confidence: confidence}
+		}
+	}
+	best.Fingerprints = fps
+	return best
+}
+
+// the options the options probe sends, the same as linux does so the answers can be compared to the usual signatures
+func osProbeOptions() []layers.TCPOption {
+	ts := make([]byte, 8)
+	ts[0], ts[1], ts[2], ts[3] = 0, 0, 0, byte(rand.Intn(256))
+	return []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+		{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: ts},
+		{OptionType: layers.TCPOptionKindNop},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+	}
+}
+
+// sends a SYN with options to the port and returns the fingerprint of the answer, a closed port gives the RST one
+func (s *SynScanner) osProbe(port int, probe string) (*TCPFingerprint, error) {
+	handle, err := openPacketConn(s.ifi.Name, time.Millisecond*100)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	if err := handle.SetBPFFilter(fmt.Sprintf("tcp and src host %s and src port %d", s.targetIP.String(), port)); err != nil {
+		return nil, err
+	}
+
+	f, err := framingFor(handle.LinkType())
+	if err != nil {
+		return nil, err
+	}
+	mac, err := s.destMAC(f)
+	if err != nil {
+		return nil, err
+	}
+
+	srcPort := uint16(32768 + rand.Intn(28000))
+	ipLayer, tcpLayer := s.synLayers(srcPort)
+	tcpLayer.DstPort = layers.TCPPort(port)
+	tcpLayer.Seq = rand.Uint32()
+	tcpLayer.Window = 64240
+	tcpLayer.Options = osProbeOptions()
+	ipLayer.TTL = 64
+	ipLayer.Flags = layers.IPv4DontFragment
+	tcpLayer.SetNetworkLayerForChecksum(&ipLayer)
+
+	p, err := f.serialize(s.ifi.HardwareAddr, mac, s.options, &ipLayer, &tcpLayer)
+	if err != nil {
+		return nil, err
+	}
+	if err := handle.WritePacketData(p); err != nil {
+		return nil, err
+	}
+	s.packetTaps.sent(handle.LinkType(), p, fmt.Sprintf("OS %s probe to %s:%d from port %d", probe, s.targetIP, port, srcPort))
+
+	ip4 := &layers.IPv4{}
+	tcp := &layers.TCP{}
+	parser := f.parser(ip4, tcp)
+	decoded := []gopacket.LayerType{}
+
+	deadline := time.Now().Add(s.timeout)
+	for time.Now().Before(deadline) {
+		data, ci, err := handle.ReadPacketData()
+		if err != nil {
+			continue
+		}
+		if parser.DecodeLayers(data, &decoded); transportLayer(decoded) != layers.LayerTypeTCP {
+			s.packetTaps.ignored(handle.LinkType(), ci, data, fmt.Sprintf("not TCP, %s", decodedLayers(decoded)))
+			continue
+		}
+		if tcp.DstPort != layers.TCPPort(srcPort) || !ip4.SrcIP.Equal(s.targetIP) {
+			s.packetTaps.ignored(handle.LinkType(), ci, data, "not an answer to the OS probe")
+			continue
+		}
+		s.packetTaps.received(handle.LinkType(), ci, data, fmt.Sprintf("Reply to the OS %s probe to %s:%d", probe, s.targetIP, port))
+		if tcp.SYN && tcp.ACK {
+			// don't leave the connection half open on the target
+			s.sendRST(handle, f, mac, srcPort, port, tcp.Ack)
+		}
+		return tcpFingerprint(ip4, tcp, probe), nil
+	}
+	return nil, fmt.Errorf("No answer to the OS probe on port %d", port)
+}
+
+func (s *SynScanner) sendRST(handle PacketConn, f linkFraming, mac net.HardwareAddr, srcPort uint16, port int, seq uint32) {
+	ipLayer, tcpLayer := s.synLayers(srcPort)
+	tcpLayer.DstPort = layers.TCPPort(port)
+	tcpLayer.SYN = false
+	tcpLayer.RST = true
+	tcpLayer.Seq = seq
+	tcpLayer.SetNetworkLayerForChecksum(&ipLayer)
+
+	if p, err := f.serialize(s.ifi.HardwareAddr, mac, s.options, &ipLayer, &tcpLayer); err == nil {
+		if handle.WritePacketData(p) == nil {
+			s.packetTaps.sent(handle.LinkType(), p, fmt.Sprintf("RST to close the OS probe to %s:%d", s.targetIP, port))
+		}
+	}
+}
+
+// EnableOSDetection keeps the fingerprints of the SYN-ACKs, with extraProbes it also sends a SYN with options to the
+// first open port and one to a closed port
+func (s *SynScanner) EnableOSDetection(extraProbes bool) {
+	s.osDetect = true
+	s.osProbes = extraProbes
+}
+
+func (s *SynScanner) addFingerprint(fp *TCPFingerprint) {
+	s.fpMu.Lock()
+	defer s.fpMu.Unlock()
+	s.fingerprints = append(s.fingerprints, fp)
+}
+
+// OSGuess matches everything the scan collected so far, nil if there is nothing to match
+func (s *SynScanner) OSGuess() *OSGuess {
+	s.fpMu.Lock()
+	fps := append([]*TCPFingerprint(nil), s.fingerprints...)
+	s.fpMu.Unlock()
+	return GuessOS(fps)
+}
+
+// the extra probes after the scan, the open port is one the scan found and the closed one a random high port
+func (s *SynScanner) runOSProbes() {
+	var openPorts []int
+	s.fpMu.Lock()
+	for _, fp := range s.fingerprints {
+		if !fp.RST {
+			openPorts = append(openPorts, fp.Port)
+		}
+	}
+	s.fpMu.Unlock()
+
+	if len(openPorts) > 0 {
+		sort.Ints(openPorts)
+		if fp, err := s.osProbe(openPorts[0], "options"); err == nil {
+			s.addFingerprint(fp)
+		}
+	}
+	closed := 40000 + rand.Intn(20000)
+	for _, p := range s.portR {
+		if p == closed {
+			return
+		}
+	}
+	if fp, err := s.osProbe(closed, "rst"); err == nil && fp.RST {
+		s.addFingerprint(fp)
+	}
+}
+
+func (fp *TCPFingerprint) String() string {
+	s := fmt.Sprintf("%s: ttl %d (%d), window %d, df %t", fp.Probe, fp.TTL, fp.InitialTTL, fp.Window, fp.DF)
+	if fp.Options != "" {
+		s += fmt.Sprintf(", options %s", fp.Options)
+	}
+	if fp.MSS >= 0 {
+		s += fmt.Sprintf(", mss %d", fp.MSS)
+	}
+	if fp.WScale >= 0 {
+		s += fmt.Sprintf(", wscale %d", fp.WScale)
+	}
+	return s
+}
+
+func (g *OSGuess) String() string {
+	s := fmt.Sprintf("%s (%s), %.0f%% confidence", g.Name, g.Class, g.Confidence*100)
+	for _, fp := range g.Fingerprints {
+		s += "\n  " + fp.String()
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package portslibK
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PacketConn is what the raw scanners send and read frames through, a pcap handle, an AF_PACKET socket or the virtual network
+type PacketConn interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	WritePacketData(data []byte) error
+	SetBPFFilter(filter string) error
+	LinkType() layers.LinkType
+	Close()
+}
+
+// PacketOpener opens a PacketConn on the interface, ReadPacketData gives up after the timeout with ErrPacketTimeout
+// and blocks until a packet comes when it is 0
+type PacketOpener func(ifName string, timeout time.Duration) (PacketConn, error)
+
+// ErrPacketTimeout is returned by ReadPacketData when no packet came in the read timeout
+var ErrPacketTimeout = errors.New("Timeout reading packet")
+
+// the functions the scanners reach the network with, the virtual network swaps them
+var (
+	openPacketConn PacketOpener = openDefaultPacketConn
+	routeSource                 = GetSource
+	dialUDP                     = net.DialTimeout
+)
+
+// the backends in this build by name, pcap unless built with the nopcap tag and afpacket on linux
+var packetBackends = make(map[string]PacketOpener)
+
+// SetPacketOpener changes how all the raw scanners open the interface, nil goes back to the default backend
+func SetPacketOpener(o PacketOpener) {
+	if o == nil {
+		o = openDefaultPacketConn
+	}
+	openPacketConn = o
+}
+
+// SetPacketBackend picks one of PacketBackends for all the raw scanners, like "afpacket" to scan without libpcap
+func SetPacketBackend(name string) error {
+	o, ok := packetBackends[name]
+	if !ok {
+		return fmt.Errorf("Error: no packet backend %q in this build, there is %s", name, strings.Join(PacketBackends(), ", "))
+	}
+	openPacketConn = o
+	return nil
+}
+
+// PacketBackends lists the backends this build has
+func PacketBackends() []string {
+	names := make([]string, 0, len(packetBackends))
+	for name := range packetBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func openDefaultPacketConn(ifName string, timeout time.Duration) (PacketConn, error) {
+	o, ok := packetBackends[defaultPacketBackend]
+	if !ok {
+		return nil, fmt.Errorf("Error: the default packet backend %q is not in this build", defaultPacketBackend)
+	}
+	return o(ifName, timeout)
+}
@@ -0,0 +1,66 @@
+//go:build nopcap
+
+package portslibK
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// without libpcap the raw scanners use AF_PACKET, there is no backend outside of linux then
+const defaultPacketBackend = "afpacket"
+
+// a pcapgo reader and the file under it
+type fileCapture struct {
+	reader interface {
+		ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+		LinkType() layers.LinkType
+	}
+	f *os.File
+}
+
+func (c fileCapture) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	return c.reader.ReadPacketData()
+}
+
+func (c fileCapture) LinkType() layers.LinkType {
+	return c.reader.LinkType()
+}
+
+func (c fileCapture) Close() {
+	c.f.Close()
+}
+
+// pcapgo reads the capture for the offline analysis, both the pcap and the pcapng files
+func openCapture(path string) (captureReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	magic, err := r.Peek(4)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	c := fileCapture{f: f}
+	if binary.LittleEndian.Uint32(magic) == pcapngSectionHeader {
+		// a recording can have an interface per link type, the default options skip the packets of all but the first
+		opts := pcapgo.DefaultNgReaderOptions
+		opts.WantMixedLinkType = true
+		c.reader, err = pcapgo.NewNgReader(r, opts)
+	} else {
+		c.reader, err = pcapgo.NewReader(r)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,45 @@
+//go:build !nopcap
+
+package portslibK
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// libpcap is the default, building with the nopcap tag leaves it out and uses AF_PACKET
+const defaultPacketBackend = "pcap"
+
+func init() {
+	packetBackends["pcap"] = openPcap
+}
+
+type pcapConn struct {
+	*pcap.Handle
+}
+
+func openPcap(ifName string, timeout time.Duration) (PacketConn, error) {
+	if timeout <= 0 {
+		timeout = pcap.BlockForever
+	}
+	handle, err := pcap.OpenLive(ifName, 65535, true, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return pcapConn{handle}, nil
+}
+
+func (c pcapConn) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := c.Handle.ReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		err = ErrPacketTimeout
+	}
+	return data, ci, err
+}
+
+// the capture for the offline analysis
+func openCapture(path string) (captureReader, error) {
+	return pcap.OpenOffline(path)
+}
@@ -0,0 +1,622 @@
+package portslibK
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// HostResult is everything found out about a single host, by the passive and offline modes
+type HostResult struct {
+	IP        net.IP
+	MAC       net.HardwareAddr
+	Hostnames []string
+	TCP       map[int]*TCPResult
+	UDP       map[int]*UDPResult
+	OS        *OSGuess
+
+	fingerprints []*TCPFingerprint
+}
+
+// PassiveScanner only listens on the interface and builds the hosts and ports from what it sees, it never sends anything
+type PassiveScanner struct {
+	ifi      *net.Interface
+	duration time.Duration // how long to listen, until Stop when 0
+	filter   string
+	portR    []int
+	inv      *inventory
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// a connection seen from its SYN, the server is the side that got the SYN
+type passiveConn struct {
+	clientSpoke bool // the client sent data before the server did
+	synAck      bool
+	bannerDone  bool
+}
+
+// the hosts and ports put together from the packets, fed by the passive listener and the offline analysis
+type inventory struct {
+	mu        sync.Mutex
+	hosts     map[string]*HostResult
+	conns     map[string]*passiveConn
+	ports     map[int]bool // only these ports are kept, all of them when empty
+	dhcpNames map[string]string
+	db        *ServiceDB
+}
+
+// a busy network would grow the connections forever, half of them never end in a FIN we see
+const maxPassiveConns = 65536
+
+// how much of the first server data is kept as the banner
+const passiveBannerSize = 1024
+
+// NewPassiveScanner listens on the interface the target IP is routed through, the target itself is not contacted
+func NewPassiveScanner(duration time.Duration, targetIP net.IP, portArr []int) (*PassiveScanner, error) {
+	_, ifi, err := routeSource(targetIP)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating new passive scanner: %v\n", err)
+	}
+	return &PassiveScanner{
+		ifi:      ifi,
+		duration: duration,
+		portR:    portArr,
+		inv:      newInventory(portArr),
+		stop:     make(chan struct{}),
+	}, nil
+}
+
+// SetFilter sets a BPF filter for the capture, like "net 10.0.0.0/24"
+func (s *PassiveScanner) SetFilter(filter string) {
+	s.filter = filter
+}
+
+// Listen captures until the duration passes or Stop is called
+func (s *PassiveScanner) Listen() error {
+	// a short read timeout so the stop and the duration are checked even on a quiet network
+	handle, err := openPacketConn(s.ifi.Name, time.Millisecond*100)
+	if err != nil {
+		return fmt.Errorf("Error opening %s for the passive scan: %v\n", s.ifi.Name, err)
+	}
+	defer handle.Close()
+
+	if s.filter != "" {
+		if err := handle.SetBPFFilter(s.filter); err != nil {
+			return fmt.Errorf("Error setting the BPF filter %q: %v\n", s.filter, err)
+		}
+	}
+
+	var deadline <-chan time.Time
+	if s.duration > 0 {
+		deadline = time.After(s.duration)
+	}
+	linkType := handle.LinkType()
+
+	for {
+		select {
+		case <-s.stop:
+			return nil
+		case <-deadline:
+			return nil
+		default:
+		}
+
+		data, ci, err := handle.ReadPacketData()
+		if err == ErrPacketTimeout {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Error reading packet data: %v\n", err)
+		}
+		packet := gopacket.NewPacket(data, linkType, gopacket.Default)
+		packet.Metadata().CaptureInfo = ci
+		s.inv.observe(packet)
+	}
+}
+
+func (s *PassiveScanner) Start() error {
+	log.Printf("Starting passive scan on %s, nothing is sent\n", s.ifi.Name)
+	if err := s.Listen(); err != nil {
+		return err
+	}
+
+	hosts := s.Hosts()
+	fmt.Printf("Seen %d hosts\n", len(hosts))
+	for _, h := range hosts {
+		fmt.Println(h.MakeReport())
+	}
+	return nil
+}
+
+// Scan reports what was seen for the port on every host so far, it doesn't capture anything itself
+func (s *PassiveScanner) Scan(port int) (string, error) {
+	var report string
+	for _, h := range s.Hosts() {
+		if r, ok := h.TCP[port]; ok {
+			report += fmt.Sprintf("%s TCP %s\n", h.IP, strings.TrimPrefix(r.MakeReport(), "\n"))
+		}
+		if r, ok := h.UDP[port]; ok {
+			report += fmt.Sprintf("%s UDP %s\n", h.IP, strings.TrimPrefix(r.MakeReport(), "\n"))
+		}
+	}
+	if report == "" {
+		return fmt.Sprintf("Port %d not seen on any host\n", port), nil
+	}
+	return report, nil
+}
+
+// Hosts returns copies of the hosts seen so far, sorted by their IP, they don't change while the scan goes on
+func (s *PassiveScanner) Hosts() []*HostResult {
+	return s.inv.results()
+}
+
+func (s *PassiveScanner) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	log.Printf("Stopping passive scan on %s\n", s.ifi.Name)
+}
+
+func newInventory(portArr []int) *inventory {
+	inv := &inventory{
+		hosts:     make(map[string]*HostResult),
+		conns:     make(map[string]*passiveConn),
+		ports:     make(map[int]bool),
+		dhcpNames: make(map[string]string),
+		db:        DefaultServiceDB(),
+	}
+	for _, p := range portArr {
+		inv.ports[p] = true
+	}
+	return inv
+}
+
+func (inv *inventory) wanted(port int) bool {
+	return len(inv.ports) == 0 || inv.ports[port]
+}
+
+// the host is made when there's the first proof it exists, not for every address in the traffic
+func (inv *inventory) host(ip net.IP) *HostResult {
+	ip = ip.To4()
+	h, ok := inv.hosts[ip.String()]
+	if !ok {
+		h = &HostResult{
+			IP:  ip,
+			TCP: make(map[int]*TCPResult),
+			UDP: make(map[int]*UDPResult),
+		}
+		inv.hosts[ip.String()] = h
+	}
+	return h
+}
+
+func (inv *inventory) observe(packet gopacket.Packet) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		inv.observeARP(arp)
+		return
+	}
+	ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return
+	}
+
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		inv.observeTCP(ip4, tcp)
+	}
+	if dhcp, ok := packet.Layer(layers.LayerTypeDHCPv4).(*layers.DHCPv4); ok {
+		inv.observeDHCP(ip4, dhcp)
+	} else if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		inv.observeUDP(ip4, udp)
+	}
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		inv.observeICMP(ip4, icmp)
+	}
+}
+
+func (inv *inventory) observeARP(arp *layers.ARP) {
+	ip := net.IP(arp.SourceProtAddress)
+	// ARP probes come from 0.0.0.0 while the host does not have an address yet
+	if len(ip) != 4 || ip.IsUnspecified() {
+		return
+	}
+	h := inv.host(ip)
+	h.MAC = append(net.HardwareAddr(nil), arp.SourceHwAddress...)
+	if name, ok := inv.dhcpNames[h.MAC.String()]; ok {
+		h.addHostname(name)
+	}
+}
+
+func connKey(server net.IP, serverPort layers.TCPPort, client net.IP, clientPort layers.TCPPort) string {
+	return fmt.Sprintf("%s:%d-%s:%d", server, serverPort, client, clientPort)
+}
+
+func (inv *inventory) observeTCP(ip4 *layers.IPv4, tcp *layers.TCP) {
+	fromServer := connKey(ip4.SrcIP, tcp.SrcPort, ip4.DstIP, tcp.DstPort)
+	fromClient := connKey(ip4.DstIP, tcp.DstPort, ip4.SrcIP, tcp.SrcPort)
+
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		if len(inv.conns) >= maxPassiveConns {
+			inv.conns = make(map[string]*passiveConn)
+		}
+		inv.conns[fromClient] = &passiveConn{}
+		return
+
+	case tcp.SYN && tcp.ACK:
+		port := int(tcp.SrcPort)
+		if c, ok := inv.conns[fromServer]; ok {
+			c.synAck = true
+		}
+		h := inv.host(ip4.SrcIP)
+		// the answer to a SYN with options shows the option order of the stack, one without only the MSS
+		probe := "syn"
+		if len(tcp.Options) > 1 {
+			probe = "options"
+		}
+		if len(h.fingerprints) < 16 {
+			h.fingerprints = append(h.fingerprints, tcpFingerprint(ip4, tcp, probe))
+		}
+		if !inv.wanted(port) {
+			return
+		}
+		r, ok := h.TCP[port]
+		if !ok {
+			r = &TCPResult{port: port}
+			h.TCP[port] = r
+		}
+		r.state = synReplyState(tcp)
+		r.details = fmt.Sprintf("SYN-ACK seen to %s", ip4.DstIP)
+		return
+
+	case tcp.RST:
+		if c, ok := inv.conns[fromServer]; ok {
+			delete(inv.conns, fromServer)
+			port := int(tcp.SrcPort)
+			if c.synAck || !inv.wanted(port) {
+				return
+			}
+			// the SYN got a reset right away
+			h := inv.host(ip4.SrcIP)
+			if _, ok := h.TCP[port]; !ok {
+				h.TCP[port] = &TCPResult{port: port, state: synReplyState(tcp), details: fmt.Sprintf("RST seen to %s", ip4.DstIP)}
+			}
+			if len(h.fingerprints) < 16 {
+				h.fingerprints = append(h.fingerprints, tcpFingerprint(ip4, tcp, "rst"))
+			}
+		}
+		delete(inv.conns, fromClient)
+		return
+	}
+
+	if len(tcp.Payload) > 0 {
+		if c, ok := inv.conns[fromClient]; ok && c.synAck {
+			c.clientSpoke = true
+		} else if c, ok := inv.conns[fromServer]; ok && c.synAck && !c.bannerDone {
+			c.bannerDone = true
+			inv.observeBanner(ip4.SrcIP, int(tcp.SrcPort), tcp.Payload, !c.clientSpoke)
+		}
+	}
+	if tcp.FIN {
+		delete(inv.conns, fromServer)
+		delete(inv.conns, fromClient)
+	}
+}
+
+// the first data the server sent, matched like the NULL probe when it talked first and like the GET one otherwise
+func (inv *inventory) observeBanner(ip net.IP, port int, payload []byte, serverFirst bool) {
+	if !inv.wanted(port) {
+		return
+	}
+	r, ok := inv.host(ip).TCP[port]
+	if !ok || r.banner != "" {
+		return
+	}
+	if len(payload) > passiveBannerSize {
+		payload = payload[:passiveBannerSize]
+	}
+	r.banner = string(payload)
+	r.bannerRead = serverFirst
+
+	probe := inv.db.byName["NULL"]
+	if !serverFirst {
+		if get, ok := inv.db.byName["GetRequest"]; ok {
+			probe = get
+		}
+	}
+	if probe == nil {
+		return
+	}
+	if info := inv.db.match(probe, payload); info != nil {
+		r.service = info
+	}
+}
+
+func (inv *inventory) observeUDP(ip4 *layers.IPv4, udp *layers.UDP) {
+	port := int(udp.SrcPort)
+	if len(udp.Payload) == 0 {
+		return
+	}
+	if port == 5353 || udp.DstPort == 5353 {
+		inv.observeMDNS(ip4, udp.Payload)
+		return
+	}
+	// only the ports we can decode, anything else could be a client port
+	if _, ok := udpDecoders[port]; !ok || !inv.wanted(port) {
+		return
+	}
+	// a DNS query sent from port 53 is still a query
+	if port == 53 && (len(udp.Payload) < 3 || udp.Payload[2]&0x80 == 0) {
+		return
+	}
+
+	r := &UDPResult{port: port, state: "open", details: fmt.Sprintf("Response of %d bytes seen to %s", len(udp.Payload), ip4.DstIP)}
+	decodeUDPResponse(port, udp.Payload, r)
+	if r.service == "" {
+		// the decoder did not like it, probably not the service we think
+		return
+	}
+	h := inv.host(ip4.SrcIP)
+	if old, ok := h.UDP[port]; ok && len(old.info) > len(r.info) {
+		return
+	}
+	h.UDP[port] = r
+}
+
+// mDNS answers name the host that sends them and the services it has
+func (inv *inventory) observeMDNS(ip4 *layers.IPv4, payload []byte) {
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(payload, gopacket.NilDecodeFeedback); err != nil || !dns.QR {
+		return
+	}
+
+	var services []string
+	for _, a := range append(dns.Answers, dns.Additionals...) {
+		switch a.Type {
+		case layers.DNSTypeA:
+			if a.IP.To4() == nil {
+				continue
+			}
+			inv.host(a.IP).addHostname(string(a.Name))
+		case layers.DNSTypePTR:
+			if strings.HasPrefix(string(a.Name), "_") {
+				services = append(services, string(a.PTR))
+			}
+		}
+	}
+
+	if !inv.wanted(5353) {
+		return
+	}
+	h := inv.host(ip4.SrcIP)
+	r, ok := h.UDP[5353]
+	if !ok {
+		r = &UDPResult{port: 5353, state: "open", service: "mdns", info: make(map[string]string)}
+		h.UDP[5353] = r
+	}
+	r.details = fmt.Sprintf("Response seen to %s", ip4.DstIP)
+	if len(services) > 0 {
+		r.info["services"] = mergeList(r.info["services"], services)
+	}
+}
+
+// DHCP tells the MAC and the hostname of the client and which host is the server
+func (inv *inventory) observeDHCP(ip4 *layers.IPv4, dhcp *layers.DHCPv4) {
+	var msgType layers.DHCPMsgType
+	var hostname string
+	var requested, serverID net.IP
+	for _, o := range dhcp.Options {
+		switch o.Type {
+		case layers.DHCPOptMessageType:
+			if len(o.Data) == 1 {
+				msgType = layers.DHCPMsgType(o.Data[0])
+			}
+		case layers.DHCPOptHostname:
+			hostname = string(o.Data)
+		case layers.DHCPOptRequestIP:
+			if len(o.Data) == 4 {
+				requested = net.IP(o.Data)
+			}
+		case layers.DHCPOptServerID:
+			if len(o.Data) == 4 {
+				serverID = net.IP(o.Data)
+			}
+		}
+	}
+
+	mac := dhcp.ClientHWAddr.String()
+	if hostname != "" {
+		inv.dhcpNames[mac] = hostname
+	}
+
+	// the address the client has or is getting
+	var clientIP net.IP
+	switch {
+	case dhcp.Operation == layers.DHCPOpReply && msgType == layers.DHCPMsgTypeAck:
+		clientIP = dhcp.YourClientIP
+	case dhcp.ClientIP != nil:
+		clientIP = dhcp.ClientIP
+	}
+	if clientIP.To4() != nil && !clientIP.IsUnspecified() {
+		h := inv.host(clientIP)
+		h.MAC = append(net.HardwareAddr(nil), dhcp.ClientHWAddr...)
+		if name, ok := inv.dhcpNames[mac]; ok {
+			h.addHostname(name)
+		}
+	}
+
+	if dhcp.Operation != layers.DHCPOpReply || !inv.wanted(67) || ip4.SrcIP.IsUnspecified() {
+		return
+	}
+	h := inv.host(ip4.SrcIP)
+	r := &UDPResult{port: 67, state: "open", service: "dhcps", info: make(map[string]string)}
+	r.details = fmt.Sprintf("%s seen to %s", msgType, dhcp.ClientHWAddr)
+	if serverID != nil {
+		r.info["server id"] = serverID.String()
+	}
+	if requested != nil {
+		r.info["requested"] = requested.String()
+	}
+	if dhcp.YourClientIP.To4() != nil && !dhcp.YourClientIP.IsUnspecified() {
+		r.info["offered"] = dhcp.YourClientIP.String()
+	}
+	h.UDP[67] = r
+}
+
+// unreachables carry the header of the packet they are about, that tells the port
+func (inv *inventory) observeICMP(ip4 *layers.IPv4, icmp *layers.ICMPv4) {
+	if icmp.TypeCode.Type() != layers.ICMPv4TypeDestinationUnreachable || len(icmp.Payload) < 20 {
+		return
+	}
+	inner := gopacket.NewPacket(icmp.Payload, layers.LayerTypeIPv4, gopacket.Default)
+	innerIP, ok := inner.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return
+	}
+
+	state := icmpProbeState(icmp, innerIP.Protocol)
+	if state == "" {
+		return
+	}
+	details := fmt.Sprintf("ICMP %s from %s", icmp.TypeCode, ip4.SrcIP)
+
+	_, port, ok := innerPorts(innerIP)
+	if !ok || !inv.wanted(port) {
+		return
+	}
+	h := inv.host(innerIP.DstIP)
+	switch innerIP.Protocol {
+	case layers.IPProtocolUDP:
+		if _, ok := h.UDP[port]; !ok {
+			h.UDP[port] = &UDPResult{port: port, state: state, details: details}
+		}
+	case layers.IPProtocolTCP:
+		if _, ok := h.TCP[port]; !ok {
+			h.TCP[port] = &TCPResult{port: port, state: state, details: details}
+		}
+	}
+}
+
+// the ICMP only has the first 8 bytes after the IP header so gopacket refuses the TCP one, the ports are the first 4
+func innerPorts(ip *layers.IPv4) (int, int, bool) {
+	if (ip.Protocol != layers.IPProtocolTCP && ip.Protocol != layers.IPProtocolUDP) || len(ip.Payload) < 4 {
+		return 0, 0, false
+	}
+	return int(ip.Payload[0])<<8 | int(ip.Payload[1]), int(ip.Payload[2])<<8 | int(ip.Payload[3]), true
+}
+
+// the hosts sorted by IP, with the OS guessed from what was collected
+func (inv *inventory) results() []*HostResult {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+
+	hosts := make([]*HostResult, 0, len(inv.hosts))
+	for _, h := range inv.hosts {
+		h.OS = GuessOS(h.fingerprints)
+		hosts = append(hosts, h.clone())
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return bytes.Compare(hosts[i].IP, hosts[j].IP) < 0
+	})
+	return hosts
+}
+
+// copies are handed out, the capture keeps changing the hosts of the inventory while the caller reads them
+func (h *HostResult) clone() *HostResult {
+	c := *h
+	c.IP = append(net.IP(nil), h.IP...)
+	c.MAC = append(net.HardwareAddr(nil), h.MAC...)
+	c.Hostnames = append([]string(nil), h.Hostnames...)
+	c.fingerprints = append([]*TCPFingerprint(nil), h.fingerprints...)
+
+	c.TCP = make(map[int]*TCPResult, len(h.TCP))
+	for p, r := range h.TCP {
+		rc := *r
+		c.TCP[p] = &rc
+	}
+	c.UDP = make(map[int]*UDPResult, len(h.UDP))
+	for p, r := range h.UDP {
+		rc := *r
+		if r.info != nil {
+			rc.info = make(map[string]string, len(r.info))
+			for k, v := range r.info {
+				rc.info[k] = v
+			}
+		}
+		c.UDP[p] = &rc
+	}
+	return &c
+}
+
+func (h *HostResult) addHostname(name string) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return
+	}
+	for _, n := range h.Hostnames {
+		if strings.EqualFold(n, name) {
+			return
+		}
+	}
+	h.Hostnames = append(h.Hostnames, name)
+}
+
+func mergeList(list string, items []string) string {
+	var all []string
+	if list != "" {
+		all = strings.Split(list, ", ")
+	}
+	for _, i := range items {
+		found := false
+		for _, a := range all {
+			if a == i {
+				found = true
+				break
+			}
+		}
+		if !found {
+			all = append(all, i)
+		}
+	}
+	return strings.Join(all, ", ")
+}
+
+func (h *HostResult) MakeReport() string {
+	report := fmt.Sprintf("\nHost %s", h.IP)
+	if h.MAC != nil {
+		report = fmt.Sprintf("%s (%s)", report, h.MAC)
+	}
+	if len(h.Hostnames) > 0 {
+		report = fmt.Sprintf("%s\nHostnames: %s", report, strings.Join(h.Hostnames, ", "))
+	}
+	if h.OS != nil {
+		report = fmt.Sprintf("%s\nOS: %s", report, h.OS)
+	}
+
+	ports := make([]int, 0, len(h.TCP))
+	for p := range h.TCP {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	for _, p := range ports {
+		report = fmt.Sprintf("%s\nTCP %s", report, strings.TrimPrefix(h.TCP[p].MakeReport(), "\n"))
+	}
+
+	ports = ports[:0]
+	for p := range h.UDP {
+		ports = append(ports, p)
+	}
+	sort.Ints(ports)
+	for _, p := range ports {
+		report = fmt.Sprintf("%s\nUDP %s", report, strings.TrimPrefix(h.UDP[p].MakeReport(), "\n"))
+	}
+	return report
+}
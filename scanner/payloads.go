@@ -0,0 +1,125 @@
+package portslibK
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PayloadFunc crafts the payload for a single probe, so it can differ per target (random DNS ids and so on)
+type PayloadFunc func(targetIP net.IP, port int) []byte
+
+// PayloadRegistry holds the UDP payloads sent to specific ports
+// it is safe to use from multiple goroutines and when a port is not registered it falls back to its parent (if any)
+type PayloadRegistry struct {
+	mu       sync.RWMutex
+	payloads map[int]PayloadFunc
+	parent   *PayloadRegistry
+}
+
+// DefaultPayloads are the popular UDP payloads every scanner falls back to
+var DefaultPayloads = defaultPayloads()
+
+func NewPayloadRegistry(parent *PayloadRegistry) *PayloadRegistry {
+	return &PayloadRegistry{
+		payloads: make(map[int]PayloadFunc),
+		parent:   parent,
+	}
+}
+
+func defaultPayloads() *PayloadRegistry {
+	r := NewPayloadRegistry(nil)
+	r.RegisterFunc(53, dnsVersionPayload)                                            // DNS version.bind query with a random id
+	r.Register(123, append([]byte{0x1b}, make([]byte, 47)...))                       // NTP v3 client request
+	r.RegisterFunc(137, netbiosStatusPayload)                                        // NetBIOS NBSTAT query for all the names
+	r.RegisterFunc(161, snmpPayload)                                                 // SNMP v1 get request for the system group with community public
+	r.RegisterFunc(443, quicInitial)                                                 // QUIC Initial with a grease version to get a version negotiation
+	r.Register(1900, []byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\n"+ // SSDP discovery
+		"MAN: \"ssdp:discover\"\r\nMX: 1\r\nST: ssdp:all\r\n\r\n"))
+	r.Register(5683, []byte("\x50\x01\x70\x6b\xbb.well-known\x04core"))      // CoAP NON GET /.well-known/core
+	r.Register(11211, []byte("\x00\x01\x00\x00\x00\x01\x00\x00version\r\n")) // memcached version with the UDP frame header
+	r.Register(47808, []byte("\x81\x0a\x00\x08\x01\x00\x10\x08"))            // BACnet/IP Who-Is
+	return r
+}
+
+// Register sets a static payload for the port
+func (r *PayloadRegistry) Register(port int, payload []byte) {
+	p := append([]byte(nil), payload...)
+	r.RegisterFunc(port, func(net.IP, int) []byte {
+		return p
+	})
+}
+
+// RegisterFunc sets a payload generator for the port, it is called for every probe sent
+func (r *PayloadRegistry) RegisterFunc(port int, f PayloadFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payloads[port] = f
+}
+
+// Remove deletes the payload for the port from this registry (the parent is left alone)
+func (r *PayloadRegistry) Remove(port int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.payloads, port)
+}
+
+// Fetch returns the payload to send to the target port, empty if there is none registered
+func (r *PayloadRegistry) Fetch(targetIP net.IP, port int) []byte {
+	for reg := r; reg != nil; reg = reg.parent {
+		reg.mu.RLock()
+		f, ok := reg.payloads[port]
+		reg.mu.RUnlock()
+		if ok {
+			return f(targetIP, port)
+		}
+	}
+	// default to empty payload if there's no predefined one
+	return []byte{}
+}
+
+// UpdatePayload allows adding or updating a default payload for a specific port
+func UpdatePayload(port int, payload []byte) {
+	DefaultPayloads.Register(port, payload)
+}
+
+// builds a chaos class TXT query for version.bind, most of the DNS servers answer that one with something
+func dnsVersionPayload(targetIP net.IP, port int) []byte {
+	return dnsQuery(uint16(rand.Intn(0x10000)), "version.bind", layers.DNSTypeTXT, layers.DNSClassCH, false)
+}
+
+// v1 so the old agents answer too, the request id is random for every probe
+func snmpPayload(targetIP net.IP, port int) []byte {
+	return snmpGet(snmpV1, "public", rand.Int31(), snmpSystemOIDs)
+}
+
+// NBSTAT query for the wildcard name "*", the id is random for every probe
+func netbiosStatusPayload(targetIP net.IP, port int) []byte {
+	p := []byte{byte(rand.Intn(0x100)), byte(rand.Intn(0x100)), 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x20}
+	// "*" padded with nulls to 16 bytes in the first level encoding is CK followed by 30 A's
+	p = append(p, []byte("CK"+strings.Repeat("A", 30))...)
+	return append(p, 0x00, 0x00, 0x21, 0x00, 0x01)
+}
+
+func dnsQuery(id uint16, name string, qType layers.DNSType, qClass layers.DNSClass, recursion bool) []byte {
+	dns := layers.DNS{
+		ID:     id,
+		OpCode: layers.DNSOpCodeQuery,
+		RD:     recursion,
+		Questions: []layers.DNSQuestion{{
+			Name:  []byte(name),
+			Type:  qType,
+			Class: qClass,
+		}},
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		return []byte{}
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,160 @@
+package portslibK
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// PcapngRecorder writes the packets a scan sent and the answers it matched into a pcapng file, each with a comment
+// naming the probe. pcapgo can't put comments on packets so the blocks are written here
+type PcapngRecorder struct {
+	mu         sync.Mutex
+	w          *bufio.Writer
+	c          io.Closer
+	interfaces map[layers.LinkType]uint32 // an interface block per link type
+	err        error
+}
+
+// block types and options of pcapng, the timestamps are in microseconds as the interfaces don't say else
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+	pcapngOptEnd         = 0
+	pcapngOptComment     = 1
+	pcapngOptUserAppl    = 4
+	pcapngSnapLen        = 65535
+)
+
+// CreatePcapng creates (or truncates) the file and writes the section header into it
+func CreatePcapng(path string) (*PcapngRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating pcapng file: %v", err)
+	}
+	r, err := NewPcapngRecorder(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.c = f
+	return r, nil
+}
+
+// NewPcapngRecorder writes into w, closing the recorder does not close w
+func NewPcapngRecorder(w io.Writer) (*PcapngRecorder, error) {
+	r := &PcapngRecorder{
+		w:          bufio.NewWriter(w),
+		interfaces: make(map[layers.LinkType]uint32),
+	}
+
+	body := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // version 1.0
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint64(body, 0xffffffffffffffff) // section length is not known
+	body = pcapngOption(body, pcapngOptUserAppl, []byte("portslibK"))
+	body = pcapngOption(body, pcapngOptEnd, nil)
+
+	if err := r.writeBlock(pcapngSectionHeader, body); err != nil {
+		return nil, fmt.Errorf("Error writing pcapng section header: %v", err)
+	}
+	return r, r.w.Flush()
+}
+
+// Record writes a single packet, the interface block for its link type goes first if it's the first of that type
+func (r *PcapngRecorder) Record(linkType layers.LinkType, ts time.Time, data []byte, comment string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+
+	id, ok := r.interfaces[linkType]
+	if !ok {
+		body := binary.LittleEndian.AppendUint16(nil, uint16(linkType))
+		body = binary.LittleEndian.AppendUint16(body, 0)
+		body = binary.LittleEndian.AppendUint32(body, pcapngSnapLen)
+		body = pcapngOption(body, pcapngOptEnd, nil)
+		if err := r.writeBlock(pcapngInterface, body); err != nil {
+			r.err = err
+			return err
+		}
+		id = uint32(len(r.interfaces))
+		r.interfaces[linkType] = id
+	}
+
+	captured := data
+	if len(captured) > pcapngSnapLen {
+		captured = captured[:pcapngSnapLen]
+	}
+	usec := uint64(ts.UnixMicro())
+
+	body := binary.LittleEndian.AppendUint32(nil, id)
+	body = binary.LittleEndian.AppendUint32(body, uint32(usec>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(usec))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(captured)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(data)))
+	body = append(body, captured...)
+	body = append(body, make([]byte, pad4(len(captured)))...)
+	if comment != "" {
+		body = pcapngOption(body, pcapngOptComment, []byte(comment))
+		body = pcapngOption(body, pcapngOptEnd, nil)
+	}
+
+	if err := r.writeBlock(pcapngEnhancedPacket, body); err != nil {
+		r.err = err
+		return err
+	}
+	// flushed on every packet so a scan that gets killed still leaves a readable file
+	if err := r.w.Flush(); err != nil {
+		r.err = err
+		return err
+	}
+	return nil
+}
+
+func (r *PcapngRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.w.Flush()
+	if r.c != nil {
+		if cerr := r.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if r.err == nil {
+		r.err = fmt.Errorf("pcapng recorder closed")
+	}
+	return err
+}
+
+// a block is its type, total length, body and the total length again
+func (r *PcapngRecorder) writeBlock(blockType uint32, body []byte) error {
+	total := uint32(12 + len(body))
+	b := binary.LittleEndian.AppendUint32(nil, blockType)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, total)
+	_, err := r.w.Write(b)
+	return err
+}
+
+func pcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
@@ -0,0 +1,46 @@
+package portslibK
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+)
+
+// PortProbe is ran against a TCP port that was already found open and attaches what it found out to the result
+// probes run in the order they were added so the later ones can use what the earlier ones found (like the service)
+type PortProbe interface {
+	Name() string
+	Probe(targetIP net.IP, r *TCPResult) error
+}
+
+// UDPProbe is the same as PortProbe but for the UDP ports that were not found closed
+type UDPProbe interface {
+	Name() string
+	ProbeUDP(targetIP net.IP, r *UDPResult) error
+}
+
+func runProbes(targetIP net.IP, r *TCPResult, probes []PortProbe) {
+	for _, p := range probes {
+		if err := p.Probe(targetIP, r); err != nil {
+			r.details = fmt.Sprintf("%s\n%s probe: %v", r.details, p.Name(), err)
+		}
+	}
+}
+
+func runUDPProbes(targetIP net.IP, r *UDPResult, probes []UDPProbe) {
+	for _, p := range probes {
+		if err := p.ProbeUDP(targetIP, r); err != nil {
+			r.details = fmt.Sprintf("%s\n%s probe: %v", r.details, p.Name(), err)
+		}
+	}
+}
+
+// dials the port for a probe, the certificate is not verified as we want to talk to anything there
+func dialProbe(addr string, timeout time.Duration, useTLS bool) (net.Conn, error) {
+	d := &net.Dialer{Timeout: timeout}
+	if useTLS {
+		return tls.DialWithDialer(d, "tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	}
+	return d.Dial("tcp", addr)
+}
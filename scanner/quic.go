@@ -0,0 +1,204 @@
+package portslibK
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clients have to pad the Initial to 1200 bytes or servers don't answer it
+const quicInitialSize = 1200
+
+// a reserved version (0x?a?a?a?a) so every server answers with a version negotiation
+const quicGreaseVersion = 0x1a2a3a4a
+
+var quicVersionNames = map[uint32]string{
+	0x00000001: "QUICv1",
+	0x6b3343cf: "QUICv2",
+	0x709a50c4: "QUICv2 draft",
+	0x51303433: "Q043",
+	0x51303436: "Q046",
+	0x51303530: "Q050",
+	0x54303530: "T050",
+	0x54303531: "T051",
+	0xfaceb001: "mvfst draft-22",
+	0xfaceb002: "mvfst draft-27",
+	0xfaceb00e: "mvfst experimental",
+}
+
+// QUICInfo is what the server said about the QUIC versions it supports
+type QUICInfo struct {
+	Versions []string
+	Initial  bool     // the server answered with an Initial instead of a version negotiation
+	AltSvc   []string // h3 entries of the Alt-Svc header over TCP, if checked
+}
+
+// QUICProbe triggers a version negotiation on UDP ports, it is an UDPProbe
+type QUICProbe struct {
+	Timeout     time.Duration
+	CheckAltSvc bool // also ask the HTTPS server on the same TCP port if it advertises h3
+}
+
+// ports where HTTP/3 usually is
+var quicPorts = map[int]bool{443: true, 8443: true, 4433: true, 784: true, 853: true}
+
+func NewQUICProbe(timeout time.Duration) *QUICProbe {
+	return &QUICProbe{
+		Timeout:     timeout,
+		CheckAltSvc: true,
+	}
+}
+
+func (p *QUICProbe) Name() string {
+	return "quic"
+}
+
+func (p *QUICProbe) ProbeUDP(targetIP net.IP, r *UDPResult) error {
+	if !quicPorts[r.port] && r.service != "quic" {
+		return nil
+	}
+
+	info, err := p.Detect(targetIP, r.port)
+	if err != nil {
+		return err
+	}
+	if r.info == nil {
+		r.info = make(map[string]string)
+	}
+	r.state = "open"
+	r.service = "quic"
+	r.info["versions"] = strings.Join(info.Versions, ", ")
+	if len(info.AltSvc) > 0 {
+		r.info["alt-svc"] = strings.Join(info.AltSvc, ", ")
+	}
+	return nil
+}
+
+// DetectQUIC sends the Initial that triggers the version negotiation to the port
+func DetectQUIC(targetIP net.IP, port int, timeout time.Duration) (*QUICInfo, error) {
+	return NewQUICProbe(timeout).Detect(targetIP, port)
+}
+
+func (p *QUICProbe) Detect(targetIP net.IP, port int) (*QUICInfo, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	c, err := net.DialTimeout("udp", addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if _, err := c.Write(quicInitial(nil, port)); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2048)
+	c.SetReadDeadline(time.Now().Add(p.Timeout))
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("No QUIC response: %v", err)
+	}
+
+	info, err := parseQUIC(buf[:n])
+	if err != nil {
+		return nil, err
+	}
+
+	if p.CheckAltSvc {
+		if http, err := FingerprintHTTP(targetIP, port, true, p.Timeout); err == nil {
+			info.AltSvc = http.H3
+		}
+	}
+	return info, nil
+}
+
+// a long header Initial with random connection ids, the server does not look past the version it does not know
+func quicInitial(targetIP net.IP, port int) []byte {
+	pkt := make([]byte, 0, quicInitialSize)
+	pkt = append(pkt, 0xc3) // long header, fixed bit, Initial, 4 byte packet number
+	pkt = binary.BigEndian.AppendUint32(pkt, quicGreaseVersion)
+
+	cids := make([]byte, 16)
+	rand.Read(cids)
+	pkt = append(pkt, 8)
+	pkt = append(pkt, cids[:8]...) // destination
+	pkt = append(pkt, 8)
+	pkt = append(pkt, cids[8:]...) // source
+
+	pkt = append(pkt, 0) // no token
+	// length as a 2 byte varint, it covers the packet number and the payload up to the padded size
+	rest := quicInitialSize - len(pkt) - 2
+	pkt = append(pkt, 0x40|byte(rest>>8), byte(rest))
+	return append(pkt, make([]byte, rest)...)
+}
+
+func parseQUIC(data []byte) (*QUICInfo, error) {
+	if len(data) < 7 || data[0]&0x80 == 0 {
+		return nil, fmt.Errorf("Not a QUIC long header packet")
+	}
+	version := binary.BigEndian.Uint32(data[1:5])
+
+	// destination and source connection ids
+	off := 5
+	for i := 0; i < 2; i++ {
+		if off >= len(data) {
+			return nil, fmt.Errorf("QUIC header truncated")
+		}
+		off += 1 + int(data[off])
+	}
+	if off > len(data) {
+		return nil, fmt.Errorf("QUIC header truncated")
+	}
+
+	info := &QUICInfo{}
+	if version != 0 {
+		// the server knew our version somehow and started the handshake
+		info.Initial = true
+		info.Versions = []string{quicVersionName(version)}
+		return info, nil
+	}
+
+	for v := data[off:]; len(v) >= 4; v = v[4:] {
+		ver := binary.BigEndian.Uint32(v)
+		// servers add grease versions to the list too
+		if ver&0x0f0f0f0f == 0x0a0a0a0a {
+			continue
+		}
+		info.Versions = append(info.Versions, quicVersionName(ver))
+	}
+	if len(info.Versions) == 0 {
+		return nil, fmt.Errorf("Empty version negotiation")
+	}
+	return info, nil
+}
+
+func quicVersionName(v uint32) string {
+	if name, ok := quicVersionNames[v]; ok {
+		return name
+	}
+	if v>>8 == 0xff0000 {
+		return fmt.Sprintf("draft-%d", v&0xff)
+	}
+	return "0x" + hex.EncodeToString(binary.BigEndian.AppendUint32(nil, v))
+}
+
+func decodeQUIC(data []byte, r *UDPResult) error {
+	info, err := parseQUIC(data)
+	if err != nil {
+		return err
+	}
+	r.service = "quic"
+	r.info["versions"] = strings.Join(info.Versions, ", ")
+	return nil
+}
+
+func (i *QUICInfo) String() string {
+	s := fmt.Sprintf("versions: %s", strings.Join(i.Versions, ", "))
+	if len(i.AltSvc) > 0 {
+		s += fmt.Sprintf(", alt-svc: %s", strings.Join(i.AltSvc, ", "))
+	}
+	return s
+}
@@ -0,0 +1,221 @@
+package portslibK
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// security protocols of the RDP negotiation
+const (
+	rdpProtocolRDP      = 0x00
+	rdpProtocolSSL      = 0x01
+	rdpProtocolHybrid   = 0x02 // CredSSP, that is NLA
+	rdpProtocolHybridEx = 0x08
+)
+
+var rdpProtocols = []uint32{rdpProtocolRDP, rdpProtocolSSL, rdpProtocolHybrid, rdpProtocolHybridEx}
+
+var rdpProtocolNames = map[uint32]string{
+	rdpProtocolRDP:      "RDP",
+	rdpProtocolSSL:      "TLS",
+	rdpProtocolHybrid:   "CredSSP (NLA)",
+	rdpProtocolHybridEx: "CredSSP with early auth (NLA)",
+}
+
+var rdpFailures = map[uint32]string{
+	1: "TLS required by server",
+	2: "TLS not allowed by server",
+	3: "no certificate on server",
+	4: "inconsistent flags",
+	5: "NLA required by server",
+	6: "TLS with user auth required by server",
+}
+
+// RDPInfo lists the security protocols the server accepted
+type RDPInfo struct {
+	Protocols   []string
+	NLARequired bool
+	Refused     []string // the protocols the server refused and why
+	Legacy      bool     // the server did not answer the negotiation, so it only knows standard RDP security
+	Weak        []string // why the service is considered insecure
+}
+
+// RDPProbe negotiates every security protocol with the server, it is a PortProbe
+type RDPProbe struct {
+	Timeout time.Duration
+}
+
+func NewRDPProbe(timeout time.Duration) *RDPProbe {
+	return &RDPProbe{
+		Timeout: timeout,
+	}
+}
+
+func (p *RDPProbe) Name() string {
+	return "rdp"
+}
+
+func (p *RDPProbe) Probe(targetIP net.IP, r *TCPResult) error {
+	if r.service != nil {
+		if r.service.Service != "ms-wbt-server" && r.service.Service != "rdp" {
+			return nil
+		}
+	} else if r.port != 3389 {
+		return nil
+	}
+
+	info, err := p.Fingerprint(targetIP, r.port)
+	if err != nil {
+		return err
+	}
+	r.rdp = info
+	return nil
+}
+
+// FingerprintRDP asks the server for every security protocol one by one
+func FingerprintRDP(targetIP net.IP, port int, timeout time.Duration) (*RDPInfo, error) {
+	return NewRDPProbe(timeout).Fingerprint(targetIP, port)
+}
+
+func (p *RDPProbe) Fingerprint(targetIP net.IP, port int) (*RDPInfo, error) {
+	info := &RDPInfo{}
+	answered := false
+	nlaFailure := false
+
+	for _, proto := range rdpProtocols {
+		selected, failure, err := p.negotiate(targetIP, port, proto)
+		if err != nil {
+			continue
+		}
+		answered = true
+		switch {
+		case failure != 0:
+			info.Refused = append(info.Refused, fmt.Sprintf("%s: %s", rdpProtocolNames[proto], rdpFailureName(failure)))
+			if failure == 5 {
+				nlaFailure = true
+			}
+		case selected == int64(proto):
+			info.Protocols = append(info.Protocols, rdpProtocolNames[proto])
+		case selected < 0:
+			// no negotiation response at all, only standard security is there
+			info.Legacy = true
+		}
+		if info.Legacy {
+			break
+		}
+	}
+	if !answered {
+		return nil, fmt.Errorf("No X.224 connection confirm from the server")
+	}
+	if info.Legacy {
+		info.Protocols = []string{rdpProtocolNames[rdpProtocolRDP]}
+	}
+
+	nla := false
+	for _, name := range info.Protocols {
+		if strings.Contains(name, "NLA") {
+			nla = true
+		}
+	}
+	info.NLARequired = nla && nlaFailure
+
+	if len(info.Protocols) > 0 && info.Protocols[0] == rdpProtocolNames[rdpProtocolRDP] {
+		info.Weak = append(info.Weak, "standard RDP security allowed")
+	}
+	if !info.NLARequired {
+		info.Weak = append(info.Weak, "NLA not required")
+	}
+	return info, nil
+}
+
+// selected is -1 when the server confirmed the connection without a negotiation response
+func (p *RDPProbe) negotiate(targetIP net.IP, port int, proto uint32) (int64, uint32, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	c, err := net.DialTimeout("tcp", addr, p.Timeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(p.Timeout))
+
+	if _, err := c.Write(rdpConnectionRequest(proto)); err != nil {
+		return 0, 0, err
+	}
+
+	tpkt := make([]byte, 4)
+	if _, err := io.ReadFull(c, tpkt); err != nil {
+		return 0, 0, err
+	}
+	if tpkt[0] != 3 {
+		return 0, 0, fmt.Errorf("Not a TPKT reply")
+	}
+	l := int(binary.BigEndian.Uint16(tpkt[2:4]))
+	if l < 4+7 || l > 1024 {
+		return 0, 0, fmt.Errorf("Bad TPKT length %d", l)
+	}
+	data := make([]byte, l-4)
+	if _, err := io.ReadFull(c, data); err != nil {
+		return 0, 0, err
+	}
+
+	// X.224 connection confirm, the negotiation response follows the fixed part
+	if data[1]&0xf0 != 0xd0 {
+		return 0, 0, fmt.Errorf("Not a connection confirm")
+	}
+	neg := data[7:]
+	if len(neg) < 8 {
+		return -1, 0, nil
+	}
+	value := binary.LittleEndian.Uint32(neg[4:8])
+	switch neg[0] {
+	case 0x02:
+		return int64(value), 0, nil
+	case 0x03:
+		return 0, value, nil
+	}
+	return 0, 0, fmt.Errorf("Unknown negotiation type 0x%02x", neg[0])
+}
+
+// TPKT, X.224 connection request and the RDP negotiation request
+func rdpConnectionRequest(proto uint32) []byte {
+	cookie := []byte("Cookie: mstshash=portslibk\r\n")
+	neg := []byte{0x01, 0x00, 0x08, 0x00, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(neg[4:8], proto)
+
+	x224 := []byte{0, 0xe0, 0, 0, 0, 0, 0}
+	x224 = append(append(x224, cookie...), neg...)
+	x224[0] = byte(len(x224) - 1)
+
+	pkt := []byte{3, 0, 0, 0}
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(4+len(x224)))
+	return append(pkt, x224...)
+}
+
+func (i *RDPInfo) String() string {
+	s := fmt.Sprintf("protocols: %s", strings.Join(i.Protocols, ", "))
+	if i.NLARequired {
+		s += ", NLA required"
+	}
+	if i.Legacy {
+		s += " (no negotiation support)"
+	}
+	if len(i.Refused) > 0 {
+		s += fmt.Sprintf("\n  refused: %s", strings.Join(i.Refused, ", "))
+	}
+	if len(i.Weak) > 0 {
+		s += fmt.Sprintf("\n  weak: %s", strings.Join(i.Weak, ", "))
+	}
+	return s
+}
+
+func rdpFailureName(code uint32) string {
+	if name, ok := rdpFailures[code]; ok {
+		return name
+	}
+	return strconv.Itoa(int(code))
+}
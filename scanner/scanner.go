@@ -26,6 +26,17 @@ func CreateScanner(sType string, targetIP net.IP, portArr []int, timeout time.Du
 		}
 		s, err := NewSynScanner(timeout, targetIP, portArr)
 		return s, err
+	case "sweep", "fast", "fS":
+		// the SYN scan sending its probes in batches from one conn
+		if !privileges.IsPrivileged {
+			return nil, fmt.Errorf("Access denied: You must run this as a privileged user.\n")
+		}
+		s, err := NewSynScanner(timeout, targetIP, portArr)
+		if err != nil {
+			return nil, err
+		}
+		s.EnableBatch(0)
+		return s, nil
 	case "tcp", "connect", "cS", "tcpS":
 		s, err := NewTCPScanner(timeout, targetIP, portArr)
 		return s, err
@@ -35,6 +46,14 @@ func CreateScanner(sType string, targetIP net.IP, portArr []int, timeout time.Du
 	case "ack", "aS", "acS", "ackS":
 		s, err := NewACKScanner(targetIP, portArr)
 		return s, err
+	case "passive", "pS", "listen":
+		// nothing is sent but capturing still needs the privileges
+		if !privileges.IsPrivileged {
+			return nil, fmt.Errorf("Access denied: You must run this as a privileged user.\n")
+		}
+		// the timeout is how long it listens
+		s, err := NewPassiveScanner(timeout, targetIP, portArr)
+		return s, err
 	}
 
 	return nil, fmt.Errorf("Error getting a scanner")
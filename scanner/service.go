@@ -0,0 +1,752 @@
+package portslibK
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceProbe is a single probe from the probes file, it is sent to a port and its response is tested against the matches
+type ServiceProbe struct {
+	Name     string
+	Protocol string // TCP or UDP
+	Data     []byte
+	Rarity   int
+	Wait     time.Duration
+	Fallback []string
+	ports    map[int]bool
+	sslPorts map[int]bool
+	matches  []*serviceMatch
+}
+
+type serviceMatch struct {
+	service  string
+	soft     bool
+	re       *regexp.Regexp
+	product  string
+	version  string
+	info     string
+	hostname string
+	os       string
+	device   string
+	cpe      []string
+}
+
+// ServiceInfo is what the version detection found out about a port
+type ServiceInfo struct {
+	Service    string
+	Product    string
+	Version    string
+	Info       string
+	Hostname   string
+	OS         string
+	DeviceType string
+	CPE        []string
+	Probe      string // name of the probe that got the matched response
+	Soft       bool   // only the service is known, not the product
+	TLS        bool   // the service was found behind TLS
+}
+
+// ServiceDB is a set of probes parsed from a nmap-service-probes compatible file
+type ServiceDB struct {
+	probes  []*ServiceProbe
+	byName  map[string]*ServiceProbe
+	skipped int // match lines with regexes that the go regexp can't compile (lookarounds, backreferences)
+}
+
+//go:embed service-probes
+var defaultServiceProbes string
+
+var (
+	defaultServiceDB     *ServiceDB
+	defaultServiceDBOnce sync.Once
+)
+
+// DefaultServiceDB returns the probes embedded in the library
+func DefaultServiceDB() *ServiceDB {
+	defaultServiceDBOnce.Do(func() {
+		db, err := ParseServiceProbes(strings.NewReader(defaultServiceProbes))
+		if err != nil {
+			panic(fmt.Sprintf("Error parsing the embedded service probes: %v", err))
+		}
+		defaultServiceDB = db
+	})
+	return defaultServiceDB
+}
+
+// LoadServiceProbes reads a probes file, the nmap-service-probes file can be used as is
+func LoadServiceProbes(path string) (*ServiceDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening service probes file: %v\n", err)
+	}
+	defer f.Close()
+
+	return ParseServiceProbes(f)
+}
+
+func ParseServiceProbes(r io.Reader) (*ServiceDB, error) {
+	db := &ServiceDB{
+		byName: make(map[string]*ServiceProbe),
+	}
+	var probe *ServiceProbe
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for sc.Scan() {
+		line++
+		l := strings.TrimSpace(sc.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		directive, rest, _ := strings.Cut(l, " ")
+		if directive != "Probe" && directive != "Exclude" && probe == nil {
+			return nil, fmt.Errorf("Line %d: %s before any Probe", line, directive)
+		}
+
+		var err error
+		switch directive {
+		case "Exclude":
+			// excluding ports is left to the caller
+		case "Probe":
+			probe, err = parseProbeLine(rest)
+			if err == nil {
+				db.probes = append(db.probes, probe)
+				db.byName[probe.Name] = probe
+			}
+		case "match", "softmatch":
+			var m *serviceMatch
+			m, err = parseMatchLine(rest, directive == "softmatch")
+			if err == errUnsupportedRegex {
+				db.skipped++
+				err = nil
+			} else if err == nil {
+				probe.matches = append(probe.matches, m)
+			}
+		case "ports":
+			probe.ports, err = parsePortList(rest)
+		case "sslports":
+			probe.sslPorts, err = parsePortList(rest)
+		case "rarity":
+			probe.Rarity, err = strconv.Atoi(rest)
+		case "totalwaitms":
+			var ms int
+			ms, err = strconv.Atoi(rest)
+			probe.Wait = time.Duration(ms) * time.Millisecond
+		case "fallback":
+			probe.Fallback = strings.Split(rest, ",")
+		default:
+			// tcpwrappedms and the others are not needed here
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", line, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// Probes returns the names of the probes in the order of the file
+func (db *ServiceDB) Probes() []string {
+	names := make([]string, 0, len(db.probes))
+	for _, p := range db.probes {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// Probe TCP GetRequest q|GET / HTTP/1.0\r\n\r\n|
+func parseProbeLine(s string) (*ServiceProbe, error) {
+	fields := strings.SplitN(s, " ", 3)
+	if len(fields) != 3 || (fields[0] != "TCP" && fields[0] != "UDP") {
+		return nil, fmt.Errorf("Invalid probe: %s", s)
+	}
+
+	q := fields[2]
+	if len(q) < 3 || q[0] != 'q' {
+		return nil, fmt.Errorf("Invalid probe string: %s", q)
+	}
+	end := strings.IndexByte(q[2:], q[1])
+	if end < 0 {
+		return nil, fmt.Errorf("Unterminated probe string: %s", q)
+	}
+	data, err := unescapeProbe(q[2 : 2+end])
+	if err != nil {
+		return nil, err
+	}
+
+	return &ServiceProbe{
+		Name:     fields[1],
+		Protocol: fields[0],
+		Data:     data,
+		Rarity:   1,
+		Wait:     time.Second * 5,
+	}, nil
+}
+
+var errUnsupportedRegex = fmt.Errorf("Unsupported regex")
+
+// match ssh m|^SSH-([\d.]+)-OpenSSH_([\w.]+)| p/OpenSSH/ v/$2/ i/protocol $1/ cpe:/a:openbsd:openssh:$2/
+func parseMatchLine(s string, soft bool) (*serviceMatch, error) {
+	service, rest, ok := strings.Cut(s, " ")
+	if !ok || len(rest) < 3 || rest[0] != 'm' {
+		return nil, fmt.Errorf("Invalid match: %s", s)
+	}
+
+	delim := rest[1]
+	end := strings.IndexByte(rest[2:], delim)
+	if end < 0 {
+		return nil, fmt.Errorf("Unterminated match regex: %s", s)
+	}
+	pattern := rest[2 : 2+end]
+	rest = rest[3+end:]
+
+	flags := ""
+	for len(rest) > 0 && rest[0] != ' ' {
+		flags += string(rest[0])
+		rest = rest[1:]
+	}
+
+	re, err := compileProbeRegex(pattern, flags)
+	if err != nil {
+		return nil, errUnsupportedRegex
+	}
+	m := &serviceMatch{
+		service: service,
+		soft:    soft,
+		re:      re,
+	}
+
+	// the version info fields, each of them is a letter followed by a delimited value
+	rest = strings.TrimSpace(rest)
+	for rest != "" {
+		var key string
+		if strings.HasPrefix(rest, "cpe:") {
+			key, rest = "cpe", rest[4:]
+		} else {
+			key, rest = rest[:1], rest[1:]
+		}
+		if len(rest) < 2 {
+			return nil, fmt.Errorf("Invalid version info in: %s", s)
+		}
+		d := rest[0]
+		end := strings.IndexByte(rest[1:], d)
+		if end < 0 {
+			return nil, fmt.Errorf("Unterminated version info in: %s", s)
+		}
+		value := rest[1 : 1+end]
+		rest = rest[2+end:]
+		// cpe can be followed by the "a" flag
+		if key == "cpe" && strings.HasPrefix(rest, "a") {
+			rest = rest[1:]
+		}
+		rest = strings.TrimSpace(rest)
+
+		switch key {
+		case "p":
+			m.product = value
+		case "v":
+			m.version = value
+		case "i":
+			m.info = value
+		case "h":
+			m.hostname = value
+		case "o":
+			m.os = value
+		case "d":
+			m.device = value
+		case "cpe":
+			m.cpe = append(m.cpe, "cpe:/"+value)
+		}
+	}
+
+	return m, nil
+}
+
+// responses are matched as latin1 strings so every byte is a single rune and \xHH in the regexes matches the byte
+func compileProbeRegex(pattern, flags string) (*regexp.Regexp, error) {
+	prefix := ""
+	if strings.Contains(flags, "i") {
+		prefix += "i"
+	}
+	if strings.Contains(flags, "s") {
+		prefix += "s"
+	}
+	if prefix != "" {
+		prefix = "(?" + prefix + ")"
+	}
+	// perl's \Z is the end of the text or before the last newline, close enough to \z here
+	pattern = strings.ReplaceAll(pattern, `\Z`, `\z`)
+	return regexp.Compile(prefix + pattern)
+}
+
+func latin1(data []byte) string {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return string(runes)
+}
+
+func fromLatin1(s string) []byte {
+	b := make([]byte, 0, len(s))
+	for _, r := range s {
+		b = append(b, byte(r))
+	}
+	return b
+}
+
+func unescapeProbe(s string) ([]byte, error) {
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		if i >= len(s) {
+			return nil, fmt.Errorf("Trailing backslash in probe string")
+		}
+		switch s[i] {
+		case '0':
+			out = append(out, 0)
+		case 'a':
+			out = append(out, '\a')
+		case 'f':
+			out = append(out, '\f')
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'v':
+			out = append(out, '\v')
+		case 'x':
+			if i+2 >= len(s) {
+				return nil, fmt.Errorf("Invalid hex escape in probe string")
+			}
+			b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid hex escape in probe string: %v", err)
+			}
+			out = append(out, byte(b))
+			i += 2
+		default:
+			out = append(out, s[i])
+		}
+	}
+	return out, nil
+}
+
+// 80,443,8000-8010
+func parsePortList(s string) (map[int]bool, error) {
+	ports := make(map[int]bool)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid port %q", part)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(hi); err != nil {
+				return nil, fmt.Errorf("Invalid port range %q", part)
+			}
+		}
+		for p := start; p <= end; p++ {
+			ports[p] = true
+		}
+	}
+	return ports, nil
+}
+
+// tries the matches of the probe, then of its fallbacks and at last the NULL probe ones
+func (db *ServiceDB) match(probe *ServiceProbe, resp []byte) *ServiceInfo {
+	text := latin1(resp)
+
+	candidates := []*ServiceProbe{probe}
+	for _, name := range probe.Fallback {
+		if p, ok := db.byName[name]; ok {
+			candidates = append(candidates, p)
+		}
+	}
+	if null, ok := db.byName["NULL"]; ok && probe.Protocol == "TCP" && probe != null {
+		candidates = append(candidates, null)
+	}
+
+	var soft *ServiceInfo
+	for _, c := range candidates {
+		for _, m := range c.matches {
+			groups := m.re.FindStringSubmatch(text)
+			if groups == nil {
+				continue
+			}
+			info := m.fill(groups)
+			info.Probe = probe.Name
+			if !m.soft {
+				return info
+			}
+			if soft == nil {
+				soft = info
+			}
+		}
+	}
+	return soft
+}
+
+func (m *serviceMatch) fill(groups []string) *ServiceInfo {
+	info := &ServiceInfo{
+		Service:    m.service,
+		Soft:       m.soft,
+		Product:    substituteVersion(m.product, groups),
+		Version:    substituteVersion(m.version, groups),
+		Info:       substituteVersion(m.info, groups),
+		Hostname:   substituteVersion(m.hostname, groups),
+		OS:         substituteVersion(m.os, groups),
+		DeviceType: substituteVersion(m.device, groups),
+	}
+	for _, c := range m.cpe {
+		info.CPE = append(info.CPE, substituteVersion(c, groups))
+	}
+	return info
+}
+
+var versionHelperRe = regexp.MustCompile(`\$(?:P\((\d)\)|SUBST\((\d),"([^"]*)","([^"]*)"\)|I\((\d),"([<>])"\)|(\d))`)
+
+// fills in $1, $P(1), $SUBST(1,"_",".") and $I(1,">") from the regex groups
+func substituteVersion(tmpl string, groups []string) string {
+	if !strings.Contains(tmpl, "$") {
+		return tmpl
+	}
+	group := func(n string) []byte {
+		i, _ := strconv.Atoi(n)
+		if i >= len(groups) {
+			return nil
+		}
+		return fromLatin1(groups[i])
+	}
+
+	out := versionHelperRe.ReplaceAllStringFunc(tmpl, func(s string) string {
+		sub := versionHelperRe.FindStringSubmatch(s)
+		switch {
+		case sub[1] != "":
+			// only the printable characters
+			var b strings.Builder
+			for _, c := range group(sub[1]) {
+				if c >= 0x20 && c < 0x7f {
+					b.WriteByte(c)
+				}
+			}
+			return b.String()
+		case sub[2] != "":
+			return strings.ReplaceAll(string(group(sub[2])), sub[3], sub[4])
+		case sub[5] != "":
+			g := group(sub[5])
+			if len(g) == 0 || len(g) > 8 {
+				return ""
+			}
+			buf := make([]byte, 8)
+			if sub[6] == ">" {
+				copy(buf[8-len(g):], g)
+				return strconv.FormatUint(binary.BigEndian.Uint64(buf), 10)
+			}
+			copy(buf, g)
+			return strconv.FormatUint(binary.LittleEndian.Uint64(buf), 10)
+		default:
+			return string(group(sub[7]))
+		}
+	})
+	return strings.TrimSpace(out)
+}
+
+// ServiceDetector runs the probes of a ServiceDB against open ports
+type ServiceDetector struct {
+	db        *ServiceDB
+	intensity int
+	timeout   time.Duration
+}
+
+// NewServiceDetector creates a detector, intensity goes from 0 to 9 (like nmap) and probes rarer than it are skipped
+// unless they are made for the scanned port, the timeout caps the connect and the wait of a single probe
+func NewServiceDetector(db *ServiceDB, intensity int, timeout time.Duration) *ServiceDetector {
+	if db == nil {
+		db = DefaultServiceDB()
+	}
+	if intensity < 0 {
+		intensity = 0
+	} else if intensity > 9 {
+		intensity = 9
+	}
+	return &ServiceDetector{
+		db:        db,
+		intensity: intensity,
+		timeout:   timeout,
+	}
+}
+
+func (d *ServiceDetector) Name() string {
+	return "service"
+}
+
+// Probe implements PortProbe, the banner already read by the connect scan is used as the NULL probe response
+func (d *ServiceDetector) Probe(targetIP net.IP, r *TCPResult) error {
+	var null []byte
+	if r.bannerRead {
+		null = []byte(r.banner)
+	}
+	info, err := d.detect(targetIP, r.port, false, null, r.bannerRead)
+	if err != nil {
+		return err
+	}
+	r.service = info
+	return nil
+}
+
+// ProbeUDP implements UDPProbe, a port that answers one of the probes is open
+func (d *ServiceDetector) ProbeUDP(targetIP net.IP, r *UDPResult) error {
+	info, err := d.DetectUDP(targetIP, r.port)
+	if err != nil {
+		return err
+	}
+	r.state = "open"
+	r.service = info.Service
+	r.version = strings.TrimSpace(info.Product + " " + info.Version)
+	if info.Info != "" {
+		if r.info == nil {
+			r.info = make(map[string]string)
+		}
+		r.info["service info"] = info.Info
+	}
+	return nil
+}
+
+// Detect runs the TCP probes against the port until one of them matches
+func (d *ServiceDetector) Detect(targetIP net.IP, port int) (*ServiceInfo, error) {
+	return d.detect(targetIP, port, false, nil, false)
+}
+
+func (d *ServiceDetector) detect(targetIP net.IP, port int, useTLS bool, null []byte, nullDone bool) (*ServiceInfo, error) {
+	var soft *ServiceInfo
+
+	for _, probe := range d.probeOrder("TCP", port, useTLS) {
+		var resp []byte
+		if probe.Name == "NULL" && nullDone && !useTLS {
+			resp = null
+		} else {
+			var err error
+			resp, err = d.exchangeTCP(targetIP, port, probe, useTLS)
+			if isRefused(err) || (useTLS && probe.Name == "NULL" && err != nil && !isTimeout(err)) {
+				// can't even connect (or do the handshake), no reason to try the others
+				return nil, fmt.Errorf("Error connecting to port %d: %v", port, err)
+			} else if err != nil {
+				continue
+			}
+		}
+		if len(resp) == 0 {
+			continue
+		}
+
+		info := d.db.match(probe, resp)
+		if info == nil {
+			continue
+		}
+		if info.Soft {
+			if soft == nil {
+				soft = info
+			}
+			continue
+		}
+		// after a soft match only the same service is accepted, apart from ssl which just means we have to go deeper
+		isSSL := info.Service == "ssl" || info.Service == "tls"
+		if soft != nil && info.Service != soft.Service && !isSSL {
+			continue
+		}
+
+		if !useTLS && isSSL {
+			// detect again what is behind the TLS
+			if inner, err := d.detect(targetIP, port, true, nil, false); err == nil {
+				inner.TLS = true
+				return inner, nil
+			}
+		}
+		info.TLS = useTLS
+		return info, nil
+	}
+
+	if soft != nil {
+		soft.TLS = useTLS
+		return soft, nil
+	}
+	return nil, fmt.Errorf("No service matched on port %d", port)
+}
+
+// DetectUDP sends the UDP probes to the port until one of them gets a matching response
+func (d *ServiceDetector) DetectUDP(targetIP net.IP, port int) (*ServiceInfo, error) {
+	var soft *ServiceInfo
+
+	for _, probe := range d.probeOrder("UDP", port, false) {
+		resp, err := d.exchangeUDP(targetIP, port, probe)
+		if err != nil || len(resp) == 0 {
+			continue
+		}
+		info := d.db.match(probe, resp)
+		if info == nil {
+			continue
+		}
+		if !info.Soft {
+			return info, nil
+		}
+		if soft == nil {
+			soft = info
+		}
+	}
+	if soft != nil {
+		return soft, nil
+	}
+	return nil, fmt.Errorf("No UDP service matched on port %d", port)
+}
+
+// NULL probe first, then the probes made for the port and then the rest by rarity up to the intensity
+func (d *ServiceDetector) probeOrder(protocol string, port int, useTLS bool) []*ServiceProbe {
+	var null, hinted, rest []*ServiceProbe
+
+	for _, p := range d.db.probes {
+		if p.Protocol != protocol {
+			continue
+		}
+		switch {
+		case p.Name == "NULL":
+			null = append(null, p)
+		case p.ports[port] || (useTLS && p.sslPorts[port]):
+			hinted = append(hinted, p)
+		case p.Rarity <= d.intensity:
+			rest = append(rest, p)
+		}
+	}
+
+	sort.SliceStable(hinted, func(i, j int) bool { return hinted[i].Rarity < hinted[j].Rarity })
+	sort.SliceStable(rest, func(i, j int) bool { return rest[i].Rarity < rest[j].Rarity })
+
+	return append(append(null, hinted...), rest...)
+}
+
+func (d *ServiceDetector) wait(probe *ServiceProbe) time.Duration {
+	if d.timeout > 0 && (probe.Wait == 0 || probe.Wait > d.timeout) {
+		return d.timeout
+	}
+	return probe.Wait
+}
+
+func (d *ServiceDetector) exchangeTCP(targetIP net.IP, port int, probe *ServiceProbe, useTLS bool) ([]byte, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	c, err := dialProbe(addr, d.timeout, useTLS)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if len(probe.Data) > 0 {
+		c.SetWriteDeadline(time.Now().Add(d.wait(probe)))
+		if _, err := c.Write(probe.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	return d.readResponse(c, probe)
+}
+
+func (d *ServiceDetector) exchangeUDP(targetIP net.IP, port int, probe *ServiceProbe) ([]byte, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	c, err := net.DialTimeout("udp", addr, d.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if _, err := c.Write(probe.Data); err != nil {
+		return nil, err
+	}
+	c.SetReadDeadline(time.Now().Add(d.wait(probe)))
+	buf := make([]byte, 4096)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// reads until the probe waited long enough, the connection got closed or the response matched
+func (d *ServiceDetector) readResponse(c net.Conn, probe *ServiceProbe) ([]byte, error) {
+	deadline := time.Now().Add(d.wait(probe))
+	var resp []byte
+	buf := make([]byte, 4096)
+
+	for len(resp) < 64*1024 {
+		c.SetReadDeadline(deadline)
+		n, err := c.Read(buf)
+		resp = append(resp, buf[:n]...)
+		if err != nil {
+			if err == io.EOF || isTimeout(err) {
+				return resp, nil
+			}
+			return resp, err
+		}
+		if info := d.db.match(probe, resp); info != nil && !info.Soft {
+			return resp, nil
+		}
+		// once the server started talking it does not need the whole wait time to finish
+		if short := time.Now().Add(time.Millisecond * 500); short.Before(deadline) {
+			deadline = short
+		}
+	}
+	return resp, nil
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func isRefused(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "connection refused")
+}
+
+func (i *ServiceInfo) String() string {
+	s := i.Service
+	if i.TLS {
+		s = "ssl/" + s
+	}
+	parts := []string{s}
+	for _, p := range []string{i.Product, i.Version} {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	if i.Info != "" {
+		parts = append(parts, "("+i.Info+")")
+	}
+	if i.OS != "" {
+		parts = append(parts, "OS: "+i.OS)
+	}
+	return strings.Join(parts, " ")
+}
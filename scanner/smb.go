@@ -0,0 +1,279 @@
+package portslibK
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	smb2SigningEnabled  = 0x01
+	smb2SigningRequired = 0x02
+)
+
+var smb2Dialects = []uint16{0x0202, 0x0210, 0x0300, 0x0302, 0x0311}
+
+var smb2DialectNames = map[uint16]string{
+	0x0202: "SMB 2.0.2",
+	0x0210: "SMB 2.1",
+	0x0300: "SMB 3.0",
+	0x0302: "SMB 3.0.2",
+	0x0311: "SMB 3.1.1",
+}
+
+// SMBInfo lists the dialects the server accepted and how it does signing
+type SMBInfo struct {
+	SMB1            bool
+	Dialects        []string
+	SigningEnabled  bool
+	SigningRequired bool
+	ServerGUID      string
+	SystemTime      time.Time
+	Weak            []string // why the service is considered insecure
+}
+
+// SMBProbe negotiates every dialect with the server, it is a PortProbe
+type SMBProbe struct {
+	Timeout time.Duration
+}
+
+func NewSMBProbe(timeout time.Duration) *SMBProbe {
+	return &SMBProbe{
+		Timeout: timeout,
+	}
+}
+
+func (p *SMBProbe) Name() string {
+	return "smb"
+}
+
+func (p *SMBProbe) Probe(targetIP net.IP, r *TCPResult) error {
+	if r.service != nil {
+		if r.service.Service != "microsoft-ds" && r.service.Service != "smb" {
+			return nil
+		}
+	} else if r.port != 445 {
+		return nil
+	}
+
+	info, err := p.Fingerprint(targetIP, r.port)
+	if err != nil {
+		return err
+	}
+	r.smb = info
+	return nil
+}
+
+// FingerprintSMB checks SMB1 and every SMB2/3 dialect on the port, it has to be the direct TCP one (445)
+func FingerprintSMB(targetIP net.IP, port int, timeout time.Duration) (*SMBInfo, error) {
+	return NewSMBProbe(timeout).Fingerprint(targetIP, port)
+}
+
+func (p *SMBProbe) Fingerprint(targetIP net.IP, port int) (*SMBInfo, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	info := &SMBInfo{}
+
+	securityMode, err := p.negotiateSMB1(addr)
+	if err == nil {
+		info.SMB1 = true
+		info.Dialects = append(info.Dialects, "NT LM 0.12")
+		info.SigningEnabled = securityMode&0x04 != 0
+		info.SigningRequired = securityMode&0x08 != 0
+		info.Weak = append(info.Weak, "SMB1 enabled")
+	}
+
+	// a connection per dialect, the server always picks the highest one we offer
+	for _, d := range smb2Dialects {
+		resp, err := p.negotiateSMB2(addr, d)
+		if err != nil || resp.dialect != d {
+			continue
+		}
+		info.Dialects = append(info.Dialects, smb2DialectNames[d])
+		info.SigningEnabled = resp.securityMode&smb2SigningEnabled != 0
+		info.SigningRequired = resp.securityMode&smb2SigningRequired != 0
+		info.ServerGUID = resp.guid
+		info.SystemTime = resp.systemTime
+	}
+
+	if len(info.Dialects) == 0 {
+		return nil, fmt.Errorf("The server did not accept any SMB dialect")
+	}
+	if !info.SigningRequired {
+		info.Weak = append(info.Weak, "signing not required")
+	}
+	return info, nil
+}
+
+// the NetBIOS session header is a zero byte and the 24 bit length
+func smbFrame(msg []byte) []byte {
+	l := len(msg)
+	return append([]byte{0, byte(l >> 16), byte(l >> 8), byte(l)}, msg...)
+}
+
+func (p *SMBProbe) exchange(addr string, msg []byte) ([]byte, error) {
+	c, err := net.DialTimeout("tcp", addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(p.Timeout))
+
+	if _, err := c.Write(smbFrame(msg)); err != nil {
+		return nil, err
+	}
+	h := make([]byte, 4)
+	if _, err := io.ReadFull(c, h); err != nil {
+		return nil, fmt.Errorf("Error reading SMB reply: %v", err)
+	}
+	l := int(h[1])<<16 | int(h[2])<<8 | int(h[3])
+	if l > 64*1024 {
+		return nil, fmt.Errorf("SMB reply too long")
+	}
+	reply := make([]byte, l)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return nil, fmt.Errorf("Error reading SMB reply: %v", err)
+	}
+	return reply, nil
+}
+
+// offers only the NT LM 0.12 dialect, servers with SMB1 disabled drop the connection or answer with an error
+func (p *SMBProbe) negotiateSMB1(addr string) (byte, error) {
+	msg := make([]byte, 32)
+	copy(msg, "\xffSMB")
+	msg[4] = 0x72                                     // negotiate
+	msg[9] = 0x18                                     // case insensitive, canonical paths
+	binary.LittleEndian.PutUint16(msg[10:12], 0xc801) // unicode, nt status, extended security, long names
+	binary.LittleEndian.PutUint16(msg[26:28], 0xfeff) // process id
+
+	dialects := []byte("\x02NT LM 0.12\x00")
+	msg = append(msg, 0) // word count
+	msg = binary.LittleEndian.AppendUint16(msg, uint16(len(dialects)))
+	msg = append(msg, dialects...)
+
+	reply, err := p.exchange(addr, msg)
+	if err != nil {
+		return 0, err
+	}
+	if len(reply) < 32+1 || string(reply[:4]) != "\xffSMB" {
+		return 0, fmt.Errorf("Not an SMB1 reply")
+	}
+	if status := binary.LittleEndian.Uint32(reply[5:9]); status != 0 {
+		return 0, fmt.Errorf("SMB1 negotiate failed with 0x%08x", status)
+	}
+	// word count 17, then the dialect index and the security mode
+	if reply[32] != 17 || len(reply) < 32+1+3 {
+		return 0, fmt.Errorf("Unexpected SMB1 negotiate reply")
+	}
+	if binary.LittleEndian.Uint16(reply[33:35]) == 0xffff {
+		return 0, fmt.Errorf("No SMB1 dialect accepted")
+	}
+	return reply[35], nil
+}
+
+type smb2NegotiateResponse struct {
+	dialect      uint16
+	securityMode uint16
+	guid         string
+	systemTime   time.Time
+}
+
+func (p *SMBProbe) negotiateSMB2(addr string, dialect uint16) (*smb2NegotiateResponse, error) {
+	reply, err := p.exchange(addr, smb2Negotiate(dialect))
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) < 64+64 || string(reply[:4]) != "\xfeSMB" {
+		return nil, fmt.Errorf("Not an SMB2 reply")
+	}
+	if status := binary.LittleEndian.Uint32(reply[8:12]); status != 0 {
+		return nil, fmt.Errorf("SMB2 negotiate failed with 0x%08x", status)
+	}
+
+	body := reply[64:]
+	resp := &smb2NegotiateResponse{
+		securityMode: binary.LittleEndian.Uint16(body[2:4]),
+		dialect:      binary.LittleEndian.Uint16(body[4:6]),
+		guid:         smbGUID(body[8:24]),
+	}
+	// FILETIME, 100ns intervals since 1601
+	if ft := binary.LittleEndian.Uint64(body[40:48]); ft > 116444736000000000 {
+		unix := ft - 116444736000000000
+		resp.systemTime = time.Unix(int64(unix/1e7), int64(unix%1e7)*100).UTC()
+	}
+	return resp, nil
+}
+
+func smb2Negotiate(dialect uint16) []byte {
+	header := make([]byte, 64)
+	copy(header, "\xfeSMB")
+	binary.LittleEndian.PutUint16(header[4:6], 64)  // structure size
+	binary.LittleEndian.PutUint16(header[14:16], 1) // credits
+
+	req := make([]byte, 36)
+	binary.LittleEndian.PutUint16(req[0:2], 36)
+	binary.LittleEndian.PutUint16(req[2:4], 1) // dialect count
+	binary.LittleEndian.PutUint16(req[4:6], smb2SigningEnabled)
+	rand.Read(req[12:28]) // client guid
+	req = binary.LittleEndian.AppendUint16(req, dialect)
+
+	if dialect == 0x0311 {
+		// 3.1.1 needs the preauth integrity context, the contexts start 8 byte aligned
+		for (64+len(req))%8 != 0 {
+			req = append(req, 0)
+		}
+		binary.LittleEndian.PutUint32(req[28:32], uint32(64+len(req)))
+		binary.LittleEndian.PutUint16(req[32:34], 2)
+
+		salt := make([]byte, 32)
+		rand.Read(salt)
+		preauth := append([]byte{1, 0, 32, 0, 1, 0}, salt...) // one algorithm, 32 bytes of salt, SHA-512
+		req = append(req, smb2Context(1, preauth)...)
+		for (64+len(req))%8 != 0 {
+			req = append(req, 0)
+		}
+		// AES-128-GCM and AES-128-CCM
+		req = append(req, smb2Context(2, []byte{2, 0, 2, 0, 1, 0})...)
+	}
+
+	return append(header, req...)
+}
+
+func smb2Context(typ uint16, data []byte) []byte {
+	c := binary.LittleEndian.AppendUint16(nil, typ)
+	c = binary.LittleEndian.AppendUint16(c, uint16(len(data)))
+	c = append(c, 0, 0, 0, 0)
+	return append(c, data...)
+}
+
+// GUIDs have the first three parts little endian
+func smbGUID(b []byte) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%x-%x", binary.LittleEndian.Uint32(b[0:4]), binary.LittleEndian.Uint16(b[4:6]),
+		binary.LittleEndian.Uint16(b[6:8]), b[8:10], b[10:16])
+}
+
+func (i *SMBInfo) String() string {
+	s := fmt.Sprintf("dialects: %s", strings.Join(i.Dialects, ", "))
+	switch {
+	case i.SigningRequired:
+		s += ", signing required"
+	case i.SigningEnabled:
+		s += ", signing enabled"
+	default:
+		s += ", signing disabled"
+	}
+	if i.ServerGUID != "" {
+		s += fmt.Sprintf("\n  server guid: %s", i.ServerGUID)
+	}
+	if !i.SystemTime.IsZero() {
+		s += fmt.Sprintf(", system time: %s", i.SystemTime.Format(time.RFC3339))
+	}
+	if len(i.Weak) > 0 {
+		s += fmt.Sprintf("\n  weak: %s", strings.Join(i.Weak, ", "))
+	}
+	return s
+}
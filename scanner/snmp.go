@@ -0,0 +1,382 @@
+package portslibK
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SNMP PDU types
+const (
+	snmpGetRequest  byte = 0xa0
+	snmpGetResponse byte = 0xa2
+	snmpReport      byte = 0xa8
+)
+
+const (
+	snmpV1  = 0
+	snmpV2c = 1
+	snmpV3  = 3
+)
+
+// the system group, the names are in snmpOIDNames
+var snmpSystemOIDs = []string{"1.3.6.1.2.1.1.1.0", "1.3.6.1.2.1.1.2.0", "1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.1.5.0"}
+
+// SNMPInfo is what the agent answered to the system group queries and the v3 discovery
+type SNMPInfo struct {
+	Versions    []string          // v1, v2c and v3 if the agent answered them
+	Communities []string          // the communities the agent accepted
+	System      map[string]string // sysDescr, sysName, sysUpTime and sysObjectID
+	EngineID    string            // hex of the v3 engine id
+	Enterprise  int               // from the engine id, -1 if it does not follow RFC 3411
+	EngineData  string            // the MAC, IP or text the engine id was made of
+	EngineBoots int64
+	EngineTime  int64 // seconds since the last boot
+}
+
+// SNMPProbe tries the communities with v2c and v1 and does the v3 engine discovery, it is a UDPProbe
+type SNMPProbe struct {
+	Timeout     time.Duration
+	Communities []string
+	Retries     int
+}
+
+func NewSNMPProbe(timeout time.Duration) *SNMPProbe {
+	return &SNMPProbe{
+		Timeout:     timeout,
+		Communities: []string{"public", "private"},
+		Retries:     1,
+	}
+}
+
+func (p *SNMPProbe) Name() string {
+	return "snmp"
+}
+
+func (p *SNMPProbe) ProbeUDP(targetIP net.IP, r *UDPResult) error {
+	if r.port != 161 && r.service != "snmp" {
+		return nil
+	}
+
+	info, err := p.Query(targetIP, r.port)
+	if err != nil {
+		return err
+	}
+	if r.info == nil {
+		r.info = make(map[string]string)
+	}
+	r.service = "snmp"
+	r.version = strings.Join(info.Versions, ", ")
+	for k, v := range info.System {
+		r.info[k] = v
+	}
+	if len(info.Communities) > 0 {
+		r.info["community"] = strings.Join(info.Communities, ", ")
+	}
+	if info.EngineID != "" {
+		r.info["engine id"] = info.EngineID
+		r.info["engine boots"] = strconv.FormatInt(info.EngineBoots, 10)
+		r.info["engine time"] = strconv.FormatInt(info.EngineTime, 10)
+		if info.Enterprise >= 0 {
+			r.info["engine enterprise"] = strconv.Itoa(info.Enterprise)
+		}
+		if info.EngineData != "" {
+			r.info["engine data"] = info.EngineData
+		}
+	}
+	return nil
+}
+
+// QuerySNMP asks the agent for the system group with the default communities and does the v3 discovery
+func QuerySNMP(targetIP net.IP, port int, timeout time.Duration) (*SNMPInfo, error) {
+	return NewSNMPProbe(timeout).Query(targetIP, port)
+}
+
+func (p *SNMPProbe) Query(targetIP net.IP, port int) (*SNMPInfo, error) {
+	info := &SNMPInfo{
+		System:     make(map[string]string),
+		Enterprise: -1,
+	}
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+
+	versions := make(map[string]bool)
+	for _, community := range p.Communities {
+		for _, version := range []int{snmpV2c, snmpV1} {
+			reqID := rand.Int31()
+			msg, err := p.exchange(addr, snmpGet(version, community, reqID, snmpSystemOIDs), reqID)
+			if err != nil {
+				continue
+			}
+			versions[snmpVersionName(version)] = true
+			if len(info.Communities) == 0 || info.Communities[len(info.Communities)-1] != community {
+				info.Communities = append(info.Communities, community)
+			}
+			for _, vb := range msg.varbinds {
+				if name, ok := snmpOIDNames[vb.oid]; ok {
+					info.System[name] = vb.value.String()
+				}
+			}
+		}
+	}
+
+	reqID := rand.Int31()
+	if msg, err := p.exchange(addr, snmpV3Discovery(reqID), reqID); err == nil {
+		versions["v3"] = true
+		info.EngineID = hex.EncodeToString(msg.engineID)
+		info.EngineBoots = msg.engineBoots
+		info.EngineTime = msg.engineTime
+		info.Enterprise, info.EngineData = parseEngineID(msg.engineID)
+	}
+
+	for _, v := range []string{"v1", "v2c", "v3"} {
+		if versions[v] {
+			info.Versions = append(info.Versions, v)
+		}
+	}
+	if len(info.Versions) == 0 {
+		return nil, fmt.Errorf("No answer from the SNMP agent")
+	}
+	return info, nil
+}
+
+// sends the request and waits for the answer with the same request id, wrong communities are just ignored by the agents
+func (p *SNMPProbe) exchange(addr string, req []byte, reqID int32) (*snmpMessage, error) {
+	c, err := net.DialTimeout("udp", addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	buf := make([]byte, 65535)
+	for try := 0; try <= p.Retries; try++ {
+		if _, err := c.Write(req); err != nil {
+			return nil, err
+		}
+		c.SetReadDeadline(time.Now().Add(p.Timeout))
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				if isTimeout(err) {
+					break
+				}
+				return nil, err
+			}
+			msg, err := parseSNMP(buf[:n])
+			if err != nil || msg.requestID != reqID {
+				continue
+			}
+			if msg.errorStatus != 0 && msg.pduType == snmpGetResponse && len(msg.varbinds) == 0 {
+				return nil, fmt.Errorf("SNMP error status %d", msg.errorStatus)
+			}
+			return msg, nil
+		}
+	}
+	return nil, fmt.Errorf("No SNMP response")
+}
+
+func snmpVersionName(v int) string {
+	switch v {
+	case snmpV1:
+		return "v1"
+	case snmpV2c:
+		return "v2c"
+	case snmpV3:
+		return "v3"
+	}
+	return fmt.Sprintf("unknown (%d)", v)
+}
+
+// snmpGet builds a v1 or v2c GetRequest for the OIDs
+func snmpGet(version int, community string, reqID int32, oids []string) []byte {
+	var varbinds [][]byte
+	for _, oid := range oids {
+		o, err := berEncodeOID(oid)
+		if err != nil {
+			continue
+		}
+		varbinds = append(varbinds, berSeq(berSequence, o, berEncode(berNull, nil)))
+	}
+	pdu := berSeq(snmpGetRequest,
+		berInt(berInteger, int64(reqID)),
+		berInt(berInteger, 0), // error status
+		berInt(berInteger, 0), // error index
+		berSeq(berSequence, varbinds...),
+	)
+	return berSeq(berSequence, berInt(berInteger, int64(version)), berOctets([]byte(community)), pdu)
+}
+
+// an empty v3 GetRequest with the reportable flag, the agent answers with a report that has its engine id, boots and time
+func snmpV3Discovery(reqID int32) []byte {
+	global := berSeq(berSequence,
+		berInt(berInteger, int64(reqID)), // message id
+		berInt(berInteger, 65507),        // max size
+		berOctets([]byte{0x04}),          // reportable, no auth and no priv
+		berInt(berInteger, 3),            // user based security model
+	)
+	security := berSeq(berSequence,
+		berOctets(nil),        // engine id
+		berInt(berInteger, 0), // boots
+		berInt(berInteger, 0), // time
+		berOctets(nil),        // user name
+		berOctets(nil),        // auth params
+		berOctets(nil),        // priv params
+	)
+	pdu := berSeq(snmpGetRequest,
+		berInt(berInteger, int64(reqID)),
+		berInt(berInteger, 0),
+		berInt(berInteger, 0),
+		berSeq(berSequence),
+	)
+	scoped := berSeq(berSequence, berOctets(nil), berOctets(nil), pdu)
+	return berSeq(berSequence, berInt(berInteger, snmpV3), global, berOctets(security), scoped)
+}
+
+type snmpVarbind struct {
+	oid   string
+	value berElement
+}
+
+type snmpMessage struct {
+	version     int
+	community   string
+	pduType     byte
+	requestID   int32
+	errorStatus int
+	varbinds    []snmpVarbind
+
+	// v3 only
+	engineID    []byte
+	engineBoots int64
+	engineTime  int64
+}
+
+func parseSNMP(data []byte) (*snmpMessage, error) {
+	root, _, err := readBER(data)
+	if err != nil {
+		return nil, err
+	}
+	fields, err := root.children()
+	if err != nil {
+		return nil, err
+	}
+	if root.tag != berSequence || len(fields) < 3 || fields[0].tag != berInteger {
+		return nil, fmt.Errorf("Not an SNMP message")
+	}
+	msg := &snmpMessage{version: int(fields[0].int())}
+
+	pduElem := fields[2]
+	if msg.version == snmpV3 {
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("SNMPv3 message truncated")
+		}
+		// the security parameters are a sequence inside of an octet string
+		sec, _, err := readBER(fields[2].value)
+		if err != nil {
+			return nil, err
+		}
+		params, err := sec.children()
+		if err != nil || len(params) < 3 {
+			return nil, fmt.Errorf("Invalid SNMPv3 security parameters")
+		}
+		msg.engineID = params[0].value
+		msg.engineBoots = params[1].int()
+		msg.engineTime = params[2].int()
+
+		// the id of the v3 message is the one we check, the pdu can have another one in reports
+		global, err := fields[1].children()
+		if err != nil || len(global) < 1 {
+			return nil, fmt.Errorf("Invalid SNMPv3 header")
+		}
+		msg.requestID = int32(global[0].int())
+
+		scoped, err := fields[3].children()
+		if err != nil || len(scoped) < 3 {
+			// encrypted, nothing more to read
+			return msg, nil
+		}
+		pduElem = scoped[2]
+	} else {
+		msg.community = string(fields[1].value)
+	}
+
+	msg.pduType = pduElem.tag
+	pdu, err := pduElem.children()
+	if err != nil || len(pdu) < 4 {
+		return nil, fmt.Errorf("Invalid SNMP PDU")
+	}
+	if msg.version != snmpV3 {
+		msg.requestID = int32(pdu[0].int())
+	}
+	msg.errorStatus = int(pdu[1].int())
+
+	varbinds, err := pdu[3].children()
+	if err != nil {
+		return nil, err
+	}
+	for _, vb := range varbinds {
+		pair, err := vb.children()
+		if err != nil || len(pair) != 2 {
+			continue
+		}
+		// noSuchObject and the others are context tagged, they are not values
+		if pair[1].tag&0xc0 == 0x80 {
+			continue
+		}
+		msg.varbinds = append(msg.varbinds, snmpVarbind{oid: pair[0].oid(), value: pair[1]})
+	}
+	return msg, nil
+}
+
+// RFC 3411 engine ids start with the enterprise number with the high bit set and then a format byte
+func parseEngineID(id []byte) (int, string) {
+	if len(id) < 5 || id[0]&0x80 == 0 {
+		return -1, ""
+	}
+	enterprise := int(binary.BigEndian.Uint32(id[0:4]) & 0x7fffffff)
+	data := id[5:]
+	switch id[4] {
+	case 1:
+		if len(data) == 4 {
+			return enterprise, "ip " + net.IP(data).String()
+		}
+	case 2:
+		if len(data) == 16 {
+			return enterprise, "ip " + net.IP(data).String()
+		}
+	case 3:
+		if len(data) == 6 {
+			return enterprise, "mac " + net.HardwareAddr(data).String()
+		}
+	case 4:
+		return enterprise, "text " + string(data)
+	}
+	return enterprise, ""
+}
+
+func (i *SNMPInfo) String() string {
+	s := strings.Join(i.Versions, ", ")
+	if len(i.Communities) > 0 {
+		s += fmt.Sprintf(", communities: %s", strings.Join(i.Communities, ", "))
+	}
+	keys := make([]string, 0, len(i.System))
+	for k := range i.System {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s += fmt.Sprintf("\n  %s: %s", k, i.System[k])
+	}
+	if i.EngineID != "" {
+		s += fmt.Sprintf("\n  engine id: %s, boots: %d, time: %ds", i.EngineID, i.EngineBoots, i.EngineTime)
+		if i.EngineData != "" {
+			s += fmt.Sprintf(" (%s)", i.EngineData)
+		}
+	}
+	return s
+}
@@ -0,0 +1,426 @@
+package portslibK
+
+import (
+	"bufio"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sshMsgKexInit     = 20
+	sshMsgKexECDHInit = 30
+	sshMsgKexECDHRply = 31
+)
+
+// SSHInfo is what the SSH probe found out, the algorithm lists are the ones the server offered in its KEXINIT
+type SSHInfo struct {
+	Banner            string
+	Protocol          string // 2.0, 1.99 means it still does SSH 1 too
+	Software          string
+	Comments          string
+	KexAlgorithms     []string
+	HostKeyAlgorithms []string
+	Ciphers           []string
+	MACs              []string
+	Compression       []string
+	HostKeys          []SSHHostKey
+	Weak              []string // weak algorithms or keys found
+}
+
+type SSHHostKey struct {
+	Type        string
+	Bits        int
+	Fingerprint string // SHA256:base64 like ssh-keygen prints it
+}
+
+// SSHProbe fingerprints SSH servers, it is a PortProbe
+type SSHProbe struct {
+	Timeout time.Duration
+}
+
+// algorithms known to be weak, taken from the usual ssh audit recommendations
+var weakSSHAlgorithms = map[string]bool{
+	"diffie-hellman-group1-sha1":         true,
+	"diffie-hellman-group14-sha1":        true,
+	"diffie-hellman-group-exchange-sha1": true,
+	"ssh-dss":                            true,
+	"ssh-rsa":                            true,
+	"3des-cbc":                           true,
+	"aes128-cbc":                         true,
+	"aes192-cbc":                         true,
+	"aes256-cbc":                         true,
+	"blowfish-cbc":                       true,
+	"cast128-cbc":                        true,
+	"arcfour":                            true,
+	"arcfour128":                         true,
+	"arcfour256":                         true,
+	"rijndael-cbc@lysator.liu.se":        true,
+	"hmac-md5":                           true,
+	"hmac-md5-96":                        true,
+	"hmac-md5-etm@openssh.com":           true,
+	"hmac-md5-96-etm@openssh.com":        true,
+	"hmac-sha1":                          true,
+	"hmac-sha1-96":                       true,
+	"hmac-sha1-etm@openssh.com":          true,
+	"hmac-sha1-96-etm@openssh.com":       true,
+	"umac-64@openssh.com":                true,
+	"umac-64-etm@openssh.com":            true,
+	"hmac-ripemd160":                     true,
+	"hmac-ripemd160@openssh.com":         true,
+	"none":                               true,
+}
+
+// the key exchanges we can do ourselves, we need one of them to get the host keys
+var sshKexCurves = map[string]ecdh.Curve{
+	"curve25519-sha256":            ecdh.X25519(),
+	"curve25519-sha256@libssh.org": ecdh.X25519(),
+	"ecdh-sha2-nistp256":           ecdh.P256(),
+	"ecdh-sha2-nistp384":           ecdh.P384(),
+	"ecdh-sha2-nistp521":           ecdh.P521(),
+}
+
+func NewSSHProbe(timeout time.Duration) *SSHProbe {
+	return &SSHProbe{
+		Timeout: timeout,
+	}
+}
+
+func (p *SSHProbe) Name() string {
+	return "ssh"
+}
+
+func (p *SSHProbe) Probe(targetIP net.IP, r *TCPResult) error {
+	switch {
+	case r.service != nil && r.service.Service == "ssh":
+	case strings.HasPrefix(r.banner, "SSH-"):
+	case r.service == nil && !r.bannerRead && r.port == 22:
+	default:
+		return nil
+	}
+
+	info, err := p.Fingerprint(targetIP, r.port)
+	if err != nil {
+		return err
+	}
+	r.ssh = info
+	return nil
+}
+
+// FingerprintSSH reads the identification and the KEXINIT of the server and does a key exchange per host key type
+func FingerprintSSH(targetIP net.IP, port int, timeout time.Duration) (*SSHInfo, error) {
+	return NewSSHProbe(timeout).Fingerprint(targetIP, port)
+}
+
+func (p *SSHProbe) Fingerprint(targetIP net.IP, port int) (*SSHInfo, error) {
+	info := &SSHInfo{}
+
+	s, err := p.connect(targetIP, port, info)
+	if err != nil {
+		return nil, err
+	}
+	s.c.Close()
+
+	// a key exchange for every kind of host key the server offered, each of them can be a different key
+	var kex string
+	for _, k := range info.KexAlgorithms {
+		if _, ok := sshKexCurves[k]; ok {
+			kex = k
+			break
+		}
+	}
+	if kex != "" {
+		seen := make(map[string]bool)
+		for _, alg := range sshHostKeyTypes(info.HostKeyAlgorithms) {
+			key, err := p.hostKey(targetIP, port, kex, alg)
+			if err != nil || seen[key.Fingerprint] {
+				continue
+			}
+			seen[key.Fingerprint] = true
+			info.HostKeys = append(info.HostKeys, *key)
+			if key.Type == "ssh-rsa" && key.Bits < 2048 {
+				info.Weak = append(info.Weak, fmt.Sprintf("RSA host key of %d bits", key.Bits))
+			}
+		}
+	}
+
+	return info, nil
+}
+
+type sshSession struct {
+	c  net.Conn
+	br *bufio.Reader
+}
+
+// connects, exchanges the identification strings and reads the KEXINIT of the server into info
+func (p *SSHProbe) connect(targetIP net.IP, port int, info *SSHInfo) (*sshSession, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	c, err := net.DialTimeout("tcp", addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(p.Timeout * 3))
+	s := &sshSession{c: c, br: bufio.NewReader(c)}
+
+	// the server can send other lines before the identification
+	for i := 0; ; i++ {
+		line, err := s.br.ReadString('\n')
+		if err != nil || i > 20 {
+			c.Close()
+			return nil, fmt.Errorf("No SSH identification received: %v", err)
+		}
+		if strings.HasPrefix(line, "SSH-") {
+			parseSSHBanner(strings.TrimRight(line, "\r\n"), info)
+			break
+		}
+	}
+
+	if _, err := c.Write([]byte("SSH-2.0-portslibK\r\n")); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	payload, err := s.readPacket()
+	if err != nil || len(payload) == 0 || payload[0] != sshMsgKexInit {
+		c.Close()
+		return nil, fmt.Errorf("No KEXINIT received: %v", err)
+	}
+	if err := parseKexInit(payload, info); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// SSH-protoversion-softwareversion SP comments
+func parseSSHBanner(banner string, info *SSHInfo) {
+	info.Banner = banner
+	rest := strings.TrimPrefix(banner, "SSH-")
+	proto, rest, _ := strings.Cut(rest, "-")
+	software, comments, _ := strings.Cut(rest, " ")
+	info.Protocol = proto
+	info.Software = software
+	info.Comments = comments
+	if strings.HasPrefix(proto, "1.") {
+		info.Weak = append(info.Weak, "SSH protocol "+proto)
+	}
+}
+
+func parseKexInit(payload []byte, info *SSHInfo) error {
+	// message type and the cookie
+	if len(payload) < 17 {
+		return fmt.Errorf("KEXINIT truncated")
+	}
+	data := payload[17:]
+	var lists [10][]string
+	for i := range lists {
+		if len(data) < 4 {
+			return fmt.Errorf("KEXINIT truncated")
+		}
+		l := int(binary.BigEndian.Uint32(data))
+		if len(data) < 4+l {
+			return fmt.Errorf("KEXINIT truncated")
+		}
+		if l > 0 {
+			lists[i] = strings.Split(string(data[4:4+l]), ",")
+		}
+		data = data[4+l:]
+	}
+
+	// client to server and server to client are the same on pretty much every server so only the first ones are kept
+	info.KexAlgorithms = lists[0]
+	info.HostKeyAlgorithms = lists[1]
+	info.Ciphers = lists[2]
+	info.MACs = lists[4]
+	info.Compression = lists[6]
+
+	for _, l := range [][]string{info.KexAlgorithms, info.HostKeyAlgorithms, info.Ciphers, info.MACs} {
+		for _, alg := range l {
+			if weakSSHAlgorithms[alg] {
+				info.Weak = append(info.Weak, alg)
+			}
+		}
+	}
+	return nil
+}
+
+// one algorithm per type of key, rsa-sha2-512, rsa-sha2-256 and ssh-rsa all use the same RSA key
+func sshHostKeyTypes(algs []string) []string {
+	var out []string
+	seen := make(map[string]bool)
+	for _, pref := range []string{"ssh-ed25519", "ecdsa-sha2-nistp256", "ecdsa-sha2-nistp384", "ecdsa-sha2-nistp521", "rsa-sha2-512", "rsa-sha2-256", "ssh-rsa", "ssh-dss"} {
+		for _, a := range algs {
+			if a != pref {
+				continue
+			}
+			family := a
+			if strings.HasPrefix(a, "rsa-sha2-") || a == "ssh-rsa" {
+				family = "rsa"
+			}
+			if !seen[family] {
+				seen[family] = true
+				out = append(out, a)
+			}
+		}
+	}
+	return out
+}
+
+// does the key exchange only until the server sends its host key, nothing gets encrypted
+func (p *SSHProbe) hostKey(targetIP net.IP, port int, kex, hostKeyAlg string) (*SSHHostKey, error) {
+	info := &SSHInfo{}
+	s, err := p.connect(targetIP, port, info)
+	if err != nil {
+		return nil, err
+	}
+	defer s.c.Close()
+
+	// agree on the first of the server's ciphers, we never get to use them anyway
+	first := func(l []string) string {
+		if len(l) == 0 {
+			return "none"
+		}
+		return l[0]
+	}
+	comp := "none"
+	if len(info.Compression) > 0 {
+		comp = info.Compression[0]
+	}
+
+	kexinit := []byte{sshMsgKexInit}
+	cookie := make([]byte, 16)
+	rand.Read(cookie)
+	kexinit = append(kexinit, cookie...)
+	for _, l := range []string{kex, hostKeyAlg, first(info.Ciphers), first(info.Ciphers), first(info.MACs), first(info.MACs), comp, comp, "", ""} {
+		kexinit = sshString(kexinit, []byte(l))
+	}
+	kexinit = append(kexinit, 0, 0, 0, 0, 0)
+	if err := s.writePacket(kexinit); err != nil {
+		return nil, err
+	}
+
+	priv, err := sshKexCurves[kex].GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.writePacket(sshString([]byte{sshMsgKexECDHInit}, priv.PublicKey().Bytes())); err != nil {
+		return nil, err
+	}
+
+	for {
+		payload, err := s.readPacket()
+		if err != nil {
+			return nil, fmt.Errorf("Error reading KEX reply: %v", err)
+		}
+		if len(payload) == 0 || payload[0] != sshMsgKexECDHRply {
+			// ignore and debug messages can come in between
+			continue
+		}
+		blob, _, ok := readSSHString(payload[1:])
+		if !ok {
+			return nil, fmt.Errorf("Invalid KEX reply")
+		}
+		return parseSSHHostKey(blob), nil
+	}
+}
+
+func parseSSHHostKey(blob []byte) *SSHHostKey {
+	sum := sha256.Sum256(blob)
+	key := &SSHHostKey{
+		Fingerprint: "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:]),
+	}
+
+	t, rest, _ := readSSHString(blob)
+	key.Type = string(t)
+	switch {
+	case key.Type == "ssh-rsa":
+		// e and then n
+		_, rest, _ = readSSHString(rest)
+		n, _, _ := readSSHString(rest)
+		key.Bits = new(big.Int).SetBytes(n).BitLen()
+	case key.Type == "ssh-dss":
+		pr, _, _ := readSSHString(rest)
+		key.Bits = new(big.Int).SetBytes(pr).BitLen()
+	case key.Type == "ssh-ed25519":
+		key.Bits = 256
+	case strings.HasPrefix(key.Type, "ecdsa-sha2-nistp"):
+		key.Bits, _ = strconv.Atoi(strings.TrimPrefix(key.Type, "ecdsa-sha2-nistp"))
+	}
+	return key
+}
+
+// binary packet: uint32 length, byte padding length, payload and padding, there's no MAC before NEWKEYS
+func (s *sshSession) readPacket() ([]byte, error) {
+	head := make([]byte, 5)
+	if _, err := io.ReadFull(s.br, head); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(head[:4])
+	if length < 2 || length > 256*1024 {
+		return nil, fmt.Errorf("Invalid SSH packet length %d", length)
+	}
+	rest := make([]byte, length-1)
+	if _, err := io.ReadFull(s.br, rest); err != nil {
+		return nil, err
+	}
+	pad := int(head[4])
+	if pad > len(rest) {
+		return nil, fmt.Errorf("Invalid SSH padding")
+	}
+	return rest[:len(rest)-pad], nil
+}
+
+func (s *sshSession) writePacket(payload []byte) error {
+	pad := 8 - (5+len(payload))%8
+	if pad < 4 {
+		pad += 8
+	}
+	pkt := make([]byte, 5, 5+len(payload)+pad)
+	binary.BigEndian.PutUint32(pkt, uint32(1+len(payload)+pad))
+	pkt[4] = byte(pad)
+	pkt = append(pkt, payload...)
+	pkt = append(pkt, make([]byte, pad)...)
+	_, err := s.c.Write(pkt)
+	return err
+}
+
+func sshString(b, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func readSSHString(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+	l := int(binary.BigEndian.Uint32(b))
+	if len(b) < 4+l {
+		return nil, nil, false
+	}
+	return b[4 : 4+l], b[4+l:], true
+}
+
+func (i *SSHInfo) String() string {
+	s := fmt.Sprintf("protocol %s, %s", i.Protocol, i.Software)
+	if i.Comments != "" {
+		s += " " + i.Comments
+	}
+	s += fmt.Sprintf("\n  kex: %s\n  host key: %s\n  ciphers: %s\n  macs: %s",
+		strings.Join(i.KexAlgorithms, ","), strings.Join(i.HostKeyAlgorithms, ","), strings.Join(i.Ciphers, ","), strings.Join(i.MACs, ","))
+	for _, k := range i.HostKeys {
+		s += fmt.Sprintf("\n  %s %d %s", k.Type, k.Bits, k.Fingerprint)
+	}
+	if len(i.Weak) > 0 {
+		s += fmt.Sprintf("\n  weak: %s", strings.Join(i.Weak, ", "))
+	}
+	return s
+}
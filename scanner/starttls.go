@@ -0,0 +1,278 @@
+package portslibK
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// negotiates the upgrade to TLS on a plain connection, after it returns the next thing on the wire is our client hello
+type startTLSFunc func(c net.Conn, timeout time.Duration) error
+
+var startTLSNegotiators = map[string]startTLSFunc{
+	"smtp":     startTLSSMTP,
+	"imap":     startTLSIMAP,
+	"pop3":     startTLSPOP3,
+	"ftp":      startTLSFTP,
+	"xmpp":     startTLSXMPP,
+	"postgres": startTLSPostgres,
+}
+
+// default ports of the protocols, used when there's no service detected
+var startTLSPorts = map[int]string{
+	21:   "ftp",
+	25:   "smtp",
+	110:  "pop3",
+	143:  "imap",
+	587:  "smtp",
+	5222: "xmpp",
+	5432: "postgres",
+}
+
+// names from the service detection
+var startTLSServices = map[string]string{
+	"ftp":         "ftp",
+	"smtp":        "smtp",
+	"submission":  "smtp",
+	"pop3":        "pop3",
+	"imap":        "imap",
+	"xmpp":        "xmpp",
+	"xmpp-client": "xmpp",
+	"jabber":      "xmpp",
+	"postgresql":  "postgres",
+}
+
+// StartTLS asks the server on the other side of c to switch to TLS, protocol is one of smtp, imap, pop3, ftp, xmpp and postgres
+func StartTLS(c net.Conn, protocol string, timeout time.Duration) error {
+	f, ok := startTLSNegotiators[protocol]
+	if !ok {
+		return fmt.Errorf("No STARTTLS negotiator for %s", protocol)
+	}
+	return f(c, timeout)
+}
+
+// the STARTTLS protocol for the result, empty if the port does not do STARTTLS
+func startTLSProtocol(r *TCPResult) string {
+	if r.service != nil {
+		if r.service.TLS {
+			return ""
+		}
+		return startTLSServices[r.service.Service]
+	}
+	// the banner of the connect scan tells the protocol better than the port number
+	if proto := startTLSFromBanner(r.banner); proto != "" {
+		return proto
+	}
+	return startTLSPorts[r.port]
+}
+
+func startTLSFromBanner(banner string) string {
+	upper := strings.ToUpper(banner)
+	switch {
+	case strings.HasPrefix(upper, "220") && strings.Contains(upper, "SMTP"):
+		return "smtp"
+	case strings.HasPrefix(upper, "220") && strings.Contains(upper, "FTP"):
+		return "ftp"
+	case strings.HasPrefix(upper, "+OK"):
+		return "pop3"
+	case strings.HasPrefix(upper, "* OK"):
+		return "imap"
+	}
+	return ""
+}
+
+// replayConn gives the bytes already read from the connection again before reading on, the banner grab has read the
+// greeting the negotiators start with
+type replayConn struct {
+	net.Conn
+	read []byte
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.read) > 0 {
+		n := copy(b, c.read)
+		c.read = c.read[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// reads until done says the reply is complete, the data is returned even on errors
+func readReply(c net.Conn, timeout time.Duration, done func(string) bool) (string, error) {
+	var reply []byte
+	buf := make([]byte, 2048)
+	c.SetReadDeadline(time.Now().Add(timeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	for len(reply) < 64*1024 {
+		n, err := c.Read(buf)
+		reply = append(reply, buf[:n]...)
+		if done(string(reply)) {
+			return string(reply), nil
+		}
+		if err != nil {
+			return string(reply), fmt.Errorf("Error reading reply: %v", err)
+		}
+	}
+	return string(reply), fmt.Errorf("Reply too long")
+}
+
+// smtp and ftp replies are complete once there is a line with the code followed by a space
+func finalReplyLine(reply string) string {
+	lines := strings.Split(strings.TrimRight(reply, "\r\n"), "\n")
+	if !strings.HasSuffix(reply, "\n") {
+		return ""
+	}
+	last := strings.TrimSpace(lines[len(lines)-1])
+	if (len(last) >= 4 && last[3] == ' ') || len(last) == 3 {
+		return last
+	}
+	return ""
+}
+
+func command(c net.Conn, timeout time.Duration, cmd string, done func(string) bool) (string, error) {
+	c.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := c.Write([]byte(cmd)); err != nil {
+		return "", fmt.Errorf("Error sending %q: %v", strings.TrimSpace(cmd), err)
+	}
+	return readReply(c, timeout, done)
+}
+
+func codeReply(reply string) bool {
+	return finalReplyLine(reply) != ""
+}
+
+func expectCode(reply, code string) error {
+	if last := finalReplyLine(reply); !strings.HasPrefix(last, code) {
+		return fmt.Errorf("Server refused STARTTLS: %s", strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+func startTLSSMTP(c net.Conn, timeout time.Duration) error {
+	greeting, err := readReply(c, timeout, codeReply)
+	if err != nil {
+		return err
+	}
+	if err := expectCode(greeting, "220"); err != nil {
+		return fmt.Errorf("Unexpected SMTP greeting: %s", strings.TrimSpace(greeting))
+	}
+
+	ehlo, err := command(c, timeout, "EHLO portslibk\r\n", codeReply)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(strings.ToUpper(ehlo), "STARTTLS") {
+		return fmt.Errorf("SMTP server does not offer STARTTLS")
+	}
+
+	reply, err := command(c, timeout, "STARTTLS\r\n", codeReply)
+	if err != nil {
+		return err
+	}
+	return expectCode(reply, "220")
+}
+
+func startTLSFTP(c net.Conn, timeout time.Duration) error {
+	greeting, err := readReply(c, timeout, codeReply)
+	if err != nil {
+		return err
+	}
+	if err := expectCode(greeting, "220"); err != nil {
+		return fmt.Errorf("Unexpected FTP greeting: %s", strings.TrimSpace(greeting))
+	}
+
+	reply, err := command(c, timeout, "AUTH TLS\r\n", codeReply)
+	if err != nil {
+		return err
+	}
+	return expectCode(reply, "234")
+}
+
+func startTLSPOP3(c net.Conn, timeout time.Duration) error {
+	line := func(s string) bool { return strings.HasSuffix(s, "\n") }
+
+	greeting, err := readReply(c, timeout, line)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "+OK") {
+		return fmt.Errorf("Unexpected POP3 greeting: %s", strings.TrimSpace(greeting))
+	}
+
+	reply, err := command(c, timeout, "STLS\r\n", line)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(reply, "+OK") {
+		return fmt.Errorf("Server refused STLS: %s", strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+func startTLSIMAP(c net.Conn, timeout time.Duration) error {
+	greeting, err := readReply(c, timeout, func(s string) bool { return strings.HasSuffix(s, "\n") })
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(greeting, "* OK") {
+		return fmt.Errorf("Unexpected IMAP greeting: %s", strings.TrimSpace(greeting))
+	}
+
+	// untagged lines can come before the tagged one
+	reply, err := command(c, timeout, "pk1 STARTTLS\r\n", func(s string) bool {
+		return strings.Contains(s, "pk1 ") && strings.HasSuffix(s, "\n")
+	})
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(reply, "pk1 OK") {
+		return fmt.Errorf("Server refused STARTTLS: %s", strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+func startTLSXMPP(c net.Conn, timeout time.Duration) error {
+	host, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+	stream := fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' "+
+		"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", host)
+
+	features, err := command(c, timeout, stream, func(s string) bool {
+		return strings.Contains(s, "</stream:features>") || strings.Contains(s, "</stream:stream>")
+	})
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(features, "urn:ietf:params:xml:ns:xmpp-tls") {
+		return fmt.Errorf("XMPP server does not offer STARTTLS")
+	}
+
+	reply, err := command(c, timeout, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>", func(s string) bool {
+		return strings.Contains(s, "<proceed") || strings.Contains(s, "<failure")
+	})
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(reply, "<proceed") {
+		return fmt.Errorf("Server refused STARTTLS: %s", strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+// postgres has no greeting, the client sends the SSLRequest and the server answers with a single S or N
+func startTLSPostgres(c net.Conn, timeout time.Duration) error {
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[0:4], 8)
+	binary.BigEndian.PutUint32(req[4:8], 80877103)
+
+	reply, err := command(c, timeout, string(req), func(s string) bool { return len(s) >= 1 })
+	if err != nil {
+		return err
+	}
+	if reply[0] != 'S' {
+		return fmt.Errorf("PostgreSQL server does not support SSL")
+	}
+	return nil
+}
@@ -10,7 +10,6 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/phayes/freeport"
 )
 
@@ -18,14 +17,26 @@ type SynScanner struct {
 	timeout  time.Duration
 	sourceIP net.IP
 	targetIP net.IP
-	port     int   // possibly two options as for single port
-	portR    []int // and for a port range
+	portR    []int // a single port or a port range
 	ifi      *net.Interface
 	options  gopacket.SerializeOptions
+	probes   []PortProbe
+	packetTaps
+
+	batchSize int // Start runs a Sweep when it's set
+
+	tmplMu  sync.Mutex
+	tmpl    *tcpTemplate // the SYN all the probes are copied from
+	tmplMAC net.HardwareAddr
+
+	osDetect     bool // keep the fingerprints of the answers
+	osProbes     bool // and send the extra probes after the scan
+	fpMu         sync.Mutex
+	fingerprints []*TCPFingerprint
 }
 
 func NewSynScanner(timeout time.Duration, targetIP net.IP, portArr []int) (*SynScanner, error) {
-	soureIP, ifi, err := GetSource(targetIP)
+	soureIP, ifi, err := routeSource(targetIP)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating new SYN scanner: %v\n", err)
 	}
@@ -49,14 +60,15 @@ func (s *SynScanner) Scan(port int) (string, error) {
 	var report string
 
 	// log.Printf("Using interface: %s\n", s.ifi.Name)
-	handle, err := pcap.OpenLive(s.ifi.Name, 65535, true, pcap.BlockForever)
+	// a short read timeout so the scan gives up after its own timeout when nothing comes back
+	handle, err := openPacketConn(s.ifi.Name, time.Millisecond*100)
 	if err != nil {
 		return fmt.Sprintf("Could not handle port %d\n", port), err
 	}
 	defer handle.Close()
 
-	// Apply a BPF filter to capture only TCP packets to the target IP and port
-	filter := fmt.Sprintf("tcp and dst host %s and dst port %d", s.targetIP.String(), port)
+	// Apply a BPF filter to capture only TCP packets coming back from the target IP and port
+	filter := fmt.Sprintf("tcp and src host %s and src port %d", s.targetIP.String(), port)
 	if err := handle.SetBPFFilter(filter); err != nil {
 		return fmt.Sprintf("Failed to set BPF filter for port %d\n", port), err
 	}
@@ -67,28 +79,38 @@ func (s *SynScanner) Scan(port int) (string, error) {
 		return fmt.Sprintf("Could not get a free system port\n"), fmt.Errorf("Error getting a free port: %v\n", err)
 	}
 
-	mac, err := s.GetMac() // this keeps timing out
+	// the packets are framed like the link of the handle, loopback and tun have no ethernet header
+	f, err := framingFor(handle.LinkType())
+	if err != nil {
+		return fmt.Sprintf("Could not frame packets on %s\n", s.ifi.Name), err
+	}
+
+	mac, err := s.destMAC(f) // this keeps timing out
 	if err != nil {
 		return "Could not get hardware addr\n", fmt.Errorf("Error getting mac addr: %v\n", err)
 	}
 
 	// build and send the layers as a sigle packet on a network
-	p, err := s.BuildSYNPacket(uint16(srcPort), s.ifi, mac)
+	buf := probeBufs.Get().(*[]byte)
+	defer probeBufs.Put(buf)
+	p, err := s.buildSYN(*buf, f, uint16(srcPort), port, mac)
 	if err != nil {
 		return fmt.Sprintf("Could not build syn packet for port %d\n", port), err
 	}
+	*buf = p
 
 	if err = handle.WritePacketData(p); err != nil {
 		return fmt.Sprintf("Error sending packet data for port %d\n", port), err
 	}
+	s.packetTaps.sent(handle.LinkType(), p, fmt.Sprintf("SYN probe to %s:%d from port %d", s.targetIP, port, srcPort))
 
-	eth := &layers.Ethernet{}
 	ip4 := &layers.IPv4{}
 	tcp := &layers.TCP{}
 	//
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, eth, ip4, tcp)
+	parser := f.parser(ip4, tcp)
 
-	ipFlow := gopacket.NewFlow(layers.EndpointIPv4, s.targetIP, s.sourceIP)
+	// the endpoints are compared as bytes, the decoded addresses are 4 bytes long
+	ipFlow := gopacket.NewFlow(layers.EndpointIPv4, s.targetIP.To4(), s.sourceIP.To4())
 
 	// pSrc := gopacket.NewPacketSource(handle, handle.LinkType())
 	//
@@ -122,13 +144,13 @@ func (s *SynScanner) Scan(port int) (string, error) {
 	// 	break
 	// }
 
-	for {
-		data, _, err := handle.ReadPacketData()
-		if err == pcap.NextErrorTimeoutExpired {
-			// return fmt.Sprintf("Timeout on port %d\n", port), nil
-			log.Printf("Timeout on port %d\n", port)
-			break
-
+	// read until the answer or the timeout, the other packets the filter lets through are skipped
+	linkType := handle.LinkType()
+	deadline := time.Now().Add(s.timeout)
+	for time.Now().Before(deadline) {
+		data, ci, err := handle.ReadPacketData()
+		if err == ErrPacketTimeout {
+			continue
 		} else if err == io.EOF {
 			break
 		} else if err != nil {
@@ -137,46 +159,60 @@ func (s *SynScanner) Scan(port int) (string, error) {
 			continue
 		}
 
-		// decode the packet
+		// decode the packet, a payload after the TCP layer is not an error for us
 		decoded := []gopacket.LayerType{}
-		if err := parser.DecodeLayers(data, &decoded); err != nil {
-			// return fmt.Sprintf("Error decoding packet for port %d\n", port), err
-			log.Printf("Error decoding packet for port %d\n", port)
+		if parser.DecodeLayers(data, &decoded); transportLayer(decoded) != layers.LayerTypeTCP {
+			s.packetTaps.ignored(linkType, ci, data, fmt.Sprintf("not TCP, %s", decodedLayers(decoded)))
+			continue
+		}
+		if ip4.NetworkFlow() != ipFlow {
+			s.packetTaps.ignored(linkType, ci, data, "not from the target")
+			continue
+		}
+		if tcp.DstPort != layers.TCPPort(srcPort) {
+			s.packetTaps.ignored(linkType, ci, data, fmt.Sprintf("to port %d, the probe was sent from %d", tcp.DstPort, srcPort))
 			continue
 		}
 
-		for _, layerType := range decoded {
-			switch layerType {
-			case layers.LayerTypeIPv4:
-				if ip4.NetworkFlow() != ipFlow {
-					continue
-				}
-			case layers.LayerTypeTCP:
-				if tcp.DstPort != layers.TCPPort(srcPort) {
-					continue
-				} else if tcp.SYN && tcp.ACK {
-					report = fmt.Sprintf("Port %d is open on %s\n", port, s.targetIP)
-					log.Printf(report)
-					return report, nil
-				} else if tcp.RST {
-					report = fmt.Sprintf("Port %d is closed on %s\n", port, s.targetIP)
-					log.Printf(report)
-					return report, nil
-				}
-			default:
-				return report, fmt.Errorf("Unexpected layer type: %v\n", layerType)
+		state := synReplyState(tcp)
+		switch state {
+		case "open":
+			s.packetTaps.received(linkType, ci, data, fmt.Sprintf("Reply to the SYN probe to %s:%d: %s", s.targetIP, port, state))
+			if s.osDetect {
+				s.addFingerprint(tcpFingerprint(ip4, tcp, "syn"))
+			}
+			report = fmt.Sprintf("Port %d is open on %s\n", port, s.targetIP)
+			log.Printf(report)
+			if len(s.probes) > 0 {
+				r := &TCPResult{port: port, state: "open"}
+				runProbes(s.targetIP, r, s.probes)
+				report += r.probeReport()
 			}
+			return report, nil
+		case "closed":
+			s.packetTaps.received(linkType, ci, data, fmt.Sprintf("Reply to the SYN probe to %s:%d: %s", s.targetIP, port, state))
+			if s.osDetect {
+				s.addFingerprint(tcpFingerprint(ip4, tcp, "rst"))
+			}
+			report = fmt.Sprintf("Port %d is closed on %s\n", port, s.targetIP)
+			log.Printf(report)
+			return report, nil
+		default:
+			s.packetTaps.ignored(linkType, ci, data, "neither a SYN-ACK nor a RST")
 		}
-		break
-
 	}
 
+	report = fmt.Sprintf("Port %d is %s on %s, no reply\n", port, synNoReply, s.targetIP)
+	log.Printf(report)
 	log.Println("Ending the scan ... ")
 
 	return report, nil
 }
 
 func (s *SynScanner) Start() error {
+	if s.batchSize > 0 {
+		return s.startSweep()
+	}
 	var wg sync.WaitGroup
 
 	// channel for result reports of a scan
@@ -184,28 +220,28 @@ func (s *SynScanner) Start() error {
 
 	// start the scan
 	fmt.Println("Starting ... ")
-	wg.Add(1)
 	for i := 0; i < len(s.portR); i++ {
 		log.Printf("Starting SYN scan on %s:%d from %s\n", s.targetIP.String(), s.portR[i], s.sourceIP.String())
+		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			s.port = s.portR[i] // this is just for the momentarly printing when stop func or so
+			port := s.portR[i]
 			// now run the scan, print results and errors
-			rStr, err := s.Scan(s.port)
+			rStr, err := s.Scan(port)
 			if err != nil {
-				log.Printf("Error in SYN scan on %s:%d -> %v\nRetrying with a whole TCP connect scan\n", s.targetIP.String(), s.port, err)
+				log.Printf("Error in SYN scan on %s:%d -> %v\nRetrying with a whole TCP connect scan\n", s.targetIP.String(), port, err)
 				// retry with tcp connect scan
 				// basically I want to run the syn scanner but if it fails, I want it to retry using the whole tcp connection but
 				// I should have functions for both of them to maybe use a bit different way in goapt
 
 				sm := make(chan struct{}, ulimit())
-				rStr, err = TCPScan(s.targetIP, s.port, sm)
+				r, err := tcpScan(s.targetIP, port, sm, s.probes)
 				if err != nil {
-					log.Printf("Error in TCP scan on %s:%d -> %v\n", s.targetIP.String(), s.port, err)
-					report <- rStr
+					log.Printf("Error in TCP scan on %s:%d -> %v\n", s.targetIP.String(), port, err)
+					report <- ""
 					return
 				}
-				report <- rStr
+				report <- r.MakeReport()
 				return
 			}
 
@@ -223,9 +259,44 @@ func (s *SynScanner) Start() error {
 	for r := range report {
 		fmt.Println(r)
 	}
+
+	s.reportOS()
 	return nil
 }
 
+// the batched scan of Start, the probes run on the open ports once the sweep is done
+func (s *SynScanner) startSweep() error {
+	fmt.Println("Starting ... ")
+	results, err := s.Sweep()
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		if r.state == "open" && len(s.probes) > 0 {
+			runProbes(s.targetIP, r, s.probes)
+		}
+		fmt.Println(r.MakeReport())
+	}
+	s.reportOS()
+	return nil
+}
+
+func (s *SynScanner) reportOS() {
+	if s.osDetect {
+		if s.osProbes {
+			s.runOSProbes()
+		}
+		if guess := s.OSGuess(); guess != nil {
+			fmt.Printf("OS guess for %s: %s\n", s.targetIP, guess)
+		}
+	}
+}
+
+// AddProbe adds a probe that runs against every open port the scanner finds
+func (s *SynScanner) AddProbe(p PortProbe) {
+	s.probes = append(s.probes, p)
+}
+
 func (s *SynScanner) Stop() {
 	log.Printf("Stopping SYN scan on addr %s\n", s.targetIP.String())
 }
@@ -0,0 +1,159 @@
+package portslibK
+
+import (
+	"log"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetTaps is where the raw scanners copy the packets they send and the ones they read, it is embedded in the
+// scanners so the setters are theirs
+type packetTaps struct {
+	recorder *PcapngRecorder
+	tracer   PacketTracer
+}
+
+// SetRecorder tees the packets of the scan into the pcapng recorder, nil turns it off
+func (t *packetTaps) SetRecorder(r *PcapngRecorder) {
+	t.recorder = r
+}
+
+// SetTracer sends a line for every packet sent and read to the tracer, nil turns it off
+func (t *packetTaps) SetTracer(tr PacketTracer) {
+	t.tracer = tr
+}
+
+func (t *packetTaps) on() bool {
+	return t != nil && (t.recorder != nil || t.tracer != nil)
+}
+
+func (t *packetTaps) sent(linkType layers.LinkType, data []byte, comment string) {
+	if !t.on() {
+		return
+	}
+	now := time.Now()
+	if t.tracer != nil {
+		t.tracer.Trace(TraceEvent{Time: now, Sent: true, Summary: packetSummary(linkType, data), Reason: comment})
+	}
+	if t.recorder != nil {
+		if err := t.recorder.Record(linkType, now, data, comment); err != nil {
+			log.Printf("Error recording sent packet: %v\n", err)
+		}
+	}
+}
+
+// a packet the scanner matched to its probe, the comment says what it made of it
+func (t *packetTaps) received(linkType layers.LinkType, ci gopacket.CaptureInfo, data []byte, comment string) {
+	if !t.on() {
+		return
+	}
+	ts := ci.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	if t.tracer != nil {
+		t.tracer.Trace(TraceEvent{Time: ts, Matched: true, Summary: packetSummary(linkType, data), Reason: comment})
+	}
+	if t.recorder != nil {
+		if err := t.recorder.Record(linkType, ts, data, comment); err != nil {
+			log.Printf("Error recording received packet: %v\n", err)
+		}
+	}
+}
+
+// a packet the scanner read and threw away, only the tracer gets those
+func (t *packetTaps) ignored(linkType layers.LinkType, ci gopacket.CaptureInfo, data []byte, reason string) {
+	if t == nil || t.tracer == nil {
+		return
+	}
+	ts := ci.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	t.tracer.Trace(TraceEvent{Time: ts, Summary: packetSummary(linkType, data), Reason: reason})
+}
+
+// the UDP scan goes through a socket so there are no frames, the datagram is put into one of linkType with zero
+// MACs on ethernet. it is the link the raw scanners capture on so the file keeps a single link type, libpcap refuses
+// to read it otherwise
+func (t *packetTaps) sentUDP(linkType layers.LinkType, local, remote net.Addr, payload []byte, comment string) {
+	if !t.on() {
+		return
+	}
+	if data := synthesizeUDP(linkType, local, remote, payload); data != nil {
+		t.sent(linkType, data, comment)
+	}
+}
+
+func (t *packetTaps) receivedUDP(linkType layers.LinkType, local, remote net.Addr, payload []byte, comment string) {
+	if !t.on() {
+		return
+	}
+	if data := synthesizeUDP(linkType, remote, local, payload); data != nil {
+		t.received(linkType, gopacket.CaptureInfo{}, data, comment)
+	}
+}
+
+// the link type a raw scanner gets on the interface of the route to the target, a handle is opened to ask so it is
+// only done when the taps are on. ethernet when there's no handle or the link can't carry a made up frame
+func (t *packetTaps) udpLinkType(targetIP net.IP) layers.LinkType {
+	if !t.on() {
+		return layers.LinkTypeEthernet
+	}
+	_, ifi, err := routeSource(targetIP)
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	handle, err := openPacketConn(ifi.Name, time.Millisecond*100)
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	defer handle.Close()
+
+	f, err := framingFor(handle.LinkType())
+	if err != nil {
+		return layers.LinkTypeEthernet
+	}
+	if _, err := f.header(nil, nil); err != nil {
+		return layers.LinkTypeEthernet
+	}
+	return f.linkType
+}
+
+func synthesizeUDP(linkType layers.LinkType, src, dst net.Addr, payload []byte) []byte {
+	s, ok := src.(*net.UDPAddr)
+	if !ok || s.IP.To4() == nil {
+		return nil
+	}
+	d, ok := dst.(*net.UDPAddr)
+	if !ok || d.IP.To4() == nil {
+		return nil
+	}
+	f, err := framingFor(linkType)
+	if err != nil {
+		return nil
+	}
+
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    s.IP.To4(),
+		DstIP:    d.IP.To4(),
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(s.Port),
+		DstPort: layers.UDPPort(d.Port),
+	}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	data, err := f.serialize(nil, nil, opts, ip, udp, gopacket.Payload(payload))
+	if err != nil {
+		return nil
+	}
+	return data
+}
@@ -15,54 +15,96 @@ import (
 type TCPScanner struct {
 	targetIP net.IP
 	sourceIP net.IP
-	port     int
 	portR    []int
 	timeout  time.Duration
+	probes   []PortProbe
+}
+
+type TCPResult struct {
+	port       int
+	state      string
+	banner     string
+	bannerRead bool // the connect scan waited for the banner, so an empty one means the server does not talk first
+	service    *ServiceInfo
+	http       *HTTPInfo
+	tls        *TLSInfo
+	ssh        *SSHInfo
+	bannerInfo *BannerInfo
+	db         *DBInfo
+	rdp        *RDPInfo
+	vnc        *VNCInfo
+	smb        *SMBInfo
+	ics        *ICSInfo
+	dns        *DNSInfo
+	details    string
 }
 
 func NewTCPScanner(timeout time.Duration, targetIP net.IP, portArr []int) (*TCPScanner, error) {
-	sourceIP, _, err := GetSource(targetIP)
+	sourceIP, _, err := routeSource(targetIP)
 	if err != nil {
 		return nil, fmt.Errorf("Error creating new TCP scanner: %v\n", err)
 	}
 	return &TCPScanner{
 		sourceIP: sourceIP,
 		targetIP: targetIP,
-		// port:     port,
-		portR:   portArr, // possibly port range
-		timeout: timeout,
+		portR:    portArr, // possibly port range
+		timeout:  timeout,
 	}, nil
 }
 
 func TCPScan(targetIP net.IP, port int, semaphore chan struct{}) (string, error) {
+	r, err := tcpScan(targetIP, port, semaphore, nil)
+	if err != nil {
+		return "", err
+	}
+	return r.MakeReport(), nil
+}
+
+func tcpScan(targetIP net.IP, port int, semaphore chan struct{}, probes []PortProbe) (*TCPResult, error) {
 	semaphore <- struct{}{}
 	defer func() { <-semaphore }()
 
-	target := fmt.Sprintf("%s:%d", targetIP.String(), port)
+	result := &TCPResult{
+		port: port,
+	}
+
+	target := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
 	c, err := net.DialTimeout("tcp", target, time.Second*2)
 	if err != nil {
 		if strings.Contains(err.Error(), "too many open files") {
 			time.Sleep(time.Second * 2)
-			TCPScan(targetIP, port, semaphore)
-		} else {
-			fmt.Println("TCP - Port", port, "closed on", targetIP.String())
-			return "", fmt.Errorf("Error dialing to port %d: %v\n", port, err)
+			return tcpScan(targetIP, port, semaphore, probes)
 		}
+		fmt.Println("TCP - Port", port, "closed on", targetIP.String())
+		result.state = "closed"
+		return result, fmt.Errorf("Error dialing to port %d: %v\n", port, err)
 	}
 
 	defer c.Close()
 
+	result.state = "open"
 	fmt.Printf("TCP - Port %d is open on %s\n", port, targetIP.String())
 
-	h, err := getPortHeader(c)
-	if err != nil || h == "" {
+	err = getPortHeader(c, result)
+	if h := strings.TrimSpace(result.banner); err != nil || h == "" {
 		// return fmt.Errorf("Error getinng port header: %v\n", err)
 		fmt.Printf("\nCouldn't get the header for port %d on %s: %v\n", port, targetIP.String(), err)
 	} else {
 		fmt.Printf("\nHeader for port %d on %s: %s\n", port, targetIP.String(), h)
 	}
-	return fmt.Sprintf("TCP scan went succesfully\n"), nil
+	if result.tls != nil {
+		fmt.Printf("TLS for port %d on %s: %s\n", port, targetIP.String(), result.tls)
+	}
+	// the probes make their own connections
+	c.Close()
 
+	runProbes(targetIP, result, probes)
+	return result, nil
+}
+
+// AddProbe adds a probe that runs against every open port the scanner finds
+func (s *TCPScanner) AddProbe(p PortProbe) {
+	s.probes = append(s.probes, p)
 }
 
 func (s *TCPScanner) Start() error {
@@ -71,17 +113,17 @@ func (s *TCPScanner) Start() error {
 	report := make(chan string, len(s.portR))
 
 	fmt.Println("Starting TCP scanner...")
-	wg.Add(1)
 
 	for i := 0; i < len(s.portR); i++ {
 		log.Printf("Starting TCP scan on %s:%d from %s\n", s.targetIP.String(), s.portR[i], s.sourceIP.String())
+		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			s.port = s.portR[i]
+			port := s.portR[i]
 
-			rStr, err := s.Scan(s.port)
+			rStr, err := s.Scan(port)
 			if err != nil {
-				log.Printf("Error in TCP scan on %s:%d -> %v\n", s.targetIP.String(), s.port, err)
+				log.Printf("Error in TCP scan on %s:%d -> %v\n", s.targetIP.String(), port, err)
 			}
 			report <- rStr
 			return
@@ -106,21 +148,91 @@ func (s *TCPScanner) Stop() {
 }
 func (s *TCPScanner) Scan(port int) (string, error) {
 	semaphore := make(chan struct{}, ulimit())
-	return TCPScan(s.targetIP, port, semaphore)
+	r, err := tcpScan(s.targetIP, port, semaphore, s.probes)
+	if err != nil {
+		return "", err
+	}
+	return r.MakeReport(), nil
 }
 
-func getPortHeader(c net.Conn) (string, error) {
+// reads the banner into r, the ports that upgrade with STARTTLS are upgraded on the same connection after it for the
+// certificate and the negotiated cipher. Not every server offers the upgrade, then r just has no TLS
+func getPortHeader(c net.Conn, r *TCPResult) error {
+	b, err := readBanner(c)
+	r.banner = string(b)
+	r.bannerRead = err == nil
+	if err != nil {
+		return err
+	}
+
+	if proto := startTLSProtocol(r); proto != "" {
+		if info, err := startTLSInfo(&replayConn{Conn: c, read: b}, proto, time.Second*3); err == nil {
+			r.tls = info
+		}
+	}
+	return nil
+}
+
+// reads whatever the server sends first, a timeout just means it has nothing to say
+func readBanner(c net.Conn) ([]byte, error) {
 	buf := make([]byte, 2048)
 	c.SetReadDeadline(time.Now().Add(time.Second * 3))
 
 	n, err := c.Read(buf)
-	if err != nil && err != io.EOF {
-		return "", fmt.Errorf("Error reading to buffer")
+	if err != nil && err != io.EOF && !isTimeout(err) {
+		return nil, fmt.Errorf("Error reading to buffer")
 	}
 
-	h := strings.TrimSpace(string(buf[:n]))
+	return buf[:n], nil
+}
+
+func (r *TCPResult) MakeReport() string {
+	return fmt.Sprintf("\nPort %d: %s%s", r.port, r.state, r.probeReport())
+}
 
-	return h, nil
+// everything the probes found, without the port state
+func (r *TCPResult) probeReport() string {
+	var report string
+	if h := strings.TrimSpace(r.banner); h != "" {
+		report = fmt.Sprintf("%s\nBanner: %s", report, h)
+	}
+	if r.service != nil {
+		report = fmt.Sprintf("%s\nService: %s", report, r.service)
+	}
+	if r.bannerInfo != nil {
+		report = fmt.Sprintf("%s\nProtocol: %s", report, r.bannerInfo)
+	}
+	if r.db != nil {
+		report = fmt.Sprintf("%s\nDatabase: %s", report, r.db)
+	}
+	if r.http != nil {
+		report = fmt.Sprintf("%s\nHTTP: %s", report, r.http)
+	}
+	if r.tls != nil {
+		report = fmt.Sprintf("%s\nTLS: %s", report, r.tls)
+	}
+	if r.ssh != nil {
+		report = fmt.Sprintf("%s\nSSH: %s", report, r.ssh)
+	}
+	if r.rdp != nil {
+		report = fmt.Sprintf("%s\nRDP: %s", report, r.rdp)
+	}
+	if r.vnc != nil {
+		report = fmt.Sprintf("%s\nVNC: %s", report, r.vnc)
+	}
+	if r.smb != nil {
+		report = fmt.Sprintf("%s\nSMB: %s", report, r.smb)
+	}
+	if r.ics != nil {
+		report = fmt.Sprintf("%s\nICS: %s", report, r.ics)
+	}
+	if r.dns != nil {
+		report = fmt.Sprintf("%s\nDNS: %s", report, r.dns)
+	}
+	if r.details != "" {
+		report = fmt.Sprintf("%s\nDetails: %s", report, strings.TrimSpace(r.details))
+	}
+	return report
 }
 
 func getProtocol(c net.Conn, ip net.IP, port int) (string, error) {
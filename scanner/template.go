@@ -0,0 +1,151 @@
+package portslibK
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tcpTemplate is a TCP probe serialized once by gopacket. A probe is a copy of it with the target and the ports put in
+// and the checksums updated for just those words (RFC 1624), so building one allocates nothing
+type tcpTemplate struct {
+	frame    []byte
+	linkType layers.LinkType // the framing it was built for
+	ip       int             // offset of the IP header
+	tcp      int             // and of the TCP one
+	ipSum    uint16
+	tcpSum   uint16
+	dst      [2]uint16 // the words of the destination address in the template
+	srcPort  uint16
+	dstPort  uint16
+}
+
+// newTCPTemplate serializes the IP and TCP layers with the header of the link in front
+func newTCPTemplate(f linkFraming, src, dst net.HardwareAddr, ip4 *layers.IPv4, tcp *layers.TCP) (*tcpTemplate, error) {
+	tcp.SetNetworkLayerForChecksum(ip4)
+	frame, err := f.serialize(src, dst, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ip4, tcp)
+	if err != nil {
+		return nil, fmt.Errorf("Error building TCP template: %v", err)
+	}
+
+	ip := f.size
+	if len(frame) < ip+20 || frame[ip]>>4 != 4 {
+		return nil, fmt.Errorf("Error building TCP template: no IPv4 header at %d", ip)
+	}
+	t := &tcpTemplate{frame: frame, linkType: f.linkType, ip: ip, tcp: ip + int(frame[ip]&0x0f)*4}
+	if len(frame) < t.tcp+20 {
+		return nil, fmt.Errorf("Error building TCP template: frame of %d bytes", len(frame))
+	}
+
+	t.ipSum = binary.BigEndian.Uint16(frame[ip+10:])
+	t.tcpSum = binary.BigEndian.Uint16(frame[t.tcp+16:])
+	t.dst[0] = binary.BigEndian.Uint16(frame[ip+16:])
+	t.dst[1] = binary.BigEndian.Uint16(frame[ip+18:])
+	t.srcPort = binary.BigEndian.Uint16(frame[t.tcp:])
+	t.dstPort = binary.BigEndian.Uint16(frame[t.tcp+2:])
+	return t, nil
+}
+
+// size is how big the buffer of packet has to be
+func (t *tcpTemplate) size() int {
+	return len(t.frame)
+}
+
+// buf when it's big enough for the probe, a new one otherwise
+func (t *tcpTemplate) buffer(buf []byte) []byte {
+	if cap(buf) < len(t.frame) {
+		return make([]byte, len(t.frame))
+	}
+	return buf
+}
+
+// the buffers the scans write their probe into. The probe is written out before the scan goes on, so the buffer
+// goes back right after and the next scan uses it again
+var probeBufs = sync.Pool{New: func() any { return new([]byte) }}
+
+// packet writes the probe for the target and ports into buf and returns it
+func (t *tcpTemplate) packet(buf []byte, dst net.IP, srcPort, dstPort uint16) []byte {
+	p := buf[:len(t.frame)]
+	copy(p, t.frame)
+
+	ipSum, tcpSum := t.ipSum, t.tcpSum
+	if d := dst.To4(); d != nil {
+		for i := 0; i < 2; i++ {
+			w := uint16(d[2*i])<<8 | uint16(d[2*i+1])
+			// the address is in the IP header and in the pseudo header of the TCP checksum
+			ipSum = csumReplace(ipSum, t.dst[i], w)
+			tcpSum = csumReplace(tcpSum, t.dst[i], w)
+			binary.BigEndian.PutUint16(p[t.ip+16+2*i:], w)
+		}
+	}
+	tcpSum = csumReplace(tcpSum, t.srcPort, srcPort)
+	tcpSum = csumReplace(tcpSum, t.dstPort, dstPort)
+	binary.BigEndian.PutUint16(p[t.tcp:], srcPort)
+	binary.BigEndian.PutUint16(p[t.tcp+2:], dstPort)
+
+	binary.BigEndian.PutUint16(p[t.ip+10:], ipSum)
+	binary.BigEndian.PutUint16(p[t.tcp+16:], tcpSum)
+	return p
+}
+
+// the checksum after a 16 bit word of what it covers went from old to new, eqn. 3 of RFC 1624
+func csumReplace(sum, old, new uint16) uint16 {
+	s := uint32(^sum) + uint32(^old) + uint32(new)
+	s = (s & 0xffff) + (s >> 16)
+	s = (s & 0xffff) + (s >> 16)
+	return ^uint16(s)
+}
+
+// the SYN template of the scanner for the framing and the MAC of the target, built on the first probe
+func (s *SynScanner) synTemplate(f linkFraming, mac net.HardwareAddr) (*tcpTemplate, error) {
+	s.tmplMu.Lock()
+	defer s.tmplMu.Unlock()
+	if s.tmpl != nil && s.tmpl.linkType == f.linkType && bytes.Equal(s.tmplMAC, mac) {
+		return s.tmpl, nil
+	}
+
+	ipLayer, tcpLayer := s.synLayers(0)
+	t, err := newTCPTemplate(f, s.ifi.HardwareAddr, mac, &ipLayer, &tcpLayer)
+	if err != nil {
+		return nil, err
+	}
+	s.tmpl, s.tmplMAC = t, mac
+	return t, nil
+}
+
+// the ACK probe for the framing, the same for every port apart from the destination
+func (s *ACKScanner) template(f linkFraming) (*tcpTemplate, error) {
+	s.tmplMu.Lock()
+	defer s.tmplMu.Unlock()
+	if s.tmpl != nil && s.tmpl.linkType == f.linkType {
+		return s.tmpl, nil
+	}
+
+	ip4 := layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		IHL:      5,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    s.sourceIP,
+		DstIP:    s.targetIP,
+	}
+
+	tcp := layers.TCP{
+		SrcPort: layers.TCPPort(s.sourcePort),
+		Seq:     0,
+		ACK:     true,
+		Window:  14600,
+	}
+
+	t, err := newTCPTemplate(f, s.ifi.HardwareAddr, net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, &ip4, &tcp)
+	if err != nil {
+		return nil, err
+	}
+	s.tmpl = t
+	return t, nil
+}
@@ -0,0 +1,155 @@
+package portslibK
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func benchACKScanner(t testing.TB) *ACKScanner {
+	s := &ACKScanner{
+		sourceIP:   net.IPv4(127, 0, 0, 1),
+		targetIP:   net.IPv4(203, 0, 113, 1),
+		sourcePort: 54321,
+		ifi:        &net.Interface{Name: "lo", HardwareAddr: net.HardwareAddr{2, 0, 0, 0, 0, 1}},
+	}
+	if _, err := s.template(ethernetFraming(t)); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// the RST a host answers the ACK probe with
+func ackReply(t testing.TB, s *ACKScanner, port int) []byte {
+	eth := layers.Ethernet{SrcMAC: net.HardwareAddr{2, 0, 0, 0, 0, 2}, DstMAC: s.ifi.HardwareAddr, EthernetType: layers.EthernetTypeIPv4}
+	ip4 := layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: s.targetIP, DstIP: s.sourceIP}
+	tcp := layers.TCP{SrcPort: layers.TCPPort(port), DstPort: layers.TCPPort(s.sourcePort), RST: true, Window: 0}
+	tcp.SetNetworkLayerForChecksum(&ip4)
+
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, &eth, &ip4, &tcp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// building a probe from a template into a buffer of the caller allocates nothing
+func TestTemplateAllocs(t *testing.T) {
+	syn, err := benchScanner().synTemplate(ethernetFraming(t), net.HardwareAddr{2, 0, 0, 0, 0, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack := benchACKScanner(t).tmpl
+	dst := net.IPv4(203, 0, 113, 1)
+
+	for name, tmpl := range map[string]*tcpTemplate{"syn": syn, "ack": ack} {
+		buf := make([]byte, tmpl.size())
+		port := uint16(0)
+		if n := testing.AllocsPerRun(1000, func() {
+			port++
+			tmpl.packet(buf, dst, 40000, port)
+		}); n != 0 {
+			t.Errorf("%s: %v allocs per probe", name, n)
+		}
+	}
+
+	// and the scanners build theirs into the buffer they are given
+	s, a := benchScanner(), benchACKScanner(t)
+	f, mac := ethernetFraming(t), net.HardwareAddr{2, 0, 0, 0, 0, 2}
+	buf := make([]byte, syn.size())
+	if n := testing.AllocsPerRun(1000, func() { s.buildSYN(buf, f, 40000, 22, mac) }); n != 0 {
+		t.Errorf("buildSYN: %v allocs per probe", n)
+	}
+	if n := testing.AllocsPerRun(1000, func() { a.buildPacket(buf, f, 22) }); n != 0 {
+		t.Errorf("buildPacket: %v allocs per probe", n)
+	}
+}
+
+// the ACK probe from the template is the one the layers serialize to
+func TestACKTemplate(t *testing.T) {
+	s := benchACKScanner(t)
+	for _, port := range []int{1, 80, 65535} {
+		p, err := s.buildPacket(nil, ethernetFraming(t), port)
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet := gopacket.NewPacket(p, layers.LayerTypeEthernet, gopacket.Default)
+		if err := packet.ErrorLayer(); err != nil {
+			t.Fatalf("port %d: %v", port, err.Error())
+		}
+		tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+		ip4, _ := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if tcp == nil || int(tcp.DstPort) != port || !tcp.ACK || !ip4.DstIP.Equal(s.targetIP) {
+			t.Fatalf("port %d: got %v", port, packet)
+		}
+
+		// the checksums gopacket computes for the same packet
+		tcp.SetNetworkLayerForChecksum(ip4)
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializePacket(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, packet); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf.Bytes()) != string(p) {
+			t.Errorf("port %d:\ngot  %x\nwant %x", port, p, buf.Bytes())
+		}
+	}
+}
+
+func BenchmarkSYNBuild(b *testing.B) {
+	s := benchScanner()
+	mac := net.HardwareAddr{2, 0, 0, 0, 0, 2}
+
+	b.Run("gopacket", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := gopacketSYN(s, 40000, 1+i%65535, mac); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("template", func(b *testing.B) {
+		tmpl, err := s.synTemplate(ethernetFraming(b), mac)
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf := make([]byte, tmpl.size())
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			tmpl.packet(buf, s.targetIP, 40000, uint16(1+i%65535))
+		}
+	})
+}
+
+// decoding the RST to an ACK probe the way listen did before and the way it does now
+func BenchmarkACKDecode(b *testing.B) {
+	s := benchACKScanner(b)
+	data := ackReply(b, s, 80)
+
+	b.Run("NewPacket", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+			tcp, _ := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+			if tcp == nil || ackReplyState(tcp) != AckUnfiltered {
+				b.Fatal("not decoded")
+			}
+		}
+	})
+	b.Run("DecodingLayerParser", func(b *testing.B) {
+		ip4 := &layers.IPv4{}
+		tcp := &layers.TCP{}
+		icmp := &layers.ICMPv4{}
+		payload := &gopacket.Payload{}
+		parser := ethernetFraming(b).parser(ip4, tcp, icmp, payload)
+		decoded := make([]gopacket.LayerType, 0, 4)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			parser.DecodeLayers(data, &decoded)
+			if transportLayer(decoded) != layers.LayerTypeTCP || ackReplyState(tcp) != AckUnfiltered {
+				b.Fatal("not decoded")
+			}
+		}
+	})
+}
@@ -0,0 +1,384 @@
+package portslibK
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CertInfo is the interesting part of a certificate from the chain
+type CertInfo struct {
+	Subject     string
+	Issuer      string
+	SANs        []string
+	NotBefore   time.Time
+	NotAfter    time.Time
+	Expired     bool
+	SelfSigned  bool
+	KeyType     string // RSA 2048, ECDSA P-256, Ed25519
+	SigAlg      string
+	Fingerprint string // sha256 of the DER
+}
+
+// TLSInfo is what the handshakes with a port found out
+type TLSInfo struct {
+	Version      string              // negotiated by a handshake offering TLS 1.0 to 1.3 and every suite crypto/tls has
+	CipherSuite  string              // same as above
+	Certificates []CertInfo          // leaf first and then the rest of the chain as the server sent it
+	Versions     []string            // every protocol version the server accepted
+	CipherSuites map[string][]string // accepted suites per version, TLS 1.3 only has the negotiated one as crypto/tls can't pick them
+	JA3S         string              // version,cipher,extensions from the server hello
+	JA3SHash     string
+	StartTLS     string // protocol used to upgrade the connection, empty when the port speaks TLS right away
+}
+
+// TLSProbe inspects the TLS of open ports, it is a PortProbe
+type TLSProbe struct {
+	Timeout    time.Duration
+	ServerName string // SNI to send, none by default as we only know the IP
+	Ciphers    bool   // enumerate the accepted cipher suites, that is a handshake per suite
+}
+
+var tlsVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// ports the probe tries even if the service detection did not say it's TLS
+var tlsPorts = map[int]bool{443: true, 465: true, 636: true, 853: true, 989: true, 990: true, 992: true, 993: true, 994: true, 995: true, 3389: true, 5061: true, 5986: true, 6697: true, 8443: true, 9443: true}
+
+func NewTLSProbe(timeout time.Duration) *TLSProbe {
+	return &TLSProbe{
+		Timeout: timeout,
+		Ciphers: true,
+	}
+}
+
+func (p *TLSProbe) Name() string {
+	return "tls"
+}
+
+func (p *TLSProbe) Probe(targetIP net.IP, r *TCPResult) error {
+	proto := startTLSProtocol(r)
+	if proto == "" {
+		if r.service != nil && !r.service.TLS && r.service.Service != "ssl" && r.service.Service != "tls" {
+			return nil
+		}
+		if r.service == nil && !tlsPorts[r.port] {
+			return nil
+		}
+	}
+
+	info, err := p.inspect(targetIP, r.port, proto)
+	if err != nil {
+		return err
+	}
+	r.tls = info
+	return nil
+}
+
+// InspectTLS does the handshakes with the default settings of the probe
+func InspectTLS(targetIP net.IP, port int, timeout time.Duration) (*TLSInfo, error) {
+	return NewTLSProbe(timeout).Inspect(targetIP, port)
+}
+
+func (p *TLSProbe) Inspect(targetIP net.IP, port int) (*TLSInfo, error) {
+	return p.inspect(targetIP, port, "")
+}
+
+// InspectStartTLS is Inspect for ports that need to be upgraded first, see StartTLS for the protocols
+func (p *TLSProbe) InspectStartTLS(targetIP net.IP, port int, protocol string) (*TLSInfo, error) {
+	return p.inspect(targetIP, port, protocol)
+}
+
+func (p *TLSProbe) inspect(targetIP net.IP, port int, proto string) (*TLSInfo, error) {
+	info := &TLSInfo{
+		CipherSuites: make(map[string][]string),
+		StartTLS:     proto,
+	}
+
+	// first the default handshake for the chain, the negotiated parameters and the server hello
+	conn, rec, err := p.handshake(targetIP, port, proto, p.config(0, nil))
+	if err != nil {
+		return nil, fmt.Errorf("Error in TLS handshake: %v", err)
+	}
+	info.negotiated(conn.ConnectionState(), rec)
+	conn.Close()
+
+	for _, v := range tlsVersions {
+		conn, _, err := p.handshake(targetIP, port, proto, p.config(v, nil))
+		if err != nil {
+			continue
+		}
+		suite := conn.ConnectionState().CipherSuite
+		conn.Close()
+
+		name := tls.VersionName(v)
+		info.Versions = append(info.Versions, name)
+		if v == tls.VersionTLS13 || !p.Ciphers {
+			info.CipherSuites[name] = []string{tls.CipherSuiteName(suite)}
+			continue
+		}
+		info.CipherSuites[name] = p.enumerateCiphers(targetIP, port, proto, v)
+	}
+
+	return info, nil
+}
+
+// the chain, the negotiated parameters and the JA3S of the default handshake
+func (info *TLSInfo) negotiated(state tls.ConnectionState, rec *recordingConn) {
+	info.Version = tls.VersionName(state.Version)
+	info.CipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	for _, c := range state.PeerCertificates {
+		info.Certificates = append(info.Certificates, certInfo(c))
+	}
+	if ja3s, err := parseJA3S(rec.Bytes()); err == nil {
+		info.JA3S = ja3s
+		sum := md5.Sum([]byte(ja3s))
+		info.JA3SHash = hex.EncodeToString(sum[:])
+	}
+}
+
+// a handshake for every suite crypto/tls implements for the version, the ones it does not implement can't be found this way
+func (p *TLSProbe) enumerateCiphers(targetIP net.IP, port int, proto string, version uint16) []string {
+	var accepted []string
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, s := range suites {
+		supported := false
+		for _, v := range s.SupportedVersions {
+			if v == version {
+				supported = true
+			}
+		}
+		if !supported {
+			continue
+		}
+		conn, _, err := p.handshake(targetIP, port, proto, p.config(version, []uint16{s.ID}))
+		if err != nil {
+			continue
+		}
+		conn.Close()
+		accepted = append(accepted, s.Name)
+	}
+	return accepted
+}
+
+// version 0 means the default ones, nil suites means all of them
+func (p *TLSProbe) config(version uint16, suites []uint16) *tls.Config {
+	if suites == nil {
+		suites = allCipherSuites()
+	}
+	cfg := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         p.ServerName,
+		CipherSuites:       suites,
+	}
+	if version != 0 {
+		cfg.MinVersion = version
+		cfg.MaxVersion = version
+	} else {
+		cfg.MinVersion = tls.VersionTLS10
+	}
+	return cfg
+}
+
+// every suite crypto/tls implements. The default list leaves out RSA key exchange, 3DES, RC4 and CBC-SHA256, the old
+// servers the version check is looking for would fail the handshake with it
+func allCipherSuites() []uint16 {
+	var ids []uint16
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids = append(ids, s.ID)
+	}
+	return ids
+}
+
+// proto is the STARTTLS protocol, every handshake needs a new connection so the upgrade is done for each of them
+func (p *TLSProbe) handshake(targetIP net.IP, port int, proto string, cfg *tls.Config) (*tls.Conn, *recordingConn, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	c, err := net.DialTimeout("tcp", addr, p.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	if proto != "" {
+		if err := StartTLS(c, proto, p.Timeout); err != nil {
+			c.Close()
+			return nil, nil, err
+		}
+	}
+
+	conn, rec, err := p.clientHandshake(c, cfg)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return conn, rec, nil
+}
+
+func (p *TLSProbe) clientHandshake(c net.Conn, cfg *tls.Config) (*tls.Conn, *recordingConn, error) {
+	rec := &recordingConn{Conn: c}
+	conn := tls.Client(rec, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	defer cancel()
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, nil, err
+	}
+	return conn, rec, nil
+}
+
+// upgrades c with the STARTTLS of proto and does the default handshake on it, that's how the banner grab gets the
+// certificate of the mail and FTP ports. The versions and the suites are left to the probe, they need more connections
+func startTLSInfo(c net.Conn, proto string, timeout time.Duration) (*TLSInfo, error) {
+	if err := StartTLS(c, proto, timeout); err != nil {
+		return nil, err
+	}
+	p := &TLSProbe{Timeout: timeout}
+	conn, rec, err := p.clientHandshake(c, p.config(0, nil))
+	if err != nil {
+		return nil, fmt.Errorf("Error in TLS handshake: %v", err)
+	}
+
+	info := &TLSInfo{
+		CipherSuites: make(map[string][]string),
+		StartTLS:     proto,
+	}
+	info.negotiated(conn.ConnectionState(), rec)
+	return info, nil
+}
+
+// recordingConn keeps the first bytes read so the server hello can be parsed after the handshake
+type recordingConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if c.buf.Len() < 32*1024 {
+		c.buf.Write(b[:n])
+	}
+	return n, err
+}
+
+func (c *recordingConn) Bytes() []byte {
+	return c.buf.Bytes()
+}
+
+// JA3S is "version,cipher,extension-extension..." taken from the server hello in decimal
+func parseJA3S(data []byte) (string, error) {
+	// collect the handshake records as the server hello can be split into more of them
+	var hs []byte
+	for len(data) >= 5 && data[0] == 0x16 {
+		l := int(binary.BigEndian.Uint16(data[3:5]))
+		if len(data) < 5+l {
+			break
+		}
+		hs = append(hs, data[5:5+l]...)
+		data = data[5+l:]
+	}
+	if len(hs) < 4 || hs[0] != 0x02 {
+		return "", fmt.Errorf("No server hello")
+	}
+	l := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3])
+	if len(hs) < 4+l {
+		return "", fmt.Errorf("Server hello truncated")
+	}
+	hello := hs[4 : 4+l]
+
+	// version, random and the session id
+	if len(hello) < 35 {
+		return "", fmt.Errorf("Server hello too short")
+	}
+	version := binary.BigEndian.Uint16(hello[0:2])
+	off := 34 + 1 + int(hello[34])
+	if len(hello) < off+3 {
+		return "", fmt.Errorf("Server hello too short")
+	}
+	cipher := binary.BigEndian.Uint16(hello[off : off+2])
+	off += 3 // cipher and compression
+
+	var exts []string
+	if len(hello) >= off+2 {
+		end := off + 2 + int(binary.BigEndian.Uint16(hello[off:off+2]))
+		off += 2
+		for off+4 <= end && off+4 <= len(hello) {
+			exts = append(exts, strconv.Itoa(int(binary.BigEndian.Uint16(hello[off:off+2]))))
+			off += 4 + int(binary.BigEndian.Uint16(hello[off+2:off+4]))
+		}
+	}
+
+	return fmt.Sprintf("%d,%d,%s", version, cipher, strings.Join(exts, "-")), nil
+}
+
+func certInfo(c *x509.Certificate) CertInfo {
+	sum := sha256.Sum256(c.Raw)
+	info := CertInfo{
+		Subject:     c.Subject.String(),
+		Issuer:      c.Issuer.String(),
+		NotBefore:   c.NotBefore,
+		NotAfter:    c.NotAfter,
+		Expired:     time.Now().After(c.NotAfter),
+		SelfSigned:  bytes.Equal(c.RawSubject, c.RawIssuer) && c.CheckSignature(c.SignatureAlgorithm, c.RawTBSCertificate, c.Signature) == nil,
+		SigAlg:      c.SignatureAlgorithm.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
+
+	info.SANs = append(info.SANs, c.DNSNames...)
+	for _, ip := range c.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	info.SANs = append(info.SANs, c.EmailAddresses...)
+
+	switch k := c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		info.KeyType = fmt.Sprintf("RSA %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		info.KeyType = fmt.Sprintf("ECDSA %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		info.KeyType = "Ed25519"
+	default:
+		info.KeyType = c.PublicKeyAlgorithm.String()
+	}
+	return info
+}
+
+func (i *TLSInfo) String() string {
+	s := fmt.Sprintf("%s %s", i.Version, i.CipherSuite)
+	if len(i.Versions) > 0 {
+		s += fmt.Sprintf(", versions: %s", strings.Join(i.Versions, ", "))
+	}
+	if i.StartTLS != "" {
+		s += fmt.Sprintf(" (%s STARTTLS)", i.StartTLS)
+	}
+	for _, v := range i.Versions {
+		if suites := i.CipherSuites[v]; len(suites) > 0 {
+			s += fmt.Sprintf("\n  %s ciphers: %s", v, strings.Join(suites, ", "))
+		}
+	}
+	for n, c := range i.Certificates {
+		s += fmt.Sprintf("\n  cert %d: %s, issuer: %s, %s, expires %s", n, c.Subject, c.Issuer, c.KeyType, c.NotAfter.Format(time.DateOnly))
+		if len(c.SANs) > 0 {
+			s += fmt.Sprintf(", SANs: %s", strings.Join(c.SANs, ", "))
+		}
+		if c.Expired {
+			s += " (EXPIRED)"
+		}
+		if c.SelfSigned {
+			s += " (self signed)"
+		}
+	}
+	if i.JA3S != "" {
+		s += fmt.Sprintf("\n  JA3S: %s (%s)", i.JA3SHash, i.JA3S)
+	}
+	return s
+}
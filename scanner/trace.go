@@ -0,0 +1,120 @@
+package portslibK
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PacketTracer gets every packet the raw scanners send and read, set it with SetTracer on the scanner
+type PacketTracer interface {
+	Trace(e TraceEvent)
+}
+
+// TraceEvent is a single packet of the trace
+type TraceEvent struct {
+	Time    time.Time
+	Sent    bool
+	Matched bool   // a read packet the scanner took as the answer, the others were ignored
+	Summary string // the packet on one line, like tcpdump does
+	Reason  string // the probe it was sent for or why it was matched or ignored
+}
+
+// TextTracer writes the events as lines, like
+// 12:00:00.000001 SENT TCP 10.0.0.9:40000 > 10.0.0.5:80 [S] seq=1 ack=0 win=1024 ttl=64 id=1 len=0 (SYN probe to 10.0.0.5:80 from port 40000)
+type TextTracer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewTextTracer(w io.Writer) *TextTracer {
+	return &TextTracer{w: w}
+}
+
+func (t *TextTracer) Trace(e TraceEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fmt.Fprintln(t.w, e.String())
+}
+
+func (e TraceEvent) String() string {
+	dir := "IGNR"
+	if e.Sent {
+		dir = "SENT"
+	} else if e.Matched {
+		dir = "RCVD"
+	}
+	s := fmt.Sprintf("%s %s %s", e.Time.Format("15:04:05.000000"), dir, e.Summary)
+	if e.Reason != "" {
+		s += fmt.Sprintf(" (%s)", e.Reason)
+	}
+	return s
+}
+
+// the fields that matter for a scan in a line, the rest of the packet is left out
+func packetSummary(linkType layers.LinkType, data []byte) string {
+	packet := gopacket.NewPacket(data, linkType, gopacket.Default)
+
+	if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		if arp.Operation == layers.ARPReply {
+			return fmt.Sprintf("ARP reply %s is-at %s", net.IP(arp.SourceProtAddress), net.HardwareAddr(arp.SourceHwAddress))
+		}
+		return fmt.Sprintf("ARP who-has %s tell %s", net.IP(arp.DstProtAddress), net.IP(arp.SourceProtAddress))
+	}
+
+	ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		var names []string
+		for _, l := range packet.Layers() {
+			names = append(names, l.LayerType().String())
+		}
+		return fmt.Sprintf("%s len=%d", strings.Join(names, "/"), len(data))
+	}
+	ipFields := fmt.Sprintf("ttl=%d id=%d", ip4.TTL, ip4.Id)
+	if ip4.Flags&layers.IPv4DontFragment != 0 {
+		ipFields += " df"
+	}
+
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		return fmt.Sprintf("TCP %s:%d > %s:%d [%s] seq=%d ack=%d win=%d %s len=%d", ip4.SrcIP, tcp.SrcPort, ip4.DstIP, tcp.DstPort,
+			tcpFlagLetters(tcp), tcp.Seq, tcp.Ack, tcp.Window, ipFields, len(tcp.Payload))
+	}
+	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		return fmt.Sprintf("UDP %s:%d > %s:%d %s len=%d", ip4.SrcIP, udp.SrcPort, ip4.DstIP, udp.DstPort, ipFields, len(udp.Payload))
+	}
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		s := fmt.Sprintf("ICMP %s > %s %s %s", ip4.SrcIP, ip4.DstIP, icmp.TypeCode, ipFields)
+		// what the unreachable is about
+		inner := gopacket.NewPacket(icmp.Payload, layers.LayerTypeIPv4, gopacket.Default)
+		if innerIP, ok := inner.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+			if srcPort, port, ok := innerPorts(innerIP); ok {
+				s += fmt.Sprintf(" for %s %s:%d > %s:%d", innerIP.Protocol, innerIP.SrcIP, srcPort, innerIP.DstIP, port)
+			}
+		}
+		return s
+	}
+	return fmt.Sprintf("IP %s > %s proto=%s %s len=%d", ip4.SrcIP, ip4.DstIP, ip4.Protocol, ipFields, len(ip4.Payload))
+}
+
+// the flags like tcpdump prints them, S for SYN, . for ACK and so on
+func tcpFlagLetters(tcp *layers.TCP) string {
+	var s string
+	for _, f := range []struct {
+		set    bool
+		letter string
+	}{{tcp.SYN, "S"}, {tcp.FIN, "F"}, {tcp.RST, "R"}, {tcp.PSH, "P"}, {tcp.URG, "U"}, {tcp.ECE, "E"}, {tcp.CWR, "W"}, {tcp.ACK, "."}} {
+		if f.set {
+			s += f.letter
+		}
+	}
+	if s == "" {
+		return "none"
+	}
+	return s
+}
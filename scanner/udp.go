@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -13,16 +15,20 @@ type UDPScanner struct {
 	targetIP net.IP
 	timeout  time.Duration
 	portR    []int
-	port     int
 	results  chan UDPResult
 	// results []UDPResult
+	payloads *PayloadRegistry
+	probes   []UDPProbe
+	packetTaps
 }
 
 type UDPResult struct {
 	port    int
 	state   string
+	service string
 	version string
 	details string
+	info    map[string]string // structured data parsed from the response
 }
 
 func NewUDPScanner(timeout time.Duration, targetIP net.IP, portArr []int) (*UDPScanner, error) {
@@ -31,24 +37,30 @@ func NewUDPScanner(timeout time.Duration, targetIP net.IP, portArr []int) (*UDPS
 		portR:    portArr,
 		timeout:  timeout,
 		results:  make(chan UDPResult),
+		payloads: NewPayloadRegistry(DefaultPayloads), // own payloads first, defaults otherwise
 	}, nil
 }
 
+// Payloads returns the registry of this scanner, payloads registered there are used only by this scanner
+func (s *UDPScanner) Payloads() *PayloadRegistry {
+	return s.payloads
+}
+
 func (s *UDPScanner) Start() error {
 	log.Println("Starting UDP scanner...")
 	var wg sync.WaitGroup
 
 	report := make(chan string, len(s.portR))
 
-	wg.Add(1)
 	for i := 0; i < len(s.portR); i++ {
 		log.Printf("Starting UDP scan on %s:%d\n", s.targetIP.String(), s.portR[i])
+		wg.Add(1)
 		go func(i int) {
 			defer wg.Done()
-			s.port = s.portR[i]
-			r, err := s.Scan(s.port)
+			port := s.portR[i]
+			r, err := s.Scan(port)
 			if err != nil {
-				log.Printf("Error in UDP scan on %s:%d -> %v\n", s.targetIP.String(), s.port, err)
+				log.Printf("Error in UDP scan on %s:%d -> %v\n", s.targetIP.String(), port, err)
 			}
 
 			report <- r
@@ -74,19 +86,83 @@ func (s *UDPScanner) Stop() {
 }
 
 func (s *UDPScanner) Scan(port int) (string, error) {
-	r, err := UDPScan(s.targetIP, port, s.timeout)
+	r, err := udpScan(s.targetIP, port, s.timeout, s.payloads, &s.packetTaps)
+	if r.state != "closed" {
+		runUDPProbes(s.targetIP, r, s.probes)
+	}
 	report := r.MakeReport()
 	return report, err
 }
 
+// AddProbe adds a probe that runs against every port the scanner did not find closed
+func (s *UDPScanner) AddProbe(p UDPProbe) {
+	s.probes = append(s.probes, p)
+}
+
 func UDPScan(targetIP net.IP, port int, timeout time.Duration) (*UDPResult, error) {
+	return udpScan(targetIP, port, timeout, DefaultPayloads, nil)
+}
+
+// taps can be nil, otherwise the datagrams are recorded in frames of the link the raw scanners use, see sentUDP
+func udpScan(targetIP net.IP, port int, timeout time.Duration, payloads *PayloadRegistry, taps *packetTaps) (*UDPResult, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+
+	result, err := udpProbe(targetIP, port, timeout, payloads, taps)
+	if !udpTimedOut(err) {
+		return result, err
+	}
+	// Did not get a response so it shall retry once and afterwards either determine correctly or return open|filtered
+	log.Printf("Got no response, on %s retrying...\n", addr)
+	result, err = udpProbe(targetIP, port, timeout, payloads, taps)
+	if !udpTimedOut(err) {
+		return result, err
+	}
+
+	result.state = udpNoReply // did not get a response so cannot determine whether it is actually closed
+	result.details = fmt.Sprintf("No response received on port: %d", port)
+	log.Printf("%s is %s ... trying ACK Scan to determine\n", addr, result.state)
+
+	// TODO
+	// or I could make a map with port and its result.state and also make a count for open|filtered and if there's more than 1 of them, I would make an ACK scanner and range over those ports to scan for firewalls to determine between open and filtered
+
+	// now try again using ACK scan to determine if it is open or filtered
+	ackS, err := NewACKScanner(targetIP, []int{port})
+	if err != nil {
+		result.details = fmt.Sprintf("%s\n-> Error after creating ACK Scanner: %v\n", result.details, err)
+		return result, err
+	}
+	if taps != nil {
+		ackS.packetTaps = *taps
+	}
+	ackS.timeout = timeout
+	r, err := ackS.Scan(port)
+	if err != nil {
+		result.details = fmt.Sprintf("%s -> Error after trying ACK Scan: %v\n", result.details, err)
+		return result, err
+	}
+	if r == string(AckUnfiltered) {
+		result.details = fmt.Sprintf("%s\nACK Scan details: Port %d: %s -> %s\n", result.details, port, result.state, AckOpen)
+		result.state = string(AckOpen)
+	} else {
+		result.details = fmt.Sprintf("%s\nACK Scan details: Port %d: %s -> %s\n", result.details, port, result.state, AckFiltered)
+		result.state = string(AckFiltered)
+	}
+	return result, nil
+}
+
+func udpTimedOut(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// a single datagram and the wait for its answer, a timeout comes back as the read error
+func udpProbe(targetIP net.IP, port int, timeout time.Duration, payloads *PayloadRegistry, taps *packetTaps) (*UDPResult, error) {
 	result := &UDPResult{
 		port: port,
 	}
-	var ofCount int = 0
 
-	addr := fmt.Sprintf("%s:%d", targetIP.String(), port)
-	c, err := net.DialTimeout("udp", addr, timeout)
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	c, err := dialUDP("udp", addr, timeout)
 	if err != nil {
 		result.state = "closed"
 		result.details = fmt.Sprintf("Error dialing %s: %v", addr, err)
@@ -94,7 +170,8 @@ func UDPScan(targetIP net.IP, port int, timeout time.Duration) (*UDPResult, erro
 	}
 	defer c.Close()
 
-	p := fetchPayload(port)
+	p := payloads.Fetch(targetIP, port)
+	linkType := taps.udpLinkType(targetIP)
 
 	_, err = c.Write(p)
 	if err != nil {
@@ -102,59 +179,43 @@ func UDPScan(targetIP net.IP, port int, timeout time.Duration) (*UDPResult, erro
 		result.details = fmt.Sprintf("Error writing to %s: %v", addr, err)
 		return result, err
 	}
+	taps.sentUDP(linkType, c.LocalAddr(), c.RemoteAddr(), p, fmt.Sprintf("UDP probe to %s", addr))
 
 	c.SetReadDeadline(time.Now().Add(timeout))
 	buf := make([]byte, 1024)
 	n, err := c.Read(buf)
 	if err != nil {
-		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			// Did not get a response so it shall retry and afterwards either determine correctly or return open|filtered
-			log.Printf("Got no response, on %s retrying...\n", addr)
-			_, err := UDPScan(targetIP, port, timeout)
-			if err != nil {
-				result.state = "open|filtered" // did not get a response so cannot determine whether it is actually closed
-				ofCount++                      // adding to open|filtered count
-				result.details = fmt.Sprintf("No response received on port: %d", port)
-				log.Printf("%s is %s ... trying ACK Scan to determine\n", addr, result.state)
-				// return result, fmt.Errorf(result.details)
-
-				// TODO
-				// now try again using ACK scan to determine if it is open or filtered
-				// or I could make a map with port and its result.state and also make a count for open|filtered and if there's more than 1 of them, I would make an ACK scanner and range over those ports to scan for firewalls to determine between open and filtered
-
-				ackS, err := NewACKScanner(targetIP, []int{port})
-				if err != nil {
-					result.details = fmt.Sprintf("%s\n-> Error after creating ACK Scanner: %v\n", result.details, err)
-					return result, err
-				}
-				// ackS.targetPort = port
-				r, err := ackS.Scan(port)
-				if err != nil {
-					result.details = fmt.Sprintf("%s -> Error after trying ACK Scan: %v\n", result.details, err)
-					return result, err
-				}
-				// result.details = fmt.Sprintf("%s\nACK Scan detail: Port %d is %s\n", result.details, port, r)
-				if r == string(AckUnfiltered) {
-					result.details = fmt.Sprintf("%s\nACK Scan details: Port %d: %s -> %s\n", result.details, port, result.state, AckOpen)
-					result.state = string(AckOpen)
-				} else {
-					result.details = fmt.Sprintf("%s\nACK Scan details: Port %d: %s -> %s\n", result.details, port, result.state, AckFiltered)
-					result.state = string(AckFiltered)
-				}
-				return result, nil
-			}
+		if udpTimedOut(err) {
+			return result, err
 		}
+		// the ICMP port unreachable comes back as connection refused
 		result.state = "closed"
 		result.details = fmt.Sprintf("Error reading from %s: %v", addr, err)
 		return result, fmt.Errorf(result.details)
 	}
 
+	taps.receivedUDP(linkType, c.LocalAddr(), c.RemoteAddr(), buf[:n], fmt.Sprintf("Reply to the UDP probe to %s: open", addr))
 	result.state = "open"
 	result.details = fmt.Sprintf("Received %d bytes from %s", n, addr)
+	decodeUDPResponse(port, buf[:n], result)
 
 	return result, nil
 }
 
 func (r *UDPResult) MakeReport() string {
-	return fmt.Sprintf("\nPort %d: %s\nDetails: %s", r.port, r.state, r.details)
+	report := fmt.Sprintf("\nPort %d: %s", r.port, r.state)
+	if r.service != "" {
+		report = fmt.Sprintf("%s\nService: %s %s", report, r.service, r.version)
+	}
+	report = fmt.Sprintf("%s\nDetails: %s", report, r.details)
+
+	keys := make([]string, 0, len(r.info))
+	for k := range r.info {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		report = fmt.Sprintf("%s\n  %s: %s", report, k, r.info[k])
+	}
+	return report
 }
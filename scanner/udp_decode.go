@@ -0,0 +1,291 @@
+package portslibK
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// udpDecoder parses the response from a port and fills the service, version and info of the result
+type udpDecoder func(data []byte, r *UDPResult) error
+
+// names of the system OIDs so the report is readable
+var snmpOIDNames = map[string]string{
+	"1.3.6.1.2.1.1.1.0": "sysDescr",
+	"1.3.6.1.2.1.1.2.0": "sysObjectID",
+	"1.3.6.1.2.1.1.3.0": "sysUpTime",
+	"1.3.6.1.2.1.1.5.0": "sysName",
+}
+
+var udpDecoders = map[int]udpDecoder{
+	53:    decodeDNS,
+	123:   decodeNTP,
+	137:   decodeNetBIOS,
+	161:   decodeSNMP,
+	443:   decodeQUIC,
+	1900:  decodeSSDP,
+	5683:  decodeCoAP,
+	11211: decodeMemcached,
+	47808: decodeBACnet,
+}
+
+// decodes the response if there's a decoder for the port, the result is left as is otherwise
+func decodeUDPResponse(port int, data []byte, r *UDPResult) {
+	d, ok := udpDecoders[port]
+	if !ok {
+		return
+	}
+	if r.info == nil {
+		r.info = make(map[string]string)
+	}
+	if err := d(data, r); err != nil {
+		r.details = fmt.Sprintf("%s (could not parse the response: %v)", r.details, err)
+	}
+}
+
+func decodeDNS(data []byte, r *UDPResult) error {
+	dns := &layers.DNS{}
+	if err := dns.DecodeFromBytes(data, gopacket.NilDecodeFeedback); err != nil {
+		return err
+	}
+	r.service = "domain"
+	r.info["rcode"] = dns.ResponseCode.String()
+	r.info["recursion available"] = fmt.Sprintf("%t", dns.RA)
+
+	for _, a := range dns.Answers {
+		if a.Type == layers.DNSTypeTXT && strings.EqualFold(string(a.Name), "version.bind") && len(a.TXTs) > 0 {
+			r.version = string(bytes.Join(a.TXTs, []byte(" ")))
+		}
+	}
+	return nil
+}
+
+func decodeNTP(data []byte, r *UDPResult) error {
+	info, err := parseNTP(data)
+	if err != nil {
+		return err
+	}
+	info.fill(r)
+	return nil
+}
+
+func decodeSNMP(data []byte, r *UDPResult) error {
+	msg, err := parseSNMP(data)
+	if err != nil {
+		return err
+	}
+	r.service = "snmp"
+	r.version = snmpVersionName(msg.version)
+	if msg.version == snmpV3 {
+		r.info["engine id"] = fmt.Sprintf("%x", msg.engineID)
+		return nil
+	}
+	r.info["community"] = msg.community
+	for _, vb := range msg.varbinds {
+		name := vb.oid
+		if n, ok := snmpOIDNames[name]; ok {
+			name = n
+		}
+		r.info[name] = vb.value.String()
+	}
+	return nil
+}
+
+func decodeNetBIOS(data []byte, r *UDPResult) error {
+	// header is 12 bytes and then the name from the question which is either a pointer or the encoded name
+	off := 12
+	if len(data) <= off {
+		return fmt.Errorf("NetBIOS response too short")
+	}
+	if data[off]&0xc0 == 0xc0 {
+		off += 2
+	} else {
+		for off < len(data) && data[off] != 0 {
+			off += int(data[off]) + 1
+		}
+		off++
+	}
+	// type, class, ttl and rdlength
+	off += 10
+	if len(data) <= off {
+		return fmt.Errorf("NetBIOS response truncated")
+	}
+
+	count := int(data[off])
+	off++
+	r.service = "netbios-ns"
+
+	var names []string
+	for i := 0; i < count && off+18 <= len(data); i++ {
+		entry := data[off : off+18]
+		off += 18
+
+		name := strings.TrimSpace(string(entry[:15]))
+		suffix := entry[15]
+		group := binary.BigEndian.Uint16(entry[16:18])&0x8000 != 0
+		names = append(names, fmt.Sprintf("%s<%02x>", name, suffix))
+
+		if suffix == 0x00 {
+			if group {
+				r.info["workgroup"] = name
+			} else {
+				r.info["name"] = name
+			}
+		}
+	}
+	r.info["names"] = strings.Join(names, ", ")
+
+	if off+6 <= len(data) {
+		r.info["mac"] = net.HardwareAddr(data[off : off+6]).String()
+	}
+	return nil
+}
+
+func decodeSSDP(data []byte, r *UDPResult) error {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	r.service = "ssdp"
+	r.version = resp.Header.Get("Server")
+	for _, h := range []string{"Location", "ST", "USN"} {
+		if v := resp.Header.Get(h); v != "" {
+			r.info[strings.ToLower(h)] = v
+		}
+	}
+	return nil
+}
+
+func decodeMemcached(data []byte, r *UDPResult) error {
+	// skip the frame header of the UDP protocol
+	if len(data) < 8 {
+		return fmt.Errorf("Memcached response too short")
+	}
+	line := strings.TrimSpace(string(data[8:]))
+	if !strings.HasPrefix(line, "VERSION ") {
+		return fmt.Errorf("Unexpected memcached response: %q", line)
+	}
+	r.service = "memcached"
+	r.version = strings.TrimPrefix(line, "VERSION ")
+	return nil
+}
+
+func decodeCoAP(data []byte, r *UDPResult) error {
+	if len(data) < 4 || data[0]>>6 != 1 {
+		return fmt.Errorf("Not a CoAP message")
+	}
+	r.service = "coap"
+	code := data[1]
+	r.info["code"] = fmt.Sprintf("%d.%02d", code>>5, code&0x1f)
+
+	// skip the token and the options, the payload is after the 0xff marker
+	off := 4 + int(data[0]&0x0f)
+	for off < len(data) && data[off] != 0xff {
+		delta, l := int(data[off]>>4), int(data[off]&0x0f)
+		off++
+		for _, v := range []*int{&delta, &l} {
+			switch *v {
+			case 13:
+				if off >= len(data) {
+					return fmt.Errorf("CoAP option truncated")
+				}
+				*v = int(data[off]) + 13
+				off++
+			case 14:
+				if off+2 > len(data) {
+					return fmt.Errorf("CoAP option truncated")
+				}
+				*v = int(binary.BigEndian.Uint16(data[off:])) + 269
+				off += 2
+			case 15:
+				return fmt.Errorf("Invalid CoAP option")
+			}
+		}
+		off += l
+	}
+	if off >= len(data) {
+		return nil
+	}
+
+	// link format, </path>;attr=...,</other>
+	var resources []string
+	for _, link := range strings.Split(string(data[off+1:]), ",") {
+		path, _, _ := strings.Cut(link, ";")
+		path = strings.Trim(strings.TrimSpace(path), "<>")
+		if path != "" {
+			resources = append(resources, path)
+		}
+	}
+	r.info["resources"] = strings.Join(resources, ", ")
+	return nil
+}
+
+var bacnetSegmentation = map[byte]string{0: "both", 1: "transmit", 2: "receive", 3: "none"}
+
+// the I-Am answer to the Who-Is, the NPDU can have the source network if the device is behind a router
+func decodeBACnet(data []byte, r *UDPResult) error {
+	if len(data) < 6 || data[0] != 0x81 {
+		return fmt.Errorf("Not a BACnet/IP message")
+	}
+	r.service = "bacnet"
+
+	npdu := data[4:]
+	if npdu[0] != 0x01 {
+		return fmt.Errorf("Unknown NPDU version %d", npdu[0])
+	}
+	control := npdu[1]
+	off := 2
+	if control&0x20 != 0 { // destination
+		if off+3 > len(npdu) {
+			return fmt.Errorf("NPDU truncated")
+		}
+		off += 3 + int(npdu[off+2])
+	}
+	if control&0x08 != 0 { // source
+		if off+3 > len(npdu) {
+			return fmt.Errorf("NPDU truncated")
+		}
+		r.info["source network"] = fmt.Sprintf("%d", binary.BigEndian.Uint16(npdu[off:]))
+		off += 3 + int(npdu[off+2])
+	}
+	if control&0x20 != 0 {
+		off++ // hop count
+	}
+	apdu := npdu[min(off, len(npdu)):]
+	if len(apdu) < 2 || apdu[0] != 0x10 || apdu[1] != 0x00 {
+		return fmt.Errorf("Not an I-Am")
+	}
+
+	// object id, max APDU, segmentation and vendor id, all application tagged
+	var values []uint32
+	tags := apdu[2:]
+	for len(tags) > 0 && len(values) < 4 {
+		l := int(tags[0] & 0x07)
+		if len(tags) < 1+l || l > 4 {
+			return fmt.Errorf("I-Am truncated")
+		}
+		var v uint32
+		for _, b := range tags[1 : 1+l] {
+			v = v<<8 | uint32(b)
+		}
+		values = append(values, v)
+		tags = tags[1+l:]
+	}
+	if len(values) < 4 {
+		return fmt.Errorf("I-Am truncated")
+	}
+	r.info["device instance"] = fmt.Sprintf("%d", values[0]&0x3fffff)
+	r.info["max apdu"] = fmt.Sprintf("%d", values[1])
+	r.info["segmentation"] = bacnetSegmentation[byte(values[2])]
+	r.info["vendor id"] = fmt.Sprintf("%d", values[3])
+	return nil
+}
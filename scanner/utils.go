@@ -7,17 +7,9 @@ import (
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/google/gopacket/routing"
 )
 
-// Popular UDP payloads
-var PortPayloads = map[int][]byte{
-	53:  []byte("\x00\x01\x00\x00\x00\x00\x00\x00"),                             // DNS query payload
-	123: []byte("\x1b\x00\x00\x00\x00\x00\x00\x00\x00\x00"),                     // NTP client request
-	161: []byte("\x30\x26\x02\x01\x00\x04\x06\x70\x75\x62\x6c\x69\x63\xa0\x19"), // SNMP get request
-}
-
 type ACKState string
 
 const (
@@ -28,18 +20,11 @@ const (
 )
 
 func GetSource(target net.IP) (net.IP, *net.Interface, error) {
-	// conn, err := net.Dial("udp", fmt.Sprintf("%s:80", target.String()))
-	// if err != nil {
-	// 	return nil, nil, fmt.Errorf("Error getting source IP: %v\n", err)
-	// }
-	// defer conn.Close()
-	//
-	// localAddr := conn.LocalAddr().(*net.UDPAddr)
-	// ifi, err := net.InterfaceByName(localAddr.Network())
-	// if err != nil {
-	// 	return nil, nil, fmt.Errorf("Error couldn't get the net interface: %v\n", err)
-	// }
-	// return localAddr.IP, ifi, nil
+	// the kernel picks the route first, the router of gopacket doesn't take the longest prefix nor read the local
+	// table so it sends 127.0.0.1 and the subnet of a tun interface out the default route
+	if srcIP, ifi, err := kernelRoute(target); err == nil {
+		return srcIP, ifi, nil
+	}
 
 	router, err := routing.New()
 	if err != nil {
@@ -52,6 +37,33 @@ func GetSource(target net.IP) (net.IP, *net.Interface, error) {
 	return srcIP, ifi, nil
 }
 
+// connecting a UDP socket sends nothing, it only gets the source address the kernel would use
+func kernelRoute(target net.IP) (net.IP, *net.Interface, error) {
+	conn, err := net.Dial("udp4", net.JoinHostPort(target.String(), "9"))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	srcIP := conn.LocalAddr().(*net.UDPAddr).IP
+
+	ifis, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range ifis {
+		addrs, err := ifis[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok && n.IP.Equal(srcIP) {
+				return srcIP.To4(), &ifis[i], nil
+			}
+		}
+	}
+	return nil, nil, fmt.Errorf("no interface has the address %s", srcIP)
+}
+
 func checksum(data []byte) uint16 {
 	var sum uint32
 
@@ -71,6 +83,18 @@ func checksum(data []byte) uint16 {
 	// return uint16(^sum)
 }
 
+// the MAC the frames go to, nil when there is nothing to ask. Only ethernet has one and the loopback takes any
+func (s *SynScanner) destMAC(f linkFraming) (net.HardwareAddr, error) {
+	if !f.ethernet() {
+		return nil, nil
+	}
+	if s.ifi.Flags&net.FlagLoopback != 0 {
+		return nil, nil
+	}
+	return s.GetMac()
+}
+
+// GetMac asks for the MAC of the target with ARP, it fails on links without ethernet headers
 func (s *SynScanner) GetMac() (net.HardwareAddr, error) {
 	var destARP net.IP
 
@@ -82,11 +106,14 @@ func (s *SynScanner) GetMac() (net.HardwareAddr, error) {
 
 	destARP = s.targetIP
 
-	handle, err := pcap.OpenLive(s.ifi.Name, 65535, true, pcap.BlockForever)
+	handle, err := openPacketConn(s.ifi.Name, time.Millisecond*100)
 	if err != nil {
 		return nil, err
 	}
 	defer handle.Close()
+	if handle.LinkType() != layers.LinkTypeEthernet {
+		return nil, fmt.Errorf("Error sending ARP request: %s is a %s link and ARP needs ethernet\n", s.ifi.Name, handle.LinkType())
+	}
 
 	start := time.Now()
 
@@ -118,14 +145,15 @@ func (s *SynScanner) GetMac() (net.HardwareAddr, error) {
 	if err = handle.WritePacketData(buf.Bytes()); err != nil {
 		return nil, err
 	}
+	s.packetTaps.sent(handle.LinkType(), buf.Bytes(), fmt.Sprintf("ARP request for %s", destARP))
 
 	// wait for an arp reply for a done time
 	for {
 		if time.Since(start) > time.Second*5 {
 			return nil, fmt.Errorf("Timeout reached getting ARP reply\n")
 		}
-		data, _, err := handle.ReadPacketData()
-		if err == pcap.NextErrorTimeoutExpired {
+		data, ci, err := handle.ReadPacketData()
+		if err == ErrPacketTimeout {
 			continue
 		} else if err != nil {
 			return nil, err
@@ -135,23 +163,11 @@ func (s *SynScanner) GetMac() (net.HardwareAddr, error) {
 		if arpLayer := p.Layer(layers.LayerTypeARP); arpLayer != nil {
 			arp := arpLayer.(*layers.ARP)
 			if net.IP(arp.SourceProtAddress).Equal(destARP) {
+				s.packetTaps.received(handle.LinkType(), ci, data, fmt.Sprintf("ARP reply for %s", destARP))
 				return net.HardwareAddr(arp.SourceHwAddress), nil
 			}
 		}
+		s.packetTaps.ignored(handle.LinkType(), ci, data, fmt.Sprintf("not the ARP reply for %s", destARP))
 
 	}
 }
-
-// FetchPayload fetches the predefined payload for a specific port
-func fetchPayload(port int) []byte {
-	if p, ok := PortPayloads[port]; ok {
-		return p
-	}
-	// default to empty payload if there's no predefined one
-	return []byte{}
-}
-
-// UpdatePayload allows adding or updating a payload for a specific port
-func UpdatePayload(port int, payload []byte) {
-	PortPayloads[port] = payload
-}
@@ -0,0 +1,815 @@
+package portslibK
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// VirtualNetwork is an ethernet segment in memory with fake hosts on it. After Install the scanners send and read
+// through it instead of pcap and the kernel, so their logic can run without privileges and gives the same answer every time
+type VirtualNetwork struct {
+	mu       sync.Mutex
+	ip       net.IP
+	ifi      *net.Interface
+	hosts    map[string]*VirtualHost
+	conns    map[*virtualConn]bool
+	udp      map[int]*virtualUDPConn // the sockets dialUDP opened, by local port
+	nextPort int
+	loss     float64
+	sends    map[string]uint64 // how many times each lossKey was put on the network
+	latency  time.Duration
+	linkType layers.LinkType // what the conns see, the hosts always talk ethernet
+}
+
+// VirtualHost answers the probes like a host with the ports set on it would, the ports that are not set are closed
+type VirtualHost struct {
+	mu      sync.Mutex
+	ip      net.IP
+	mac     net.HardwareAddr
+	tcp     map[int]string
+	udp     map[int]string
+	replies map[int][]byte // what the open UDP ports answer, nothing when nil
+	reject  bool           // filtered ports answer with ICMP admin prohibited instead of nothing
+	noPing  bool
+
+	// the TCP/IP stack of the host, what the OS fingerprinting looks at
+	ttl     uint8
+	window  uint16
+	df      bool
+	options []layers.TCPOption
+}
+
+// NewVirtualNetwork makes an empty network with the scanner at ip on the virt0 interface
+func NewVirtualNetwork(ip net.IP) *VirtualNetwork {
+	return &VirtualNetwork{
+		ip: ip.To4(),
+		ifi: &net.Interface{
+			Index:        1,
+			MTU:          1500,
+			Name:         "virt0",
+			HardwareAddr: net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01},
+			Flags:        net.FlagUp | net.FlagBroadcast,
+		},
+		hosts:    make(map[string]*VirtualHost),
+		conns:    make(map[*virtualConn]bool),
+		udp:      make(map[int]*virtualUDPConn),
+		nextPort: 40000,
+		sends:    make(map[string]uint64),
+		linkType: layers.LinkTypeEthernet,
+	}
+}
+
+// AddHost puts a host on the network, it answers like a Linux box with all ports closed until they are set
+func (n *VirtualNetwork) AddHost(ip net.IP) *VirtualHost {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ip = ip.To4()
+	h := &VirtualHost{
+		ip:      ip,
+		mac:     net.HardwareAddr{0x02, 0x00, ip[0], ip[1], ip[2], ip[3]},
+		tcp:     make(map[int]string),
+		udp:     make(map[int]string),
+		replies: make(map[int][]byte),
+		ttl:     64,
+		window:  64240,
+		df:      true,
+		options: []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+			{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+			{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: make([]byte, 8)},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{7}},
+		},
+	}
+	n.hosts[ip.String()] = h
+	return h
+}
+
+// SetLoss drops this part of the packets put on the network. Which ones is decided by what the packet asks for and how
+// many times it was asked before, not by the order the goroutines send in, so a run loses the same packets every time
+func (n *VirtualNetwork) SetLoss(rate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.loss = rate
+}
+
+// SetLatency delays every answer of the hosts
+func (n *VirtualNetwork) SetLatency(d time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency = d
+}
+
+// SetLinkType makes the conns read and write frames of the link type, like on a tun interface or a BSD loopback.
+// A conn that writes with another framing gets an error
+func (n *VirtualNetwork) SetLinkType(linkType layers.LinkType) error {
+	if _, err := framingFor(linkType); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.linkType = linkType
+	return nil
+}
+
+func (n *VirtualNetwork) link() layers.LinkType {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.linkType
+}
+
+// Interface is the interface the scanners get routed to
+func (n *VirtualNetwork) Interface() *net.Interface {
+	return n.ifi
+}
+
+// Install makes the scanners use the network, restore puts pcap and the real routes back
+func (n *VirtualNetwork) Install() (restore func()) {
+	opener, route, dial := openPacketConn, routeSource, dialUDP
+	openPacketConn, routeSource, dialUDP = n.Open, n.Route, n.DialUDP
+	return func() {
+		openPacketConn, routeSource, dialUDP = opener, route, dial
+	}
+}
+
+// Route gives every target the address and interface of the scanner
+func (n *VirtualNetwork) Route(target net.IP) (net.IP, *net.Interface, error) {
+	return n.ip, n.ifi, nil
+}
+
+// Open is the PacketOpener of the network, every conn sees all the frames on it like pcap in promiscuous mode
+func (n *VirtualNetwork) Open(ifName string, timeout time.Duration) (PacketConn, error) {
+	if ifName != n.ifi.Name {
+		return nil, fmt.Errorf("Error opening %s: no such device on the virtual network", ifName)
+	}
+	c := &virtualConn{
+		net:     n,
+		timeout: timeout,
+		in:      make(chan virtualFrame, 1024),
+		done:    make(chan struct{}),
+	}
+	n.mu.Lock()
+	n.conns[c] = true
+	n.mu.Unlock()
+	return c, nil
+}
+
+// DialUDP works like net.DialTimeout for the hosts of the network, a closed port makes the read fail with connection refused
+func (n *VirtualNetwork) DialUDP(network, address string, timeout time.Duration) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("Error dialing %s: bad port", address)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("Error dialing %s: only IPv4 addresses are on the virtual network", address)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nextPort++
+	c := &virtualUDPConn{
+		net:     n,
+		local:   &net.UDPAddr{IP: n.ip, Port: n.nextPort},
+		remote:  &net.UDPAddr{IP: ip.To4(), Port: port},
+		in:      make(chan []byte, 16),
+		refused: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	n.udp[c.local.Port] = c
+	return c, nil
+}
+
+// SetTCP sets the ports to open, closed or filtered
+func (h *VirtualHost) SetTCP(state string, ports ...int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, p := range ports {
+		h.tcp[p] = state
+	}
+}
+
+// SetUDP sets the ports to open, closed or filtered, the open ones answer with reply (or stay silent when it's nil)
+func (h *VirtualHost) SetUDP(state string, reply []byte, ports ...int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, p := range ports {
+		h.udp[p] = state
+		h.replies[p] = reply
+	}
+}
+
+// SetReject makes the filtered ports answer with ICMP communication administratively prohibited
+func (h *VirtualHost) SetReject(reject bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reject = reject
+}
+
+// SetPing turns the answers to ICMP echo on or off
+func (h *VirtualHost) SetPing(on bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.noPing = !on
+}
+
+// SetStack changes what the SYN-ACKs of the host look like, the options go to the SYNs that have options themselves
+func (h *VirtualHost) SetStack(ttl uint8, window uint16, df bool, options []layers.TCPOption) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ttl, h.window, h.df, h.options = ttl, window, df, options
+}
+
+func (h *VirtualHost) IP() net.IP {
+	return h.ip
+}
+
+func (h *VirtualHost) MAC() net.HardwareAddr {
+	return h.mac
+}
+
+func (h *VirtualHost) tcpState(port int) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.tcp[port]; ok {
+		return s
+	}
+	return "closed"
+}
+
+func (h *VirtualHost) udpState(port int) (string, []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.udp[port]; ok {
+		return s, h.replies[port]
+	}
+	return "closed", nil
+}
+
+type virtualFrame struct {
+	data []byte
+	ts   time.Time
+}
+
+// transmit puts the frame on the wire, everyone listening sees it and the hosts answer it
+func (n *VirtualNetwork) transmit(data []byte) {
+	frame := append([]byte(nil), data...)
+	n.deliver(frame)
+
+	n.mu.Lock()
+	lost := n.lost(frame)
+	latency := n.latency
+	n.mu.Unlock()
+	if lost {
+		return
+	}
+
+	for _, reply := range n.answer(frame) {
+		reply := reply
+		if latency > 0 {
+			time.AfterFunc(latency, func() { n.deliver(reply) })
+		} else {
+			n.deliver(reply)
+		}
+	}
+}
+
+// a hash of the lossKey and its count against the rate, called with the lock held
+func (n *VirtualNetwork) lost(frame []byte) bool {
+	if n.loss <= 0 {
+		return false
+	}
+	key := lossKey(frame)
+	count := n.sends[key]
+	n.sends[key]++
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write(binary.BigEndian.AppendUint64(nil, count))
+	// fnv alone keeps the keys that differ in the last digit close, the murmur finalizer spreads them
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return float64(x>>11)/(1<<53) < n.loss
+}
+
+// what the frame asks for, the address, protocol and port it goes to. the source ports and ids are random so they
+// are left out, the retries of a probe are told apart by the count
+func lossKey(frame []byte) string {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		return fmt.Sprintf("arp %s", net.IP(arp.DstProtAddress))
+	}
+	ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return string(frame)
+	}
+	switch l := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		return fmt.Sprintf("tcp %s:%d", ip4.DstIP, l.DstPort)
+	case *layers.UDP:
+		return fmt.Sprintf("udp %s:%d", ip4.DstIP, l.DstPort)
+	}
+	return fmt.Sprintf("%s %s", ip4.Protocol, ip4.DstIP)
+}
+
+func (n *VirtualNetwork) deliver(frame []byte) {
+	f := virtualFrame{data: frame, ts: time.Now()}
+
+	n.mu.Lock()
+	conns := make([]*virtualConn, 0, len(n.conns))
+	for c := range n.conns {
+		conns = append(conns, c)
+	}
+	n.mu.Unlock()
+
+	if f.data = n.toLink(frame); f.data != nil {
+		for _, c := range conns {
+			select {
+			case c.in <- f:
+			default: // a full buffer drops like a full pcap ring
+			}
+		}
+	}
+	n.deliverUDP(frame)
+}
+
+// toLink gives the frame of the segment the way the conns see it, nil for what the link doesn't carry
+func (n *VirtualNetwork) toLink(frame []byte) []byte {
+	linkType := n.link()
+	if linkType == layers.LinkTypeEthernet {
+		return frame
+	}
+	if len(frame) < 14 || layers.EthernetType(binary.BigEndian.Uint16(frame[12:])) != layers.EthernetTypeIPv4 {
+		return nil
+	}
+
+	hdr := loopbackHeader(linkType)
+	if linkType == layers.LinkTypeLinuxSLL {
+		// packet type, ARPHRD_ETHER, the source address padded to 8 bytes and the protocol
+		hdr = make([]byte, 16)
+		if net.HardwareAddr(frame[6:12]).String() == n.ifi.HardwareAddr.String() {
+			hdr[1] = 4 // outgoing
+		}
+		hdr[3], hdr[5] = 1, 6
+		copy(hdr[6:], frame[6:12])
+		copy(hdr[14:], frame[12:14])
+	}
+	return append(hdr, frame[14:]...)
+}
+
+// the address family in front of IPv4 on the loopback links, in host order on Null and network order on Loop
+func loopbackHeader(linkType layers.LinkType) []byte {
+	switch linkType {
+	case layers.LinkTypeNull:
+		return []byte{byte(layers.ProtocolFamilyIPv4), 0, 0, 0}
+	case layers.LinkTypeLoop:
+		return []byte{0, 0, 0, byte(layers.ProtocolFamilyIPv4)}
+	}
+	return nil
+}
+
+// fromLink is the other way, the conns have to write with the framing of the link
+func (n *VirtualNetwork) fromLink(data []byte) ([]byte, error) {
+	linkType := n.link()
+	if linkType == layers.LinkTypeEthernet {
+		return data, nil
+	}
+
+	if linkType == layers.LinkTypeLinuxSLL {
+		return nil, fmt.Errorf("Error writing packet: nothing can be sent on a Linux cooked capture")
+	}
+	hdr := loopbackHeader(linkType)
+	if len(data) < len(hdr)+20 || string(data[:len(hdr)]) != string(hdr) || data[len(hdr)]>>4 != 4 {
+		return nil, fmt.Errorf("Error writing packet: not an IPv4 packet framed for %s", linkType)
+	}
+
+	// the hosts get it from the scanner like on ethernet
+	ip := data[len(hdr):]
+	frame := make([]byte, 14, 14+len(ip))
+	if h := n.host(net.IP(ip[16:20])); h != nil {
+		copy(frame, h.mac)
+	}
+	copy(frame[6:], n.ifi.HardwareAddr)
+	binary.BigEndian.PutUint16(frame[12:], uint16(layers.EthernetTypeIPv4))
+	return append(frame, ip...), nil
+}
+
+// the answers to the sockets of dialUDP, the datagram itself or the ICMP port unreachable about it
+func (n *VirtualNetwork) deliverUDP(frame []byte) {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok || !ip4.DstIP.Equal(n.ip) {
+		return
+	}
+
+	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		n.mu.Lock()
+		c := n.udp[int(udp.DstPort)]
+		n.mu.Unlock()
+		if c != nil && c.remote.IP.Equal(ip4.SrcIP) && c.remote.Port == int(udp.SrcPort) {
+			select {
+			case c.in <- append([]byte(nil), udp.Payload...):
+			default:
+			}
+		}
+		return
+	}
+
+	icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	if !ok || icmp.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort) {
+		return
+	}
+	inner := gopacket.NewPacket(icmp.Payload, layers.LayerTypeIPv4, gopacket.Default)
+	innerIP, ok := inner.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok || innerIP.Protocol != layers.IPProtocolUDP {
+		return
+	}
+	srcPort, _, ok := innerPorts(innerIP)
+	if !ok {
+		return
+	}
+	n.mu.Lock()
+	c := n.udp[srcPort]
+	n.mu.Unlock()
+	if c != nil {
+		select {
+		case c.refused <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// what the hosts send back to the frame
+func (n *VirtualNetwork) answer(frame []byte) [][]byte {
+	packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+	eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		return nil
+	}
+
+	if arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+		if arp.Operation != layers.ARPRequest {
+			return nil
+		}
+		h := n.host(net.IP(arp.DstProtAddress))
+		if h == nil {
+			return nil
+		}
+		return n.frames(h.arpReply(eth, arp))
+	}
+
+	ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return nil
+	}
+	h := n.host(ip4.DstIP)
+	if h == nil || ip4.SrcIP.Equal(h.ip) {
+		return nil
+	}
+
+	switch {
+	case packet.Layer(layers.LayerTypeTCP) != nil:
+		return n.frames(h.answerTCP(eth, ip4, packet.Layer(layers.LayerTypeTCP).(*layers.TCP)))
+	case packet.Layer(layers.LayerTypeUDP) != nil:
+		return n.frames(h.answerUDP(eth, ip4, packet.Layer(layers.LayerTypeUDP).(*layers.UDP)))
+	case packet.Layer(layers.LayerTypeICMPv4) != nil:
+		return n.frames(h.answerICMP(eth, ip4, packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)))
+	}
+	return nil
+}
+
+func (n *VirtualNetwork) host(ip net.IP) *VirtualHost {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.hosts[ip.String()]
+}
+
+// serializes the layers of every answer, the ones that fail to serialize are left out
+func (n *VirtualNetwork) frames(answers ...[]gopacket.SerializableLayer) [][]byte {
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	var out [][]byte
+	for _, ls := range answers {
+		if ls == nil {
+			continue
+		}
+		buf := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buf, opts, ls...); err == nil {
+			out = append(out, append([]byte(nil), buf.Bytes()...))
+		}
+	}
+	return out
+}
+
+func (h *VirtualHost) arpReply(eth *layers.Ethernet, arp *layers.ARP) []gopacket.SerializableLayer {
+	return []gopacket.SerializableLayer{
+		&layers.Ethernet{SrcMAC: h.mac, DstMAC: eth.SrcMAC, EthernetType: layers.EthernetTypeARP},
+		&layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         layers.ARPReply,
+			SourceHwAddress:   []byte(h.mac),
+			SourceProtAddress: []byte(h.ip),
+			DstHwAddress:      arp.SourceHwAddress,
+			DstProtAddress:    arp.SourceProtAddress,
+		},
+	}
+}
+
+// the ethernet and IP layers of an answer to the packet
+func (h *VirtualHost) replyLayers(eth *layers.Ethernet, ip4 *layers.IPv4, proto layers.IPProtocol) (*layers.Ethernet, *layers.IPv4) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      h.ttl,
+		Protocol: proto,
+		SrcIP:    h.ip,
+		DstIP:    ip4.SrcIP,
+	}
+	if h.df {
+		ip.Flags = layers.IPv4DontFragment
+	}
+	return &layers.Ethernet{SrcMAC: h.mac, DstMAC: eth.SrcMAC, EthernetType: layers.EthernetTypeIPv4}, ip
+}
+
+// an ICMP unreachable with the header and the first 8 bytes of the packet it is about
+func (h *VirtualHost) unreachable(eth *layers.Ethernet, ip4 *layers.IPv4, code uint8) []gopacket.SerializableLayer {
+	e, ip := h.replyLayers(eth, ip4, layers.IPProtocolICMPv4)
+	quoted := append(append([]byte(nil), ip4.Contents...), ip4.Payload...)
+	if len(quoted) > len(ip4.Contents)+8 {
+		quoted = quoted[:len(ip4.Contents)+8]
+	}
+	return []gopacket.SerializableLayer{
+		e, ip,
+		&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, code)},
+		gopacket.Payload(quoted),
+	}
+}
+
+// a filtered port drops the probe or rejects it with ICMP
+func (h *VirtualHost) filtered(eth *layers.Ethernet, ip4 *layers.IPv4) []gopacket.SerializableLayer {
+	h.mu.Lock()
+	reject := h.reject
+	h.mu.Unlock()
+	if !reject {
+		return nil
+	}
+	return h.unreachable(eth, ip4, layers.ICMPv4CodeCommAdminProhibited)
+}
+
+func (h *VirtualHost) answerTCP(eth *layers.Ethernet, ip4 *layers.IPv4, tcp *layers.TCP) []gopacket.SerializableLayer {
+	state := h.tcpState(int(tcp.DstPort))
+	if state == "filtered" {
+		return h.filtered(eth, ip4)
+	}
+	if tcp.RST {
+		return nil
+	}
+
+	e, ip := h.replyLayers(eth, ip4, layers.IPProtocolTCP)
+	reply := &layers.TCP{
+		SrcPort: tcp.DstPort,
+		DstPort: tcp.SrcPort,
+	}
+
+	switch {
+	case tcp.SYN && !tcp.ACK && state == "open":
+		h.mu.Lock()
+		reply.SYN, reply.ACK = true, true
+		reply.Seq = uint32(tcp.DstPort)<<16 | uint32(tcp.SrcPort)
+		reply.Ack = tcp.Seq + 1
+		reply.Window = h.window
+		if len(tcp.Options) > 0 {
+			reply.Options = h.options
+		} else if len(h.options) > 0 && h.options[0].OptionType == layers.TCPOptionKindMSS {
+			// a SYN without options only gets the MSS back
+			reply.Options = h.options[:1]
+		}
+		h.mu.Unlock()
+	case tcp.SYN && !tcp.ACK:
+		reply.RST, reply.ACK = true, true
+		reply.Ack = tcp.Seq + 1
+	default:
+		// an ACK without a connection gets a RST whether the port is open or not
+		reply.RST = true
+		reply.Seq = tcp.Ack
+	}
+	reply.SetNetworkLayerForChecksum(ip)
+	return []gopacket.SerializableLayer{e, ip, reply}
+}
+
+func (h *VirtualHost) answerUDP(eth *layers.Ethernet, ip4 *layers.IPv4, udp *layers.UDP) []gopacket.SerializableLayer {
+	state, payload := h.udpState(int(udp.DstPort))
+	switch state {
+	case "filtered":
+		return h.filtered(eth, ip4)
+	case "open":
+		if payload == nil {
+			return nil
+		}
+		e, ip := h.replyLayers(eth, ip4, layers.IPProtocolUDP)
+		reply := &layers.UDP{SrcPort: udp.DstPort, DstPort: udp.SrcPort}
+		reply.SetNetworkLayerForChecksum(ip)
+		return []gopacket.SerializableLayer{e, ip, reply, gopacket.Payload(payload)}
+	}
+	return h.unreachable(eth, ip4, layers.ICMPv4CodePort)
+}
+
+func (h *VirtualHost) answerICMP(eth *layers.Ethernet, ip4 *layers.IPv4, icmp *layers.ICMPv4) []gopacket.SerializableLayer {
+	h.mu.Lock()
+	noPing := h.noPing
+	h.mu.Unlock()
+	if noPing || icmp.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+		return nil
+	}
+	e, ip := h.replyLayers(eth, ip4, layers.IPProtocolICMPv4)
+	reply := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+		Id:       icmp.Id,
+		Seq:      icmp.Seq,
+	}
+	return []gopacket.SerializableLayer{e, ip, reply, gopacket.Payload(icmp.Payload)}
+}
+
+// the PacketConn of the network, the BPF filter is not applied so the scanners see everything and skip what's not theirs
+type virtualConn struct {
+	net       *VirtualNetwork
+	timeout   time.Duration
+	in        chan virtualFrame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *virtualConn) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	var timeout <-chan time.Time
+	if c.timeout > 0 {
+		t := time.NewTimer(c.timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case f := <-c.in:
+		ci := gopacket.CaptureInfo{Timestamp: f.ts, CaptureLength: len(f.data), Length: len(f.data), InterfaceIndex: c.net.ifi.Index}
+		return f.data, ci, nil
+	case <-timeout:
+		return nil, gopacket.CaptureInfo{}, ErrPacketTimeout
+	case <-c.done:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+}
+
+func (c *virtualConn) WritePacketData(data []byte) error {
+	select {
+	case <-c.done:
+		return fmt.Errorf("Error writing packet: conn closed")
+	default:
+	}
+	frame, err := c.net.fromLink(data)
+	if err != nil {
+		return err
+	}
+	c.net.transmit(frame)
+	return nil
+}
+
+func (c *virtualConn) SetBPFFilter(filter string) error {
+	return nil
+}
+
+func (c *virtualConn) LinkType() layers.LinkType {
+	return c.net.link()
+}
+
+func (c *virtualConn) Close() {
+	c.closeOnce.Do(func() {
+		c.net.mu.Lock()
+		delete(c.net.conns, c)
+		c.net.mu.Unlock()
+		close(c.done)
+	})
+}
+
+// the UDP socket of the network, the datagrams go out as frames so the conns see them too
+type virtualUDPConn struct {
+	net       *VirtualNetwork
+	local     *net.UDPAddr
+	remote    *net.UDPAddr
+	in        chan []byte
+	refused   chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (c *virtualUDPConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case p := <-c.in:
+		return copy(b, p), nil
+	case <-c.refused:
+		return 0, c.opError("read", os.NewSyscallError("recvfrom", syscall.ECONNREFUSED))
+	case <-timeout:
+		return 0, c.opError("read", os.ErrDeadlineExceeded)
+	case <-c.done:
+		return 0, c.opError("read", net.ErrClosed)
+	}
+}
+
+func (c *virtualUDPConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, c.opError("write", net.ErrClosed)
+	default:
+	}
+
+	eth := &layers.Ethernet{SrcMAC: c.net.ifi.HardwareAddr, EthernetType: layers.EthernetTypeIPv4}
+	if h := c.net.host(c.remote.IP); h != nil {
+		eth.DstMAC = h.mac
+	} else {
+		eth.DstMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	}
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: c.local.IP, DstIP: c.remote.IP}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(c.local.Port), DstPort: layers.UDPPort(c.remote.Port)}
+	udp.SetNetworkLayerForChecksum(ip)
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, gopacket.Payload(b)); err != nil {
+		return 0, c.opError("write", err)
+	}
+	c.net.transmit(buf.Bytes())
+	return len(b), nil
+}
+
+func (c *virtualUDPConn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "udp", Source: c.local, Addr: c.remote, Err: err}
+}
+
+func (c *virtualUDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.net.mu.Lock()
+		delete(c.net.udp, c.local.Port)
+		c.net.mu.Unlock()
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *virtualUDPConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *virtualUDPConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *virtualUDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *virtualUDPConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return nil
+}
+
+func (c *virtualUDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,515 @@
+package portslibK
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var (
+	testScannerIP = net.IPv4(10, 0, 0, 1)
+	testTargetIP  = net.IPv4(10, 0, 0, 2)
+)
+
+// a network with a single host on it, installed until the test ends
+func newTestNetwork(t *testing.T) (*VirtualNetwork, *VirtualHost) {
+	t.Helper()
+	n := NewVirtualNetwork(testScannerIP)
+	h := n.AddHost(testTargetIP)
+	t.Cleanup(n.Install())
+	return n, h
+}
+
+func synScan(t *testing.T, timeout time.Duration, port int) string {
+	t.Helper()
+	s, err := NewSynScanner(timeout, testTargetIP, []int{port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := s.Scan(port)
+	if err != nil {
+		t.Fatalf("SYN scan of port %d: %v", port, err)
+	}
+	return report
+}
+
+func dnsReply(t *testing.T) []byte {
+	t.Helper()
+	dns := &layers.DNS{
+		ID:           1,
+		QR:           true,
+		RA:           true,
+		ResponseCode: layers.DNSResponseCodeNoErr,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVirtualGetMac(t *testing.T) {
+	_, h := newTestNetwork(t)
+
+	s, err := NewSynScanner(time.Second, testTargetIP, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac, err := s.GetMac()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mac.String() != h.MAC().String() {
+		t.Errorf("got mac %s, want %s", mac, h.MAC())
+	}
+}
+
+func TestVirtualSynScan(t *testing.T) {
+	_, h := newTestNetwork(t)
+	h.SetTCP("open", 22)
+	h.SetTCP("filtered", 443)
+
+	for _, c := range []struct {
+		port  int
+		state string
+	}{
+		{22, "is open"},
+		{80, "is closed"},
+		{443, "is filtered"},
+	} {
+		if report := synScan(t, time.Millisecond*300, c.port); !strings.Contains(report, c.state) {
+			t.Errorf("port %d: got %q, want %q", c.port, report, c.state)
+		}
+	}
+}
+
+func TestVirtualSynScanReject(t *testing.T) {
+	_, h := newTestNetwork(t)
+	h.SetTCP("filtered", 443)
+	h.SetReject(true)
+
+	if report := synScan(t, time.Millisecond*300, 443); !strings.Contains(report, "is filtered") {
+		t.Errorf("got %q, want filtered", report)
+	}
+}
+
+func TestVirtualSynScanLatency(t *testing.T) {
+	n, h := newTestNetwork(t)
+	h.SetTCP("open", 22)
+
+	n.SetLatency(time.Millisecond * 50)
+	if report := synScan(t, time.Millisecond*500, 22); !strings.Contains(report, "is open") {
+		t.Errorf("answer before the timeout: got %q, want open", report)
+	}
+
+	// the ARP has its own longer timeout, only the SYN-ACK comes too late
+	n.SetLatency(time.Millisecond * 400)
+	if report := synScan(t, time.Millisecond*200, 22); !strings.Contains(report, "is filtered") {
+		t.Errorf("answer after the timeout: got %q, want filtered", report)
+	}
+}
+
+func TestVirtualSynScanLoss(t *testing.T) {
+	n, h := newTestNetwork(t)
+	h.SetTCP("open", 22)
+	n.SetLoss(1)
+
+	s, err := NewSynScanner(time.Millisecond*200, testTargetIP, []int{22})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ARP request is lost as well
+	if _, err := s.Scan(22); err == nil {
+		t.Error("expected an error without an ARP reply")
+	}
+}
+
+// half of the packets are lost, the same ones in every run however the scans run at once
+func TestVirtualLossRepeats(t *testing.T) {
+	ports := make([]int, 20)
+	for i := range ports {
+		ports[i] = 1000 + i
+	}
+	run := func() map[int]string {
+		n, h := newTestNetwork(t)
+		h.SetUDP("open", []byte("hello"), ports...)
+		n.SetLoss(0.5)
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		states := make(map[int]string)
+		for _, port := range ports {
+			wg.Add(1)
+			go func(port int) {
+				defer wg.Done()
+				r, _ := UDPScan(testTargetIP, port, time.Millisecond*100)
+				mu.Lock()
+				states[port] = r.state
+				mu.Unlock()
+			}(port)
+		}
+		wg.Wait()
+		return states
+	}
+
+	first := run()
+	open := 0
+	for _, state := range first {
+		if state == "open" {
+			open++
+		}
+	}
+	// both datagrams to a port have to be lost for it not to be open
+	if open == 0 || open == len(ports) {
+		t.Errorf("%d of %d ports open with half of the packets lost", open, len(ports))
+	}
+	for i := 0; i < 2; i++ {
+		if again := run(); !reflect.DeepEqual(first, again) {
+			t.Fatalf("the same loss gave %v and then %v", first, again)
+		}
+	}
+}
+
+func TestVirtualACKScan(t *testing.T) {
+	_, h := newTestNetwork(t)
+	h.SetTCP("open", 22)
+	h.SetTCP("filtered", 443)
+
+	s, err := NewACKScanner(testTargetIP, []int{22, 80, 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.timeout = time.Millisecond * 300
+
+	for _, c := range []struct {
+		port  int
+		state ACKState
+	}{
+		{22, AckUnfiltered},
+		{80, AckUnfiltered},
+		{443, AckFiltered},
+	} {
+		state, err := s.Scan(c.port)
+		if err != nil {
+			t.Fatalf("ACK scan of port %d: %v", c.port, err)
+		}
+		if state != string(c.state) {
+			t.Errorf("port %d: got %s, want %s", c.port, state, c.state)
+		}
+	}
+
+	h.SetReject(true)
+	if state, _ := s.Scan(443); state != string(AckFiltered) {
+		t.Errorf("rejected port: got %s, want %s", state, AckFiltered)
+	}
+}
+
+func TestVirtualACKScanOtherUnreachable(t *testing.T) {
+	n, h := newTestNetwork(t)
+	h.SetTCP("open", 22)
+	n.SetLatency(time.Millisecond * 100)
+
+	s, err := NewACKScanner(testTargetIP, []int{22})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.timeout = time.Millisecond * 500
+
+	// a reject of a probe to another port comes before the RST of this one
+	probe := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(probe, gopacket.SerializeOptions{FixLengths: true},
+		&layers.Ethernet{SrcMAC: n.Interface().HardwareAddr, DstMAC: h.MAC(), EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: testScannerIP, DstIP: testTargetIP},
+		&layers.TCP{SrcPort: layers.TCPPort(s.sourcePort), DstPort: 443, ACK: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := gopacket.NewPacket(probe.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	eth := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	ip4 := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	reject := n.frames(h.unreachable(eth, ip4, layers.ICMPv4CodeCommAdminProhibited))[0]
+	time.AfterFunc(time.Millisecond*30, func() { n.deliver(reject) })
+
+	state, err := s.Scan(22)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != string(AckUnfiltered) {
+		t.Errorf("got %s, want %s", state, AckUnfiltered)
+	}
+}
+
+func TestVirtualUDPScan(t *testing.T) {
+	_, h := newTestNetwork(t)
+	h.SetUDP("open", dnsReply(t), 53)
+	h.SetUDP("open", nil, 161)
+	h.SetUDP("filtered", nil, 500)
+	h.SetTCP("filtered", 500)
+
+	r, err := UDPScan(testTargetIP, 53, time.Millisecond*300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.state != "open" || r.service != "domain" {
+		t.Errorf("port 53: got %s %q, want open domain", r.state, r.service)
+	}
+
+	r, err = UDPScan(testTargetIP, 123, time.Millisecond*300)
+	if err == nil || r.state != "closed" {
+		t.Errorf("port 123: got %s (%v), want closed with the refused error", r.state, err)
+	}
+
+	// a silent port is open|filtered and the ACK scan decides, the RST to it says there's no firewall
+	r, err = UDPScan(testTargetIP, 161, time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.state != string(AckOpen) {
+		t.Errorf("port 161: got %s, want %s", r.state, AckOpen)
+	}
+
+	r, err = UDPScan(testTargetIP, 500, time.Millisecond*200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.state != string(AckFiltered) {
+		t.Errorf("port 500: got %s, want %s", r.state, AckFiltered)
+	}
+}
+
+// the made up frames of the UDP datagrams are of the link the ACK fallback captures on, the file has one link type
+func TestVirtualUDPRecordLinkType(t *testing.T) {
+	n, h := newTestNetwork(t)
+	h.SetUDP("open", dnsReply(t), 53)
+	h.SetUDP("open", nil, 161)
+	if err := n.SetLinkType(layers.LinkTypeNull); err != nil {
+		t.Fatal(err)
+	}
+
+	var file bytes.Buffer
+	rec, err := NewPcapngRecorder(&file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewUDPScanner(time.Millisecond*200, testTargetIP, []int{53, 161})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetRecorder(rec)
+	for _, port := range []int{53, 161} {
+		if _, err := s.Scan(port); err != nil {
+			t.Fatalf("UDP scan of port %d: %v", port, err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := pcapgo.NewNgReader(&file, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var udp, tcp int
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		packet := gopacket.NewPacket(data, r.LinkType(), gopacket.Default)
+		if packet.Layer(layers.LayerTypeUDP) != nil {
+			udp++
+		}
+		if packet.Layer(layers.LayerTypeTCP) != nil {
+			tcp++
+		}
+	}
+	if r.LinkType() != layers.LinkTypeNull || r.NInterfaces() != 1 {
+		t.Errorf("got %d interfaces, the first %s, want a single %s", r.NInterfaces(), r.LinkType(), layers.LinkTypeNull)
+	}
+	// the query and answer to 53, the two queries to 161 and the ACK with its RST
+	if udp != 4 || tcp != 2 {
+		t.Errorf("got %d UDP and %d TCP packets, want 4 and 2", udp, tcp)
+	}
+}
+
+func TestVirtualOSDetection(t *testing.T) {
+	_, h := newTestNetwork(t)
+	h.SetTCP("open", 22, 80)
+
+	s, err := NewSynScanner(time.Millisecond*300, testTargetIP, []int{22, 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.EnableOSDetection(true)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	guess := s.OSGuess()
+	if guess == nil || guess.Class != "Linux" {
+		t.Fatalf("got %v, want a Linux guess", guess)
+	}
+
+	h.SetStack(128, 8192, true, []layers.TCPOption{
+		{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}},
+		{OptionType: layers.TCPOptionKindNop},
+		{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{8}},
+		{OptionType: layers.TCPOptionKindNop},
+		{OptionType: layers.TCPOptionKindNop},
+		{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+	})
+	s, err = NewSynScanner(time.Millisecond*300, testTargetIP, []int{22, 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.EnableOSDetection(true)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if guess := s.OSGuess(); guess == nil || guess.Name != "Windows 7 / 2008 R2" {
+		t.Fatalf("got %v, want Windows 7", guess)
+	}
+}
+
+func TestVirtualPassive(t *testing.T) {
+	_, h := newTestNetwork(t)
+	h.SetTCP("open", 22)
+
+	// it stops by the duration, a Stop right after the scans could come before it read what's queued
+	p, err := NewPassiveScanner(time.Millisecond*300, testTargetIP, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- p.Listen() }()
+	time.Sleep(time.Millisecond * 50) // let it open the conn before the traffic
+
+	synScan(t, time.Millisecond*300, 22)
+	synScan(t, time.Millisecond*300, 80)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	var host *HostResult
+	for _, hr := range p.Hosts() {
+		if hr.IP.Equal(testTargetIP) {
+			host = hr
+		}
+	}
+	if host == nil {
+		t.Fatal("the target was not seen")
+	}
+	if host.MAC.String() != h.MAC().String() {
+		t.Errorf("got mac %s, want %s", host.MAC, h.MAC())
+	}
+	if r, ok := host.TCP[22]; !ok || r.state != "open" {
+		t.Errorf("port 22: got %+v, want open", r)
+	}
+	if r, ok := host.TCP[80]; !ok || r.state != "closed" {
+		t.Errorf("port 80: got %+v, want closed", r)
+	}
+}
+
+func TestVirtualSweep(t *testing.T) {
+	_, h := newTestNetwork(t)
+	h.SetTCP("open", 22, 443)
+	h.SetTCP("filtered", 8080)
+
+	ports := []int{21, 22, 80, 443, 8080}
+	s, err := NewSynScanner(time.Millisecond*300, testTargetIP, ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.EnableBatch(2)
+	results, err := s.Sweep()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[int]string{21: "closed", 22: "open", 80: "closed", 443: "open", 8080: "filtered"}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for _, r := range results {
+		if r.state != want[r.port] {
+			t.Errorf("port %d: got %s, want %s", r.port, r.state, want[r.port])
+		}
+	}
+}
+
+// the scanners frame their packets like the link of the handle, the network refuses anything else
+func TestVirtualLinkTypes(t *testing.T) {
+	for _, linkType := range []layers.LinkType{layers.LinkTypeRaw, layers.LinkTypeNull, layers.LinkTypeLoop} {
+		t.Run(linkType.String(), func(t *testing.T) {
+			n, h := newTestNetwork(t)
+			h.SetTCP("open", 22)
+			h.SetTCP("filtered", 443)
+			h.SetReject(true)
+			if err := n.SetLinkType(linkType); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range []struct {
+				port  int
+				state string
+			}{
+				{22, "is open"},
+				{80, "is closed"},
+			} {
+				if report := synScan(t, time.Millisecond*300, c.port); !strings.Contains(report, c.state) {
+					t.Errorf("SYN to port %d: got %q, want %q", c.port, report, c.state)
+				}
+			}
+
+			s, err := NewSynScanner(time.Millisecond*300, testTargetIP, []int{22, 80})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.GetMac(); err == nil {
+				t.Error("ARP on a link without ethernet")
+			}
+			results, err := s.Sweep()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 2 || results[0].state != "open" || results[1].state != "closed" {
+				t.Errorf("sweep: got %v", results)
+			}
+
+			a, err := NewACKScanner(testTargetIP, []int{22, 443})
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.timeout = time.Millisecond * 300
+			if state, err := a.Scan(22); err != nil || state != string(AckUnfiltered) {
+				t.Errorf("ACK to port 22: got %s, %v", state, err)
+			}
+			if state, err := a.Scan(443); err != nil || state != string(AckFiltered) {
+				t.Errorf("ACK to port 443: got %s, %v", state, err)
+			}
+		})
+	}
+
+	// a cooked capture can be read but not sent on
+	n, _ := newTestNetwork(t)
+	if err := n.SetLinkType(layers.LinkTypeLinuxSLL); err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSynScanner(time.Millisecond*300, testTargetIP, []int{22})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Scan(22); err == nil {
+		t.Error("SYN sent on a cooked capture")
+	}
+	if err := n.SetLinkType(layers.LinkTypeFDDI); err == nil {
+		t.Error("expected an error for an unsupported link type")
+	}
+}
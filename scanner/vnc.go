@@ -0,0 +1,175 @@
+package portslibK
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var vncSecurityTypes = map[byte]string{
+	0:   "invalid",
+	1:   "None",
+	2:   "VNC Authentication",
+	5:   "RA2",
+	6:   "RA2ne",
+	16:  "Tight",
+	17:  "Ultra",
+	18:  "TLS",
+	19:  "VeNCrypt",
+	20:  "GTK-VNC SASL",
+	21:  "MD5 hash",
+	22:  "Colin Dean xvp",
+	30:  "Apple Remote Desktop",
+	113: "Apple iCloud",
+}
+
+// VNCInfo is the RFB version of the server and the security types it offered
+type VNCInfo struct {
+	Version       string // like 3.8
+	SecurityTypes []string
+	Error         string   // the reason the server sent instead of the security types
+	Weak          []string // why the service is considered insecure
+}
+
+// VNCProbe reads the RFB handshake up to the security types, it is a PortProbe
+type VNCProbe struct {
+	Timeout time.Duration
+}
+
+func NewVNCProbe(timeout time.Duration) *VNCProbe {
+	return &VNCProbe{
+		Timeout: timeout,
+	}
+}
+
+func (p *VNCProbe) Name() string {
+	return "vnc"
+}
+
+func (p *VNCProbe) Probe(targetIP net.IP, r *TCPResult) error {
+	switch {
+	case r.service != nil:
+		if r.service.Service != "vnc" {
+			return nil
+		}
+	case strings.HasPrefix(r.banner, "RFB "):
+	case r.port < 5900 || r.port > 5910:
+		return nil
+	}
+
+	info, err := p.Fingerprint(targetIP, r.port)
+	if err != nil {
+		return err
+	}
+	r.vnc = info
+	return nil
+}
+
+// FingerprintVNC gets the RFB version and the security types of the server
+func FingerprintVNC(targetIP net.IP, port int, timeout time.Duration) (*VNCInfo, error) {
+	return NewVNCProbe(timeout).Fingerprint(targetIP, port)
+}
+
+func (p *VNCProbe) Fingerprint(targetIP net.IP, port int) (*VNCInfo, error) {
+	addr := net.JoinHostPort(targetIP.String(), strconv.Itoa(port))
+	c, err := net.DialTimeout("tcp", addr, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(p.Timeout))
+
+	// "RFB 003.008\n"
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(c, version); err != nil {
+		return nil, fmt.Errorf("Error reading RFB version: %v", err)
+	}
+	if string(version[:4]) != "RFB " || version[11] != '\n' {
+		return nil, fmt.Errorf("Not an RFB server: %q", version)
+	}
+	major, err1 := strconv.Atoi(string(version[4:7]))
+	minor, err2 := strconv.Atoi(string(version[8:11]))
+	if err1 != nil || err2 != nil {
+		return nil, fmt.Errorf("Bad RFB version: %q", version)
+	}
+	info := &VNCInfo{
+		Version: fmt.Sprintf("%d.%d", major, minor),
+	}
+
+	// we answer with the highest version we know that the server has too
+	reply := "RFB 003.008\n"
+	if major == 3 && minor < 7 {
+		reply = "RFB 003.003\n"
+	} else if major == 3 && minor == 7 {
+		reply = "RFB 003.007\n"
+	}
+	if _, err := c.Write([]byte(reply)); err != nil {
+		return nil, err
+	}
+
+	var types []byte
+	if reply == "RFB 003.003\n" {
+		// the server picks the type and sends it as a uint32
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return nil, fmt.Errorf("Error reading security type: %v", err)
+		}
+		types = []byte{byte(binary.BigEndian.Uint32(b))}
+	} else {
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(c, n); err != nil {
+			return nil, fmt.Errorf("Error reading security types: %v", err)
+		}
+		types = make([]byte, n[0])
+		if _, err := io.ReadFull(c, types); err != nil {
+			return nil, fmt.Errorf("Error reading security types: %v", err)
+		}
+	}
+
+	// no types means a failure with the reason after it, like too many authentication failures
+	if len(types) == 0 || types[0] == 0 {
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(c, b); err == nil {
+			reason := make([]byte, min(binary.BigEndian.Uint32(b), 1024))
+			n, _ := io.ReadFull(c, reason)
+			info.Error = string(reason[:n])
+		}
+		return info, nil
+	}
+
+	for _, t := range types {
+		name, ok := vncSecurityTypes[t]
+		if !ok {
+			name = fmt.Sprintf("unknown (%d)", t)
+		}
+		info.SecurityTypes = append(info.SecurityTypes, name)
+		if t == 1 {
+			info.Weak = append(info.Weak, "no authentication")
+		}
+	}
+	if major == 3 && minor < 7 {
+		info.Weak = append(info.Weak, "RFB "+info.Version)
+	}
+	if len(types) == 1 && types[0] == 2 {
+		info.Weak = append(info.Weak, "only DES challenge authentication")
+	}
+	return info, nil
+}
+
+func (i *VNCInfo) String() string {
+	s := fmt.Sprintf("RFB %s", i.Version)
+	if len(i.SecurityTypes) > 0 {
+		s += fmt.Sprintf(", security types: %s", strings.Join(i.SecurityTypes, ", "))
+	}
+	if i.Error != "" {
+		s += fmt.Sprintf(", error: %s", i.Error)
+	}
+	if len(i.Weak) > 0 {
+		s += fmt.Sprintf("\n  weak: %s", strings.Join(i.Weak, ", "))
+	}
+	return s
+}